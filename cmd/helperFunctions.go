@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -13,6 +14,7 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/ipmess/dentistbackend/pkg/appointments"
+	"github.com/ipmess/dentistbackend/pkg/clinic"
 	"github.com/ipmess/dentistbackend/pkg/models"
 	"gorm.io/driver/mysql"
 	"gorm.io/gorm"
@@ -24,10 +26,33 @@ type Config struct {
 	Password   string `json:"password"`
 	Database   string `json:"database"`
 	PopulateDB bool   `json:"populate_db"`
+	// Notify the best waitlist candidate automatically when a slot is freed:
+	WaitlistAutoNotify bool `json:"waitlist_auto_notify"`
+	// The first day of the week, e.g. "monday" (the default):
+	WeekStart string `json:"week_start"`
+	// The clinic's IANA time zone, e.g. "Asia/Nicosia" (the default):
+	TimeZone string `json:"time_zone"`
+	// The time zone earlier versions stored times in (the server's local
+	// time), to convert them to UTC once when upgrading:
+	StoredTimeZone string `json:"stored_time_zone"`
+	// The secret in the URL of the calendar feed; empty switches the feed off:
+	CalendarFeedToken string `json:"calendar_feed_token"`
+	// The credentials of calendar apps syncing over CalDAV; an empty password
+	// switches CalDAV off:
+	CalDAVUsername string `json:"caldav_username"`
+	CalDAVPassword string `json:"caldav_password"`
+	// Google Calendar sync, switched on by google_refresh_token (or by
+	// google_api_url, for a fake Calendar API server without OAuth):
+	GoogleCalendarID   string `json:"google_calendar_id"`
+	GoogleClientID     string `json:"google_client_id"`
+	GoogleClientSecret string `json:"google_client_secret"`
+	GoogleRefreshToken string `json:"google_refresh_token"`
+	GoogleWebhookURL   string `json:"google_webhook_url"`
+	GoogleAPIURL       string `json:"google_api_url"`
 }
 
 func initDB(endpoint, database, username, password string) (*gorm.DB, error) {
-	dsn := username + ":" + password + "@tcp(" + endpoint + ")/" + database + "?charset=utf8mb4&parseTime=True&loc=Local"
+	dsn := username + ":" + password + "@tcp(" + endpoint + ")/" + database + "?charset=utf8mb4&parseTime=True&loc=UTC"
 	// Open the database connection:
 	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
 	if err != nil {
@@ -36,6 +61,72 @@ func initDB(endpoint, database, username, password string) (*gorm.DB, error) {
 	return db, nil
 }
 
+// migrateStoredTimes converts every DATETIME column from storedZone, the
+// server's local time that earlier versions stored times in, to UTC, once.
+// A database without appointments, patients or time off has nothing to
+// convert. Otherwise storedZone is required, and named time zones need
+// MariaDB's time zone tables (mariadb-tzinfo-to-sql).
+func migrateStoredTimes(db *gorm.DB, storedZone string) error {
+	var migrated int64
+	if err := db.Model(&models.TimeZoneMigration{}).Count(&migrated).Error; err != nil {
+		return err
+	}
+	if migrated > 0 {
+		return nil
+	}
+	var stored int64
+	for _, model := range []any{&models.Appointment{}, &models.Patient{}, &models.TimeOff{}} {
+		var count int64
+		if err := db.Model(model).Unscoped().Count(&count).Error; err != nil {
+			return err
+		}
+		stored += count
+	}
+	if stored == 0 {
+		return db.Create(&models.TimeZoneMigration{FromZone: "UTC", MigratedAt: time.Now()}).Error
+	}
+	if storedZone == "" {
+		return errors.New("the times in the database were stored in the server's local time and must be converted to UTC once: " +
+			`set stored_time_zone in config.json to the server's time zone, e.g. "Asia/Nicosia", or to "UTC" if it ran in UTC`)
+	}
+	if _, err := time.LoadLocation(storedZone); err != nil {
+		return fmt.Errorf("stored_time_zone: %w", err)
+	}
+	err := db.Transaction(func(tx *gorm.DB) error {
+		if storedZone != "UTC" {
+			var known bool
+			err := tx.Raw("SELECT CONVERT_TZ('2025-01-01 00:00:00', ?, '+00:00') IS NOT NULL", storedZone).Scan(&known).Error
+			if err != nil {
+				return err
+			}
+			if !known {
+				return fmt.Errorf("the database does not know the time zone %q: load its time zone tables with mariadb-tzinfo-to-sql", storedZone)
+			}
+			var columns []struct {
+				TableName  string
+				ColumnName string
+			}
+			err = tx.Raw("SELECT TABLE_NAME AS table_name, COLUMN_NAME AS column_name FROM information_schema.COLUMNS " +
+				"WHERE TABLE_SCHEMA = DATABASE() AND DATA_TYPE = 'datetime'").Scan(&columns).Error
+			if err != nil {
+				return err
+			}
+			for _, column := range columns {
+				err := tx.Exec(fmt.Sprintf("UPDATE `%s` SET `%s` = CONVERT_TZ(`%s`, ?, '+00:00')",
+					column.TableName, column.ColumnName, column.ColumnName), storedZone).Error
+				if err != nil {
+					return fmt.Errorf("converting %s.%s to UTC: %w", column.TableName, column.ColumnName, err)
+				}
+			}
+		}
+		return tx.Create(&models.TimeZoneMigration{FromZone: storedZone, MigratedAt: time.Now()}).Error
+	})
+	if err == nil {
+		log.Printf("Converted the stored times from %s to UTC\n", storedZone)
+	}
+	return err
+}
+
 func loadConfig(filename string) (Config, error) {
 	var config Config
 	file, err := os.Open(filename)
@@ -134,37 +225,12 @@ func populate(ctx context.Context, db *gorm.DB) error {
 		return result.Error
 	}
 
-	// First off, we need to add a single appointment so that the appointment overlap check does not fail due to an empty appointments table:
-	appointmentType := appointmentTypes[rand.Intn(len(appointmentTypes))]
-	patient := patients[rand.Intn(len(patients))]
-	startTime := time.Now().AddDate(0, 0, -2)
-	tempUUID, _ := uuid.NewV7()
-	newAppointment := models.Appointment{
-		UUID:              tempUUID.String(),
-		PatientID:         patient.ID,
-		AppointmentTypeID: appointmentType.ID,
-		StartTime:         startTime,
-		Duration:          appointmentType.DefaultDuration,
-		Viber:             patient.Viber,
-		Whatsapp:          patient.Whatsapp,
-		SMS:               patient.SMS,
-		EmailNotification: patient.EmailNotification,
-		Reminder:          rand.Intn(48) + 12,
-		Patient:           patient,
-		AppointmentType:   appointmentType,
-	}
-
-	if err := db.Create(&newAppointment).Error; err != nil {
-		log.Printf("Error creating initial appointment:\n %s\n", err)
-		return err
-	}
-
 	// We will create ~100 appointments:
 	for i := 0; i < 115; i++ {
 		// Randomly select an appointment type from appointmentTypes:
-		appointmentType = appointmentTypes[rand.Intn(len(appointmentTypes))]
+		appointmentType := appointmentTypes[rand.Intn(len(appointmentTypes))]
 		// Randomly select a patient from patients:
-		patient = patients[rand.Intn(len(patients))]
+		patient := patients[rand.Intn(len(patients))]
 		// Randomly select a date and time within the next 2 months.
 		// The hours have to be between 8 and 17, and the minutes have to be either 0 or 30:
 		// The days have to be working days (Monday to Friday):
@@ -174,14 +240,14 @@ func populate(ctx context.Context, db *gorm.DB) error {
 		// The notification preferences have to be the patient's preferences:
 		// The reminder time has to be between 1 and 48 hours before the appointment:
 		// Create the appointment:
-		startTime = time.Now().AddDate(0, rand.Intn(2), rand.Intn(30))
+		startTime := clinic.Now().AddDate(0, rand.Intn(2), rand.Intn(30))
 		startTime = time.Date(startTime.Year(), startTime.Month(), startTime.Day(), 8+rand.Intn(10), rand.Intn(2)*30, 0, 0, startTime.Location())
 		//make sure the date is a working day:
 		for startTime.Weekday() == time.Saturday || startTime.Weekday() == time.Sunday {
 			startTime = startTime.AddDate(0, 0, 1)
 		}
 		tempUUID, _ := uuid.NewV7()
-		newAppointment = models.Appointment{
+		newAppointment := models.Appointment{
 			UUID:              tempUUID.String(),
 			PatientID:         patient.ID,
 			AppointmentTypeID: appointmentType.ID,
@@ -8,10 +8,24 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/ipmess/dentistbackend/pkg/agenda"
 	"github.com/ipmess/dentistbackend/pkg/appointments"
+	"github.com/ipmess/dentistbackend/pkg/appointmenttypes"
 	"github.com/ipmess/dentistbackend/pkg/authenticationHelper"
+	"github.com/ipmess/dentistbackend/pkg/caldav"
+	"github.com/ipmess/dentistbackend/pkg/charges"
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/googlecalendar"
+	"github.com/ipmess/dentistbackend/pkg/holidays"
+	"github.com/ipmess/dentistbackend/pkg/ical"
 	"github.com/ipmess/dentistbackend/pkg/models"
+	"github.com/ipmess/dentistbackend/pkg/notifications"
 	"github.com/ipmess/dentistbackend/pkg/patient"
+	"github.com/ipmess/dentistbackend/pkg/practitioners"
+	"github.com/ipmess/dentistbackend/pkg/resources"
+	"github.com/ipmess/dentistbackend/pkg/timeoff"
+	"github.com/ipmess/dentistbackend/pkg/waitlist"
+	"github.com/ipmess/dentistbackend/pkg/workinghours"
 	"gorm.io/gorm"
 )
 
@@ -32,7 +46,60 @@ func main() {
 		log.Fatalf("error initializing database at %s.\nFailed with '%s'\n", config.DBEndpoint, err)
 		return
 	}
-	db.AutoMigrate(&models.Appointment{}, &models.Patient{}, &models.AppointmentType{})
+	db.AutoMigrate(&models.Appointment{}, &models.Patient{}, &models.AppointmentType{}, &models.WorkingHours{}, &models.TimeOff{}, &models.HolidayOptOut{}, &models.AppointmentSeries{}, &models.AppointmentChange{}, &models.Resource{}, &models.Practitioner{}, &models.WaitlistEntry{}, &models.WaitlistOffer{}, &models.Notification{}, &models.GoogleCalendarEvent{}, &models.GoogleCalendarSync{}, &models.Charge{}, &models.TimeZoneMigration{})
+
+	// Convert the times earlier versions stored in the server's local time:
+	err = migrateStoredTimes(db, config.StoredTimeZone)
+	if err != nil {
+		log.Fatalf("error converting the stored times to UTC: %s\n", err)
+	}
+
+	// Notify the best waitlist candidate as soon as a slot is freed, if configured:
+	waitlist.AutoNotify = config.WaitlistAutoNotify
+	// Only offer freed slots that the waiting patient's appointment fits into:
+	waitlist.Bookable = appointments.Bookable
+
+	// The clinic's time zone, for working hours, time off and calendar days:
+	if config.TimeZone != "" {
+		err = clinic.SetTimeZone(config.TimeZone)
+		if err != nil {
+			log.Fatalf("error in config.json: time_zone: %s\n", err)
+		}
+	}
+
+	// The calendar feed is only served with this token:
+	ical.FeedToken = config.CalendarFeedToken
+
+	// Calendar apps sign in to CalDAV with these credentials:
+	if config.CalDAVUsername != "" {
+		caldav.Username = config.CalDAVUsername
+	}
+	caldav.Password = config.CalDAVPassword
+
+	// Sync the appointments with Google Calendar, if it is configured:
+	if config.GoogleRefreshToken != "" || config.GoogleAPIURL != "" {
+		client := &googlecalendar.APIClient{BaseURL: config.GoogleAPIURL}
+		if config.GoogleRefreshToken != "" {
+			client.Auth = &googlecalendar.OAuth{
+				ClientID:     config.GoogleClientID,
+				ClientSecret: config.GoogleClientSecret,
+				RefreshToken: config.GoogleRefreshToken,
+			}
+		}
+		googlecalendar.Client = client
+		if config.GoogleCalendarID != "" {
+			googlecalendar.CalendarID = config.GoogleCalendarID
+		}
+		googlecalendar.WebhookURL = config.GoogleWebhookURL
+	}
+
+	// The first day of the week in the weekly calendar view (Monday by default):
+	if config.WeekStart != "" {
+		appointments.WeekStart, err = appointments.ParseWeekday(config.WeekStart)
+		if err != nil {
+			log.Fatalf("error in config.json: week_start: %s\n", err)
+		}
+	}
 
 	// Create context
 	ctx = context.Background()
@@ -47,6 +114,71 @@ func main() {
 		Ctx: ctx,
 	}
 
+	workingHoursHandler := workinghours.HTTPHandler{
+		DB:  db,
+		Ctx: ctx,
+	}
+
+	timeOffHandler := timeoff.HTTPHandler{
+		DB:  db,
+		Ctx: ctx,
+	}
+
+	holidayHandler := holidays.HTTPHandler{
+		DB:  db,
+		Ctx: ctx,
+	}
+
+	appointmentTypeHandler := appointmenttypes.HTTPHandler{
+		DB:  db,
+		Ctx: ctx,
+	}
+
+	resourceHandler := resources.HTTPHandler{
+		DB:  db,
+		Ctx: ctx,
+	}
+
+	practitionerHandler := practitioners.HTTPHandler{
+		DB:  db,
+		Ctx: ctx,
+	}
+
+	waitlistHandler := waitlist.HTTPHandler{
+		DB:  db,
+		Ctx: ctx,
+	}
+
+	agendaHandler := agenda.HTTPHandler{
+		DB:  db,
+		Ctx: ctx,
+	}
+
+	chargeHandler := charges.HTTPHandler{
+		DB:  db,
+		Ctx: ctx,
+	}
+
+	notificationHandler := notifications.HTTPHandler{
+		DB:  db,
+		Ctx: ctx,
+	}
+
+	calendarHandler := ical.HTTPHandler{
+		DB:  db,
+		Ctx: ctx,
+	}
+
+	davHandler := caldav.HTTPHandler{
+		DB:  db,
+		Ctx: ctx,
+	}
+
+	googleCalendarHandler := googlecalendar.HTTPHandler{
+		DB:  db,
+		Ctx: ctx,
+	}
+
 	if config.PopulateDB {
 		// Populate the database with sample data:
 		fmt.Printf("Populating the database with sample data...\n")
@@ -56,6 +188,15 @@ func main() {
 		}
 	}
 
+	// Warn about appointments that fall on public holidays in the coming year:
+	err = holidays.WarnAboutBookedHolidays(db, time.Now(), time.Now().AddDate(1, 0, 0))
+	if err != nil {
+		log.Printf("couldn't check for appointments on public holidays: %s\n", err)
+	}
+
+	// Keep Google Calendar in sync in the background:
+	go googlecalendar.Run(ctx, db)
+
 	// Sample appointment data
 	sampleAppointment := models.Appointment{
 		PatientID:         1,
@@ -102,7 +243,7 @@ func main() {
 	appointments.PrintAppointments(monthAppointments)
 
 	// Example usage of GetDayAppointments
-	appointmentDay = time.Date(2024, 10, 25, 0, 0, 0, 0, time.Local)
+	appointmentDay = time.Date(2024, 10, 25, 0, 0, 0, 0, clinic.Location)
 	dayAppointments, err = appointments.GetDayAppointments(db, appointmentDay)
 	if err != nil {
 		log.Fatalf("Error retrieving appointments: %s", err)
@@ -147,11 +288,81 @@ func main() {
 	router.HandleFunc("/patients/{uuid}", patientHandler.GetPatient).Methods("GET")
 	router.HandleFunc("/patients/{uuid}", patientHandler.UpdatePatient).Methods("PUT")
 	router.HandleFunc("/patients/{uuid}", patientHandler.DeletePatient).Methods("DELETE")
+	router.HandleFunc("/patients/{uuid}/appointments", patientHandler.GetPatientAppointments).Methods("GET")
+	router.HandleFunc("/patients/{uuid}/cancellations", patientHandler.GetCancellationStats).Methods("GET")
+	router.HandleFunc("/reports/late-cancellations", patientHandler.ListLateCancellations).Methods("GET")
 	router.HandleFunc("/appointments", appointmentHandler.NewAppointment).Methods("POST")
+	router.HandleFunc("/appointments/check", appointmentHandler.CheckAppointment).Methods("POST")
+	router.HandleFunc("/appointments/import/preview", appointmentHandler.PreviewImport).Methods("POST")
+	router.HandleFunc("/appointments/import", appointmentHandler.ImportAppointments).Methods("POST")
+	router.HandleFunc("/appointments", appointmentHandler.ListAppointments).Methods("GET")
 	router.HandleFunc("/appointments/date", appointmentHandler.ListAppointments).Methods("GET")
+	router.HandleFunc("/appointments/week", appointmentHandler.ListWeekAppointments).Methods("GET")
+	router.HandleFunc("/appointments/month", appointmentHandler.ListMonthAppointments).Methods("GET")
 	router.HandleFunc("/appointments/{uuid}", appointmentHandler.GetAppointment).Methods("GET")
 	router.HandleFunc("/appointments/{uuid}", appointmentHandler.UpdateAppointment).Methods("PUT")
 	router.HandleFunc("/appointments/{uuid}", appointmentHandler.DeleteAppointment).Methods("DELETE")
+	router.HandleFunc("/appointments/{uuid}/move", appointmentHandler.MoveAppointment).Methods("POST")
+	router.HandleFunc("/appointments/{uuid}/history", appointmentHandler.GetAppointmentHistory).Methods("GET")
+	router.HandleFunc("/appointments/{uuid}/confirm", appointmentHandler.ConfirmAppointment).Methods("POST")
+	router.HandleFunc("/appointments/{uuid}/check-in", appointmentHandler.CheckInAppointment).Methods("POST")
+	router.HandleFunc("/appointments/{uuid}/in-chair", appointmentHandler.SeatAppointment).Methods("POST")
+	router.HandleFunc("/appointments/{uuid}/complete", appointmentHandler.CompleteAppointment).Methods("POST")
+	router.HandleFunc("/appointments/{uuid}/cancel", appointmentHandler.CancelAppointment).Methods("POST")
+	router.HandleFunc("/appointments/{uuid}/no-show", appointmentHandler.NoShowAppointment).Methods("POST")
+	router.HandleFunc("/series", appointmentHandler.NewSeries).Methods("POST")
+	router.HandleFunc("/series/{uuid}", appointmentHandler.GetSeries).Methods("GET")
+	router.HandleFunc("/series/{uuid}/occurrences/{appointment}", appointmentHandler.UpdateSeriesOccurrences).Methods("PUT")
+	router.HandleFunc("/series/{uuid}/occurrences/{appointment}", appointmentHandler.DeleteSeriesOccurrences).Methods("DELETE")
+	router.HandleFunc("/slots", appointmentHandler.FindSlots).Methods("GET")
+	router.HandleFunc("/working-hours", workingHoursHandler.ListWorkingHours).Methods("GET")
+	router.HandleFunc("/working-hours", workingHoursHandler.ReplaceWorkingHours).Methods("PUT")
+	router.HandleFunc("/time-off", timeOffHandler.NewTimeOff).Methods("POST")
+	router.HandleFunc("/time-off", timeOffHandler.ListTimeOff).Methods("GET")
+	router.HandleFunc("/time-off/{uuid}", timeOffHandler.GetTimeOff).Methods("GET")
+	router.HandleFunc("/time-off/{uuid}", timeOffHandler.UpdateTimeOff).Methods("PUT")
+	router.HandleFunc("/time-off/{uuid}", timeOffHandler.DeleteTimeOff).Methods("DELETE")
+	router.HandleFunc("/holidays", holidayHandler.ListHolidays).Methods("GET")
+	router.HandleFunc("/holidays/{key}/opt-out", holidayHandler.OptOut).Methods("PUT")
+	router.HandleFunc("/holidays/{key}/opt-out", holidayHandler.OptIn).Methods("DELETE")
+	router.HandleFunc("/resources", resourceHandler.NewResource).Methods("POST")
+	router.HandleFunc("/resources", resourceHandler.ListResources).Methods("GET")
+	router.HandleFunc("/resources/{uuid}", resourceHandler.GetResource).Methods("GET")
+	router.HandleFunc("/resources/{uuid}", resourceHandler.UpdateResource).Methods("PUT")
+	router.HandleFunc("/resources/{uuid}", resourceHandler.DeleteResource).Methods("DELETE")
+	router.HandleFunc("/appointment-types", appointmentTypeHandler.NewAppointmentType).Methods("POST")
+	router.HandleFunc("/appointment-types", appointmentTypeHandler.ListAppointmentTypes).Methods("GET")
+	router.HandleFunc("/appointment-types/{id}", appointmentTypeHandler.GetAppointmentType).Methods("GET")
+	router.HandleFunc("/appointment-types/{id}", appointmentTypeHandler.UpdateAppointmentType).Methods("PUT")
+	router.HandleFunc("/appointment-types/{id}", appointmentTypeHandler.DeleteAppointmentType).Methods("DELETE")
+	router.HandleFunc("/appointment-types/{id}/archive", appointmentTypeHandler.ArchiveAppointmentType).Methods("POST")
+	router.HandleFunc("/appointment-types/{id}/unarchive", appointmentTypeHandler.UnarchiveAppointmentType).Methods("POST")
+	router.HandleFunc("/appointment-types/{id}/resources", resourceHandler.GetTypeResources).Methods("GET")
+	router.HandleFunc("/appointment-types/{id}/resources", resourceHandler.SetTypeResources).Methods("PUT")
+	router.HandleFunc("/practitioners", practitionerHandler.NewPractitioner).Methods("POST")
+	router.HandleFunc("/practitioners", practitionerHandler.ListPractitioners).Methods("GET")
+	router.HandleFunc("/practitioners/{uuid}", practitionerHandler.GetPractitioner).Methods("GET")
+	router.HandleFunc("/practitioners/{uuid}", practitionerHandler.UpdatePractitioner).Methods("PUT")
+	router.HandleFunc("/practitioners/{uuid}", practitionerHandler.DeletePractitioner).Methods("DELETE")
+	router.HandleFunc("/practitioners/{uuid}/appointment-types", practitionerHandler.SetAppointmentTypes).Methods("PUT")
+	router.HandleFunc("/waitlist", waitlistHandler.NewEntry).Methods("POST")
+	router.HandleFunc("/waitlist", waitlistHandler.ListEntries).Methods("GET")
+	router.HandleFunc("/waitlist/offers", waitlistHandler.ListOffers).Methods("GET")
+	router.HandleFunc("/waitlist/offers/{id}/notify", waitlistHandler.NotifyOffer).Methods("POST")
+	router.HandleFunc("/waitlist/offers/{id}/dismiss", waitlistHandler.DismissOffer).Methods("POST")
+	router.HandleFunc("/waitlist/{uuid}", waitlistHandler.GetEntry).Methods("GET")
+	router.HandleFunc("/waitlist/{uuid}", waitlistHandler.UpdateEntry).Methods("PUT")
+	router.HandleFunc("/waitlist/{uuid}", waitlistHandler.DeleteEntry).Methods("DELETE")
+	router.HandleFunc("/agenda/{date}", agendaHandler.Agenda).Methods("GET")
+	router.HandleFunc("/charges", chargeHandler.ListCharges).Methods("GET")
+	router.HandleFunc("/charges/{uuid}", chargeHandler.GetCharge).Methods("GET")
+	router.HandleFunc("/charges/{uuid}", chargeHandler.UpdateCharge).Methods("PUT")
+	router.HandleFunc("/notifications", notificationHandler.ListNotifications).Methods("GET")
+	router.HandleFunc("/notifications/{id}/sent", notificationHandler.MarkSent).Methods("POST")
+	router.HandleFunc("/calendar.ics", calendarHandler.Feed).Methods("GET")
+	router.HandleFunc("/.well-known/caldav", davHandler.WellKnown)
+	router.HandleFunc("/google-calendar/notifications", googleCalendarHandler.Notification).Methods("POST")
+	router.PathPrefix("/dav/").HandlerFunc(davHandler.ServeDAV)
 	router.HandleFunc("/authenticate", authenticationHelper.Authenticate).Methods("GET")
 
 	// Start the server
@@ -160,10 +371,37 @@ func main() {
 
 /*
 * `POST /appointments` to create an appointment
+* `POST /appointments/check` to check a proposed appointment for conflicts
+* `POST /appointments/import/preview` with an .ics file to match its events to patients and appointment types, and `POST /appointments/import` to book the confirmed ones
+* `GET /appointments?frame=...&start=...` or `?from=...&to=...` to list appointments, filtered by `type`, `patient`, `status`, `resource` or `practitioner`
 * `GET /appointments/month` to get a list of all appointments for a particular month/year.
 * `GET /appointments/week` to get a list of all appointments for a particular week/year.
 * `GET /appointments/date` to get a list of all appointments for a particular date.
 * `GET /appointments/:uuid` to get a specific appointment
 * `PUT /appointments/:uuid` to update a specific appointment
-* `DELETE /appointments/:uuid` to delete a specific appointment
+* `DELETE /appointments/:uuid` to cancel a specific appointment
+* `POST /appointments/:uuid/move` to move an appointment to a new time, and `GET /appointments/:uuid/history` to see where it was before
+* `POST /appointments/:uuid/confirm`, `/check-in`, `/in-chair`, `/complete`, `/cancel`, `/no-show` to move an appointment through its status lifecycle
+* `GET /patients/:uuid/appointments` and `GET /patients/:uuid/cancellations` for a patient's history and cancellation statistics
+* `GET /reports/late-cancellations` to list the patients with late cancellations
+* `POST /series`, `GET /series/:uuid` to create and view recurring appointments
+* `PUT`/`DELETE /series/:uuid/occurrences/:appointment?scope=this|following|all` to edit or cancel occurrences of a series
+* `GET /slots` to find free time slots for an appointment
+* `GET /working-hours` and `PUT /working-hours` to view and replace the clinic's weekly opening hours
+* `POST /time-off`, `GET /time-off`, `GET /time-off/:uuid`, `PUT /time-off/:uuid`, `DELETE /time-off/:uuid` to manage off days and blocked hours
+* `GET /holidays` to list the Cyprus public holidays, and `PUT`/`DELETE /holidays/:key/opt-out` to stay open on a holiday or close again
+* `POST /resources`, `GET /resources`, `GET /resources/:uuid`, `PUT /resources/:uuid`, `DELETE /resources/:uuid` to manage the treatment rooms and chairs
+* `POST /appointment-types`, `GET /appointment-types`, `GET /appointment-types/:id`, `PUT /appointment-types/:id`, `DELETE /appointment-types/:id` to manage the appointment types; types in use are archived instead of deleted
+* `POST /appointment-types/:id/archive` and `POST /appointment-types/:id/unarchive` to retire an appointment type or make it bookable again
+* `GET /appointment-types/:id/resources` and `PUT /appointment-types/:id/resources` for the rooms and chairs an appointment type can use
+* `POST /practitioners`, `GET /practitioners`, `GET /practitioners/:uuid`, `PUT /practitioners/:uuid`, `DELETE /practitioners/:uuid` to manage the dentists and hygienists
+* `PUT /practitioners/:uuid/appointment-types` to set the appointment types a practitioner may perform
+* `POST /waitlist`, `GET /waitlist`, `GET /waitlist/:uuid`, `PUT /waitlist/:uuid`, `DELETE /waitlist/:uuid` to manage patients waiting for an earlier appointment
+* `GET /waitlist/offers` to see which waiting patients suit freed slots, and `POST /waitlist/offers/:id/notify` or `/dismiss` to act on a suggestion
+* `GET /agenda/:date` for the printable day sheet, as HTML or, with `?format=pdf`, as a PDF
+* `GET /charges`, `GET /charges/:uuid`, `PUT /charges/:uuid` for what patients are charged for completed appointments
+* `GET /notifications?status=pending` and `POST /notifications/:id/sent` for the queue of messages to patients
+* `GET /calendar.ics?token=...` for an iCalendar feed of the schedule, optionally for one `practitioner` or `type`
+* `POST /google-calendar/notifications` for Google Calendar's push notifications
+* `/dav/` (and `/.well-known/caldav`) for CalDAV, so calendar apps can show, move and cancel appointments
  */
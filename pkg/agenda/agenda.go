@@ -0,0 +1,339 @@
+// Package agenda renders the day sheet the front desk prints: the day's
+// appointments with their times, patients, phone numbers, colour-coded
+// appointment types and the patients' medical alerts, on A4 pages, as HTML
+// or PDF.
+package agenda
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"html/template"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipmess/dentistbackend/pkg/appointments"
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/gorm"
+)
+
+type HTTPHandler struct {
+	DB  *gorm.DB
+	Ctx context.Context
+}
+
+// entry is a row of the day sheet.
+type entry struct {
+	Time     string
+	Duration string
+	Patient  string
+	Phone    string
+	Type     string
+	Color    string // the appointment type's colour, e.g. #CD5C5C
+	Alerts   string
+}
+
+func (e entry) cells() []string {
+	return []string{e.Time, e.Duration, e.Patient, e.Phone, e.Type, e.Alerts}
+}
+
+// column is a column of the table, with its width in points.
+type column struct {
+	Title string
+	Width float64
+}
+
+var columns = []column{
+	{"Time", 42}, {"Min", 34}, {"Patient", 122}, {"Phone", 80}, {"Type", 105}, {"Medical alerts", 132},
+}
+
+// The layout of a page, in points from the bottom of the page.
+const (
+	margin      = 40.0
+	titleY      = pageHeight - 52
+	subtitleY   = pageHeight - 67
+	headerY     = pageHeight - 90 // the baseline of the column titles
+	tableTop    = pageHeight - 96
+	tableBottom = 50.0
+	footerY     = 28.0
+	fontSize    = 9.0
+	lineHeight  = 11.0
+	padding     = 3.0
+	swatchSize  = 7.0
+)
+
+// typeColumn is the index of the Type column, whose text follows the colour
+// swatch.
+const typeColumn = 4
+
+// alertsColumn is the index of the medical alerts column, which is printed
+// in bold red.
+const alertsColumn = 5
+
+// cellWidth is the room for text in column i.
+func cellWidth(i int) float64 {
+	width := columns[i].Width - 2*padding
+	if i == typeColumn {
+		width -= swatchSize + 3
+	}
+	return width
+}
+
+// row is an entry laid out for the PDF: the lines of each cell.
+type row struct {
+	entry
+	lines  [][]string
+	height float64
+}
+
+func layout(e entry) row {
+	laidOut := row{entry: e}
+	count := 1
+	for i, cell := range e.cells() {
+		lines := wrap(transliterate(cell), cellWidth(i), fontSize, i == alertsColumn)
+		laidOut.lines = append(laidOut.lines, lines)
+		count = max(count, len(lines))
+	}
+	laidOut.height = float64(count)*lineHeight + 2*padding
+	return laidOut
+}
+
+// paginate lays out the entries and splits them into pages.
+func paginate(entries []entry) [][]row {
+	pages := [][]row{{}}
+	y := tableTop
+	for _, e := range entries {
+		laidOut := layout(e)
+		last := len(pages) - 1
+		if y-laidOut.height < tableBottom && len(pages[last]) > 0 {
+			pages = append(pages, []row{})
+			y = tableTop
+			last++
+		}
+		pages[last] = append(pages[last], laidOut)
+		y -= laidOut.height
+	}
+	return pages
+}
+
+// sheet is the day sheet of a day.
+type sheet struct {
+	Title    string
+	Subtitle string
+	Printed  string
+	Pages    [][]row
+}
+
+func newSheet(date time.Time, list []models.Appointment) sheet {
+	var entries []entry
+	minutes := 0
+	for _, appointment := range list {
+		if appointment.Status == models.StatusCancelled {
+			continue
+		}
+		entries = append(entries, entry{
+			Time:     appointment.StartTime.In(clinic.Location).Format("15:04"),
+			Duration: strconv.Itoa(appointment.Duration),
+			Patient:  appointment.Patient.Name,
+			Phone:    appointment.Patient.PhoneNumber,
+			Type:     appointment.AppointmentType.Description,
+			Color:    appointment.AppointmentType.Color,
+			Alerts:   appointment.Patient.MedicalAlerts,
+		})
+		minutes += appointment.Duration
+	}
+	subtitle := "No appointments"
+	switch len(entries) {
+	case 0:
+	case 1:
+		subtitle = fmt.Sprintf("1 appointment, %d minutes", minutes)
+	default:
+		subtitle = fmt.Sprintf("%d appointments, %d hours %d minutes", len(entries), minutes/60, minutes%60)
+	}
+	return sheet{
+		Title:    "Appointments, " + date.Format("Monday 2 January 2006"),
+		Subtitle: subtitle,
+		Printed:  "Printed " + clinic.Now().Format("02/01/2006 15:04"),
+		Pages:    paginate(entries),
+	}
+}
+
+// rgb is a colour with components from 0 to 1.
+type rgb struct{ r, g, b float64 }
+
+var (
+	black = rgb{0, 0, 0}
+	grey  = rgb{0.4, 0.4, 0.4}
+	rule  = rgb{0.8, 0.8, 0.8}
+	red   = rgb{0.69, 0, 0.13}
+)
+
+var hexColor = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
+// swatchColor returns the colour of an appointment type, or grey if it has
+// none.
+func swatchColor(color string) string {
+	if !hexColor.MatchString(color) {
+		return "#999999"
+	}
+	return color
+}
+
+func parseColor(color string) rgb {
+	value, _ := strconv.ParseUint(swatchColor(color)[1:], 16, 32)
+	return rgb{float64(value>>16&0xFF) / 255, float64(value>>8&0xFF) / 255, float64(value&0xFF) / 255}
+}
+
+// pdfNote is printed at the bottom of every PDF page, since the PDF fonts
+// cannot show Greek.
+const pdfNote = "Greek text is transliterated; see the HTML sheet for the original"
+
+// pdfPages draws the pages of the sheet.
+func (s sheet) pdfPages() []*canvas {
+	var pages []*canvas
+	for number, page := range s.Pages {
+		c := &canvas{}
+		c.text(margin, titleY, s.Title, 14, true, black)
+		c.text(margin, subtitleY, s.Subtitle, fontSize, false, grey)
+		x := margin
+		for _, col := range columns {
+			c.text(x+padding, headerY, col.Title, fontSize, true, black)
+			x += col.Width
+		}
+		c.line(margin, tableTop, pageWidth-margin, tableTop, black)
+
+		y := tableTop
+		for _, r := range page {
+			x := margin
+			for i, lines := range r.lines {
+				textX, color := x+padding, black
+				if i == typeColumn {
+					c.rect(textX, y-padding-lineHeight+1.5, swatchSize, swatchSize, parseColor(r.Color))
+					textX += swatchSize + 3
+				}
+				if i == alertsColumn {
+					color = red
+				}
+				for j, line := range lines {
+					c.text(textX, y-padding-float64(j+1)*lineHeight+2.5, line, fontSize, i == alertsColumn, color)
+				}
+				x += columns[i].Width
+			}
+			y -= r.height
+			c.line(margin, y, pageWidth-margin, y, rule)
+		}
+
+		c.text(margin, footerY, s.Printed, 8, false, grey)
+		c.text((pageWidth-textWidth(pdfNote, 8, false))/2, footerY, pdfNote, 8, false, grey)
+		pageNumber := fmt.Sprintf("Page %d of %d", number+1, len(s.Pages))
+		c.text(pageWidth-margin-textWidth(pageNumber, 8, false), footerY, pageNumber, 8, false, grey)
+		pages = append(pages, c)
+	}
+	return pages
+}
+
+var sheetTemplate = template.Must(template.New("sheet").Funcs(template.FuncMap{
+	"percent": func(width float64) string {
+		return fmt.Sprintf("%.2f%%", width*100/(pageWidth-2*margin))
+	},
+	"swatch": func(color string) template.CSS {
+		return template.CSS("background: " + swatchColor(color))
+	},
+	"inc": func(i int) int { return i + 1 },
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+@page { size: A4; margin: 0 }
+body { margin: 0; background: #ddd; font-family: Helvetica, Arial, sans-serif; font-size: 9pt; color: #000 }
+.page { box-sizing: border-box; position: relative; width: 210mm; height: 297mm; margin: 8mm auto; padding: 14mm 14mm 18mm; background: #fff; overflow: hidden; break-after: page }
+.page:last-child { break-after: auto }
+h1 { margin: 0 0 1.5mm; font-size: 14pt }
+.subtitle { margin-bottom: 4mm; color: #666 }
+table { width: 100%; border-collapse: collapse; table-layout: fixed }
+th { padding: 1mm; border-bottom: 1px solid #000; text-align: left }
+td { padding: 1mm; border-bottom: 1px solid #ccc; vertical-align: top; overflow-wrap: anywhere }
+.swatch { display: inline-block; width: 2.5mm; height: 2.5mm; margin-right: 1mm; -webkit-print-color-adjust: exact; print-color-adjust: exact }
+.alerts { color: #b00020; font-weight: bold }
+footer { position: absolute; left: 14mm; right: 14mm; bottom: 9mm; display: flex; justify-content: space-between; color: #666; font-size: 8pt }
+@media print { body { background: none } .page { margin: 0 } }
+</style>
+</head>
+<body>
+{{- $sheet := . }}
+{{- range $number, $page := .Pages}}
+<section class="page">
+<h1>{{$sheet.Title}}</h1>
+<div class="subtitle">{{$sheet.Subtitle}}</div>
+<table>
+<colgroup>{{range $.Columns}}<col style="width: {{percent .Width}}">{{end}}</colgroup>
+<thead><tr>{{range $.Columns}}<th>{{.Title}}</th>{{end}}</tr></thead>
+<tbody>
+{{- range $page}}
+<tr><td>{{.Time}}</td><td>{{.Duration}}</td><td>{{.Patient}}</td><td>{{.Phone}}</td><td><span class="swatch" style="{{swatch .Color}}"></span>{{.Type}}</td><td class="alerts">{{.Alerts}}</td></tr>
+{{- end}}
+</tbody>
+</table>
+<footer><span>{{$sheet.Printed}}</span><span>Page {{inc $number}} of {{len $sheet.Pages}}</span></footer>
+</section>
+{{- end}}
+</body>
+</html>
+`))
+
+// Agenda handles GET /agenda/{date}, the day sheet of a day (YYYY-MM-DD, or
+// "today"), as HTML to print from the browser, or as a PDF with
+// ?format=pdf. Both are paginated for A4 in the same way. Cancelled
+// appointments are left out.
+func (h *HTTPHandler) Agenda(w http.ResponseWriter, r *http.Request) {
+	value := mux.Vars(r)["date"]
+	date := clinic.StartOfDay(clinic.Now())
+	if value != "today" {
+		var err error
+		date, err = time.ParseInLocation("2006-01-02", value, clinic.Location)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid date %q: use YYYY-MM-DD", value), http.StatusBadRequest)
+			return
+		}
+	}
+	list, err := appointments.GetDayAppointments(h.DB, date)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	day := newSheet(date, list)
+
+	// rendered in full first, so that an error can still be reported:
+	var out bytes.Buffer
+	var contentType, disposition string
+	switch format := r.URL.Query().Get("format"); format {
+	case "pdf":
+		contentType = "application/pdf"
+		err = writePDF(&out, day.Title, day.pdfPages())
+		disposition = fmt.Sprintf(`inline; filename="agenda-%s.pdf"`, date.Format("2006-01-02"))
+	case "", "html":
+		contentType = "text/html; charset=utf-8"
+		err = sheetTemplate.Execute(&out, struct {
+			sheet
+			Columns []column
+		}{day, columns})
+	default:
+		http.Error(w, fmt.Sprintf("unknown format %q: use html or pdf", format), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if disposition != "" {
+		w.Header().Set("Content-Disposition", disposition)
+	}
+	w.Write(out.Bytes())
+}
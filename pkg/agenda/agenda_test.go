@@ -0,0 +1,99 @@
+package agenda
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTransliterate(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Παπαδόπουλος", "Papadopoulos"},
+		{"Γιώργος Παπαδόπουλος", "Giorgos Papadopoulos"},
+		{"Χρήστος", "Christos"},
+		{"Ευάγγελος", "Evangelos"},
+		{"Θεά", "Thea"},
+		{"ΘΕΑ", "THEA"},
+		{"ΑΥΓΟ", "AVGO"},
+		{"Ψ", "Ps"},
+		{"Maria (κλινική)", "Maria (kliniki)"},
+		{"Maria Ioannou", "Maria Ioannou"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		if got := transliterate(test.text); got != test.want {
+			t.Errorf("transliterate(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestWinAnsi(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Cleaning", "Cleaning"},
+		{"Extraction (wisdom tooth)", `Extraction \(wisdom tooth\)`},
+		{`C:\notes`, `C:\\notes`},
+		{"Café", "Caf\xe9"},
+		{"Straße", "Stra\xdfe"},
+		{"€50", "\x8050"},
+		{"10:00–10:30 — late", "10:00-10:30 - late"},
+		{"Μαρία", "Maria"},
+		{"日本", "??"},
+		{"tab\there", "tab?here"},
+	}
+	for _, test := range tests {
+		if got := winAnsi(test.text); got != test.want {
+			t.Errorf("winAnsi(%q) = %q, want %q", test.text, got, test.want)
+		}
+	}
+}
+
+func TestPaginate(t *testing.T) {
+	short := entry{Time: "09:00", Duration: "30", Patient: "Maria Ioannou", Type: "Cleaning"}
+	// a patient name on three lines makes a row of three lines:
+	tall := entry{Time: "09:30", Duration: "30", Patient: "Maria\nIoannou\nGeorgiou", Type: "Cleaning"}
+	// medical alerts too long for a page of their own:
+	huge := entry{Time: "10:00", Duration: "60", Alerts: strings.Repeat("penicillin allergy ", 400)}
+	repeat := func(e entry, count int) []entry {
+		var entries []entry
+		for range count {
+			entries = append(entries, e)
+		}
+		return entries
+	}
+	if got := layout(short).height; got != lineHeight+2*padding {
+		t.Errorf("a row of one line is %.1f high, want %.1f", got, lineHeight+2*padding)
+	}
+	if got := layout(tall).height; got != 3*lineHeight+2*padding {
+		t.Errorf("a row of three lines is %.1f high, want %.1f", got, 3*lineHeight+2*padding)
+	}
+
+	tests := []struct {
+		name    string
+		entries []entry
+		want    []int // the number of rows on each page
+	}{
+		{"no appointments", nil, []int{0}},
+		{"one appointment", repeat(short, 1), []int{1}},
+		{"a full page", repeat(short, 40), []int{40}},
+		{"one row more than fits", repeat(short, 41), []int{40, 1}},
+		{"a tall row that still fits", append(repeat(short, 38), tall), []int{39}},
+		{"a tall row that does not fit", append(repeat(short, 39), tall), []int{39, 1}},
+		{"a row taller than a page gets a page of its own", []entry{short, huge, short}, []int{1, 1, 1}},
+		{"a row taller than a page first", []entry{huge, short}, []int{1, 1}},
+	}
+	for _, test := range tests {
+		var got []int
+		for _, page := range paginate(test.entries) {
+			got = append(got, len(page))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: paginate = %v rows per page, want %v", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package agenda
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The PDF is drawn with the standard Helvetica fonts, which every PDF reader
+// has, so no font files are needed. They only cover the Latin alphabet
+// (WinAnsiEncoding): Greek text is transliterated, and other characters
+// become "?". Every page says so in its footer, and the HTML sheet, which
+// keeps the original text, is the one to rely on.
+
+// A4 in points
+const (
+	pageWidth  = 595.28
+	pageHeight = 841.89
+)
+
+// helveticaWidths are the widths of the ASCII characters from space to ~ in
+// Helvetica, in thousandths of the font size.
+var helveticaWidths = [95]int{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278, // space to /
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, // 0 to 9
+	278, 278, 584, 584, 584, 556, 1015, // : to @
+	667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, // A to M
+	722, 778, 667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, // N to Z
+	278, 278, 278, 469, 556, 333, // [ to `
+	556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, // a to m
+	556, 556, 556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, // n to z
+	334, 260, 334, 584, // { to ~
+}
+
+// textWidth returns the width of text in Helvetica at size points. Bold
+// text is about 5% wider.
+func textWidth(text string, size float64, bold bool) float64 {
+	width := 0
+	for _, r := range text {
+		if r >= ' ' && r <= '~' {
+			width += helveticaWidths[r-' ']
+		} else {
+			width += 556
+		}
+	}
+	if bold {
+		width = width * 105 / 100
+	}
+	return float64(width) * size / 1000
+}
+
+// wrap breaks text into lines no wider than width, at spaces where it can.
+func wrap(text string, width, size float64, bold bool) []string {
+	var lines []string
+	for _, paragraph := range strings.Split(text, "\n") {
+		line := ""
+		for _, word := range strings.Fields(paragraph) {
+			candidate := word
+			if line != "" {
+				candidate = line + " " + word
+			}
+			if textWidth(candidate, size, bold) <= width {
+				line = candidate
+				continue
+			}
+			if line != "" {
+				lines = append(lines, line)
+			}
+			// break up words that don't fit on a line of their own:
+			line = ""
+			for _, r := range word {
+				if line != "" && textWidth(line+string(r), size, bold) > width {
+					lines = append(lines, line)
+					line = ""
+				}
+				line += string(r)
+			}
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+// winAnsi encodes text for a PDF string in WinAnsiEncoding: Latin-1 letters
+// are kept, Greek is transliterated, and anything else becomes "?".
+func winAnsi(text string) string {
+	var encoded strings.Builder
+	for _, r := range transliterate(text) {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			encoded.WriteByte('\\')
+			encoded.WriteRune(r)
+		case r >= ' ' && r <= '~':
+			encoded.WriteRune(r)
+		case r >= 0xA0 && r <= 0xFF:
+			encoded.WriteByte(byte(r))
+		case r == '€':
+			encoded.WriteByte(0x80)
+		case r == '–' || r == '—':
+			encoded.WriteByte('-')
+		default:
+			encoded.WriteByte('?')
+		}
+	}
+	return encoded.String()
+}
+
+// canvas collects the drawing operators of a page. y grows upwards from the
+// bottom of the page, as in PDF.
+type canvas struct {
+	ops bytes.Buffer
+}
+
+// text draws text with its baseline starting at x, y.
+func (c *canvas) text(x, y float64, text string, size float64, bold bool, color rgb) {
+	font := "F1"
+	if bold {
+		font = "F2"
+	}
+	fmt.Fprintf(&c.ops, "%.3f %.3f %.3f rg BT /%s %.1f Tf %.2f %.2f Td (%s) Tj ET\n",
+		color.r, color.g, color.b, font, size, x, y, winAnsi(text))
+}
+
+// rect fills a rectangle whose bottom left corner is at x, y.
+func (c *canvas) rect(x, y, width, height float64, color rgb) {
+	fmt.Fprintf(&c.ops, "%.3f %.3f %.3f rg %.2f %.2f %.2f %.2f re f\n", color.r, color.g, color.b, x, y, width, height)
+}
+
+// line draws a thin line.
+func (c *canvas) line(x1, y1, x2, y2 float64, color rgb) {
+	fmt.Fprintf(&c.ops, "%.3f %.3f %.3f RG 0.5 w %.2f %.2f m %.2f %.2f l S\n", color.r, color.g, color.b, x1, y1, x2, y2)
+}
+
+// writePDF writes a PDF document with one A4 page per canvas.
+func writePDF(w io.Writer, title string, pages []*canvas) error {
+	var out bytes.Buffer
+	var offsets []int
+	object := func(body string) {
+		offsets = append(offsets, out.Len())
+		fmt.Fprintf(&out, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	out.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+
+	// objects 1 to 5: the catalog, the page tree, the fonts and the document
+	// information; then a page and its contents for each page.
+	kids := make([]string, len(pages))
+	for i := range pages {
+		kids[i] = fmt.Sprintf("%d 0 R", 6+2*i)
+	}
+	object("<< /Type /Catalog /Pages 2 0 R >>")
+	object(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(pages)))
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	object("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	object(fmt.Sprintf("<< /Title (%s) /Producer (dentistbackend) >>", winAnsi(title)))
+	for i, page := range pages {
+		object(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] "+
+			"/Resources << /Font << /F1 3 0 R /F2 4 0 R >> >> /Contents %d 0 R >>", pageWidth, pageHeight, 7+2*i))
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(page.ops.Bytes())
+		zw.Close()
+		object(fmt.Sprintf("<< /Length %d /Filter /FlateDecode >>\nstream\n%s\nendstream", compressed.Len(), compressed.String()))
+	}
+
+	xref := out.Len()
+	fmt.Fprintf(&out, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&out, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&out, "trailer\n<< /Size %d /Root 1 0 R /Info 5 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	_, err := w.Write(out.Bytes())
+	return err
+}
@@ -0,0 +1,60 @@
+package agenda
+
+import (
+	"strings"
+	"unicode"
+)
+
+// greekLetters maps the Greek letters, without accents, to Latin ones,
+// following ELOT 743 in simplified form.
+var greekLetters = map[rune]string{
+	'α': "a", 'β': "v", 'γ': "g", 'δ': "d", 'ε': "e", 'ζ': "z", 'η': "i", 'θ': "th",
+	'ι': "i", 'κ': "k", 'λ': "l", 'μ': "m", 'ν': "n", 'ξ': "x", 'ο': "o", 'π': "p",
+	'ρ': "r", 'σ': "s", 'ς': "s", 'τ': "t", 'υ': "y", 'φ': "f", 'χ': "ch", 'ψ': "ps", 'ω': "o",
+}
+
+// greekPairs are the letter pairs that are transliterated together.
+var greekPairs = map[string]string{
+	"ου": "ou", "αυ": "av", "ευ": "ev", "ηυ": "iv", "γγ": "ng", "γξ": "nx", "γχ": "nch",
+}
+
+var stripAccents = strings.NewReplacer(
+	"ά", "α", "έ", "ε", "ή", "η", "ί", "ι", "ϊ", "ι", "ΐ", "ι", "ό", "ο", "ύ", "υ", "ϋ", "υ", "ΰ", "υ", "ώ", "ω",
+	"Ά", "Α", "Έ", "Ε", "Ή", "Η", "Ί", "Ι", "Ϊ", "Ι", "Ό", "Ο", "Ύ", "Υ", "Ϋ", "Υ", "Ώ", "Ω",
+)
+
+// transliterate writes the Greek in text with Latin letters, e.g.
+// "Γιώργος Παπαδόπουλος" becomes "Giorgos Papadopoulos". Other text is kept.
+func transliterate(text string) string {
+	runes := []rune(stripAccents.Replace(text))
+	var latin strings.Builder
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		lower := unicode.ToLower(r)
+		if _, greek := greekLetters[lower]; !greek {
+			latin.WriteRune(r)
+			continue
+		}
+		upper := r != lower
+		value := greekLetters[lower]
+		nextUpper := false
+		if i+1 < len(runes) {
+			next := runes[i+1]
+			nextUpper = next != unicode.ToLower(next)
+			if pair, ok := greekPairs[string([]rune{lower, unicode.ToLower(next)})]; ok {
+				value = pair
+				i++
+			}
+		}
+		switch {
+		case upper && nextUpper:
+			// "ΘΕΑ" becomes "THEA",
+			value = strings.ToUpper(value)
+		case upper:
+			// but "Θεά" becomes "Thea"
+			value = strings.ToUpper(value[:1]) + value[1:]
+		}
+		latin.WriteString(value)
+	}
+	return latin.String()
+}
@@ -2,17 +2,24 @@ package appointments
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/ipmess/dentistbackend/pkg/clinic"
 	"github.com/ipmess/dentistbackend/pkg/models"
+	"github.com/ipmess/dentistbackend/pkg/timeoff"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 // limit the appointmentRequest.timeFrame to the following values:
@@ -27,9 +34,38 @@ const (
 )
 
 type appointmentRequest struct {
-	// a structure to hold the request data for listing appointments
-	Frame     TimeFrame
-	StartDate string
+	// a structure to hold the query parameters for listing appointments
+	Frame          TimeFrame
+	StartDate      string // YYYY-MM-DD, any day within the frame
+	From           string // optional: list [From, To) instead of a frame
+	To             string
+	TypeID         *uint                      // optional: only list appointments of this type
+	PatientUUID    string                     // optional: only list the appointments of this patient
+	Statuses       []models.AppointmentStatus // optional: only list appointments in these states
+	ResourceID     *uint                      // optional: only list the appointments booked into this resource
+	PractitionerID *uint                      // optional: only list the calendar of this practitioner
+	Cancelled      bool                       // include the cancelled appointments, which are left out otherwise
+}
+
+type appointmentUpdateRequest struct {
+	// a structure to hold the changes to an appointment; nil keeps a preference
+	StartTime         time.Time // zero keeps the time
+	Duration          int       // in minutes; zero keeps the duration
+	AllowOutsideHours *bool     // nil keeps the setting
+	AppointmentTypeID uint      // zero keeps the type
+	Viber             *bool
+	Whatsapp          *bool
+	SMS               *bool
+	EmailNotification *bool
+	Reminder          *int
+}
+
+type appointmentListResponse struct {
+	// a structure to hold everything needed to render a calendar view
+	Appointments  []models.Appointment
+	TimeOff       []timeoff.Block
+	Practitioners []practitionerSchedule // the same appointments, per practitioner
+	Resources     []resourceSchedule     // the same appointments, per room or chair
 }
 
 type HTTPHandler struct {
@@ -37,8 +73,15 @@ type HTTPHandler struct {
 	Ctx context.Context
 }
 
-// Validate checks if the timeFrame is one of the allowed values
+// Validate checks if the timeFrame is one of the allowed values, or that a
+// range is given instead
 func (ar *appointmentRequest) Validate() error {
+	if ar.From != "" || ar.To != "" {
+		if ar.From == "" || ar.To == "" {
+			return errors.New("both from and to are required")
+		}
+		return nil
+	}
 	switch ar.Frame {
 	case Day, Week, Month, Year:
 		return nil
@@ -47,106 +90,241 @@ func (ar *appointmentRequest) Validate() error {
 	}
 }
 
-func CreateAppointment(ctx context.Context, db *gorm.DB, appointment models.Appointment) (models.Appointment, error) {
-	// Use the passed db descriptor to create the appointment record
-	db.Model(&appointment).Association("Patient")
-	db.Model(&appointment).Association("AppointmentType")
+// parseListQuery reads an appointmentRequest from the query parameters frame,
+// start, from, to, type, patient, status, resource, practitioner and
+// cancelled. The frame defaults to the given one, and the start date to today.
+func parseListQuery(values url.Values, frame TimeFrame) (appointmentRequest, error) {
+	request := appointmentRequest{
+		Frame:       frame,
+		StartDate:   values.Get("start"),
+		From:        values.Get("from"),
+		To:          values.Get("to"),
+		PatientUUID: values.Get("patient"),
+		Cancelled:   values.Get("cancelled") == "true",
+	}
+	if value := values.Get("frame"); value != "" {
+		request.Frame = TimeFrame(value)
+	}
+	if request.StartDate == "" {
+		request.StartDate = clinic.Now().Format("2006-01-02")
+	}
+	ids := map[string]**uint{
+		"type":         &request.TypeID,
+		"resource":     &request.ResourceID,
+		"practitioner": &request.PractitionerID,
+	}
+	for key, target := range ids {
+		value := values.Get(key)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(value, 10, 0)
+		if err != nil {
+			return request, fmt.Errorf("invalid %s %q", key, value)
+		}
+		converted := uint(id)
+		*target = &converted
+	}
+	if value := values.Get("status"); value != "" {
+		for _, status := range strings.Split(value, ",") {
+			status := models.AppointmentStatus(strings.TrimSpace(status))
+			switch status {
+			case models.StatusScheduled, models.StatusConfirmed, models.StatusCheckedIn, models.StatusInChair,
+				models.StatusCompleted, models.StatusCancelled, models.StatusNoShow:
+				request.Statuses = append(request.Statuses, status)
+			default:
+				return request, fmt.Errorf("invalid status %q", status)
+			}
+		}
+	}
+	return request, request.Validate()
+}
 
-	// sanity check: Verify that the appointment's patient and appointment type exist in the database:
+// filter narrows db down to the appointments matching the filters of the
+// request. Cancelled appointments are left out, unless the request asks for
+// them with Cancelled or its Statuses.
+func (ar *appointmentRequest) filter(db *gorm.DB) (*gorm.DB, error) {
+	if ar.PatientUUID != "" {
+		var patient models.Patient
+		err := db.Where("uuid = ?", ar.PatientUUID).First(&patient).Error
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrPatientNotFound, ar.PatientUUID)
+		}
+		db = db.Where("patient_id = ?", patient.ID)
+	}
+	if ar.TypeID != nil {
+		db = db.Where("appointment_type_id = ?", *ar.TypeID)
+	}
+	if len(ar.Statuses) > 0 {
+		db = db.Where("status IN ?", ar.Statuses)
+	} else if !ar.Cancelled {
+		db = db.Where("status <> ?", models.StatusCancelled)
+	}
+	if ar.ResourceID != nil {
+		db = db.Where("resource_id = ?", *ar.ResourceID)
+	}
+	if ar.PractitionerID != nil {
+		db = db.Where("practitioner_id = ?", *ar.PractitionerID)
+	}
+	return db, nil
+}
+
+// scheduleLockName is the MariaDB advisory lock that serialises every change
+// to the schedule, so that two concurrent bookings cannot both pass the
+// overlap check.
+const scheduleLockName = "dentistbackend.schedule"
+
+// scheduleLockTimeout is how long (in seconds) to wait for the schedule lock.
+const scheduleLockTimeout = 10
+
+// withScheduleLock runs fn inside a transaction while holding the schedule
+// advisory lock. The lock is taken and released on the same connection as the
+// transaction, and it is only released after the transaction has finished.
+func withScheduleLock(ctx context.Context, db *gorm.DB, fn func(tx *gorm.DB) error) error {
+	return db.WithContext(ctx).Connection(func(conn *gorm.DB) error {
+		var acquired sql.NullInt64
+		err := conn.Raw("SELECT GET_LOCK(?, ?)", scheduleLockName, scheduleLockTimeout).Row().Scan(&acquired)
+		if err != nil {
+			return fmt.Errorf("couldn't acquire the schedule lock: %w", err)
+		}
+		if !acquired.Valid || acquired.Int64 != 1 {
+			return errors.New("timed out waiting for the schedule lock")
+		}
+		defer func() {
+			var released sql.NullInt64
+			if err := conn.Raw("SELECT RELEASE_LOCK(?)", scheduleLockName).Row().Scan(&released); err != nil {
+				log.Printf("couldn't release the schedule lock: %s\n", err)
+			}
+		}()
+		return conn.Transaction(fn)
+	})
+}
+
+// FindOverlappingAppointments returns the appointments that take up time
+// within [start, end), except cancelled ones and those in excludeIDs (e.g.
+// appointments being moved).
+func FindOverlappingAppointments(db *gorm.DB, start, end time.Time, excludeIDs ...uint) ([]models.Appointment, error) {
+	var overlapping []models.Appointment
+	query := db.Model(&models.Appointment{}).
+		Joins("JOIN appointment_types ON appointment_types.id = appointments.appointment_type_id").
+		Preload("Patient").
+		Preload("AppointmentType").
+		Preload("Resource").
+		Preload("Practitioner").
+		Where("appointments.status <> ?", models.StatusCancelled).
+		// an appointment takes up its own time plus the buffer time of its type
+		// before and after it; touching intervals do not overlap:
+		Where("DATE_SUB(appointments.start_time, INTERVAL appointment_types.buffer_before MINUTE) < ?", end).
+		Where("DATE_ADD(appointments.start_time, INTERVAL appointments.duration + appointment_types.buffer_after MINUTE) > ?", start)
+	if len(excludeIDs) > 0 {
+		query = query.Where("appointments.id NOT IN ?", excludeIDs)
+	}
+	err := query.Order("appointments.start_time asc").Find(&overlapping).Error
+	if err != nil {
+		return nil, err
+	}
+	return overlapping, nil
+}
+
+// occupied returns the interval appointment takes up, including the buffer
+// time of its appointment type, which must be loaded.
+func occupied(appointment models.Appointment) (time.Time, time.Time) {
+	start := appointment.StartTime.Add(-time.Duration(appointment.AppointmentType.BufferBefore) * time.Minute)
+	end := appointment.StartTime.Add(time.Duration(appointment.Duration+appointment.AppointmentType.BufferAfter) * time.Minute)
+	return start, end
+}
+
+// loadReferences verifies that the appointment's patient and appointment type
+// exist, and stores them in the appointment.
+func loadReferences(db *gorm.DB, appointment *models.Appointment) error {
 	var patient models.Patient
 	err := db.First(&patient, appointment.PatientID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("%w: patient ID %d", ErrPatientNotFound, appointment.PatientID)
+	}
 	if err != nil {
-		log.Fatalf("Error retrieving patient with ID %d.\nFailed with '%s'\n", appointment.PatientID, err)
+		return fmt.Errorf("error retrieving patient with ID %d: %w", appointment.PatientID, err)
 	}
 	var appointmentType models.AppointmentType
 	err = db.First(&appointmentType, appointment.AppointmentTypeID).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return fmt.Errorf("%w: appointment type ID %d", ErrAppointmentTypeNotFound, appointment.AppointmentTypeID)
+	}
 	if err != nil {
-		log.Fatalf("Error retrieving appointment type with ID %d.\nFailed with '%s'\n", appointment.AppointmentTypeID, err)
+		return fmt.Errorf("error retrieving appointment type with ID %d: %w", appointment.AppointmentTypeID, err)
 	}
-	// store retrieved patient data and appointment type into the appointment struct:
 	appointment.Patient = patient
 	appointment.AppointmentType = appointmentType
+	return nil
+}
 
-	// Check if the appointment overlaps with an existing appointment:
-
-	var lastAppointment models.Appointment
-	//startTime := appointment.StartTime
-	endTime := appointment.StartTime.Add(time.Minute * time.Duration(appointment.Duration))
-	fmt.Printf("Checking for overlapping appointments for appointments between %s and %s\n", appointment.StartTime.Format("02 Jan 2006 15:04 -0700"), appointment.StartTime.Add(time.Minute*time.Duration(appointment.Duration)).Format("02 Jan 2006 15:04 -0700"))
+// bumpSequence increases the revision number of the appointment with the
+// given ID, so that calendar clients pick up the change.
+func bumpSequence(tx *gorm.DB, id uint) error {
+	return tx.Model(&models.Appointment{}).Where("id = ?", id).UpdateColumn("sequence", gorm.Expr("sequence + 1")).Error
+}
 
-	// Find the last appointment before the new appointment's end time
-	SQLStatement := db.ToSQL(func(tx *gorm.DB) *gorm.DB {
-		return tx.Model(&models.Appointment{}).Where("start_time < ?", endTime).Order("start_time desc").First(&lastAppointment)
-	})
-	fmt.Printf("SQL statement:\n%s\n", SQLStatement)
-	err = db.Preload("Patient").Preload("AppointmentType").Where("start_time < ?", endTime).Order("start_time desc").First(&lastAppointment).Error
+// checkAvailability verifies that appointment can take place at its
+// StartTime: within working hours (unless AllowOutsideHours is set), outside
+// time off, with a practitioner and in a resource (room or chair) that no
+// other appointment takes up at the time. It books the appointment with that
+// practitioner and into that resource; pinned says which of the
+// appointment's current assignments must be kept. Appointments listed in
+// excludeIDs are ignored. It should be called while holding the schedule
+// lock.
+func checkAvailability(tx *gorm.DB, appointment *models.Appointment, pinned pins, excludeIDs ...uint) error {
+	result, err := evaluate(tx, appointment, pinned, excludeIDs...)
 	if err != nil {
-		log.Fatalf("Error checking for overlapping appointments.\nFailed with '%s'\n", err)
+		return err
 	}
-
-	// Check if the new appointment's start time is after the last appointment's end time:
-
-	lastAppointmentsEndTime := lastAppointment.StartTime.Add(time.Duration(lastAppointment.Duration) * time.Minute)
-	if lastAppointmentsEndTime.After(appointment.StartTime) {
-		fmt.Printf("Overlapping appointment:\n")
-		PrintAppointment(lastAppointment)
-		return appointment, fmt.Errorf("appointment overlaps with an existing appointment")
+	if result.OutOfHours {
+		return ErrOutsideWorkingHours
 	}
+	if len(result.Conflicts) > 0 || len(result.Blocks) > 0 {
+		return &OverlapError{Conflicts: result.Conflicts, Blocks: result.Blocks}
+	}
+	return nil
+}
 
-	// Now we know it is safe to create the appointment:
-
-	if err := db.Create(&appointment).Error; err != nil {
-		return models.Appointment{}, err
+func CreateAppointment(ctx context.Context, db *gorm.DB, appointment models.Appointment) (models.Appointment, error) {
+	if appointment.Duration <= 0 {
+		return models.Appointment{}, ErrInvalidDuration
 	}
-	err = db.Model(&appointment).Association("Patient").Error
-	if err != nil {
-		log.Fatalf(
-			"association error (of appointment with patient) when creating appointment.\nFailed with '%s'\n",
-			err,
-		)
+	// sanity check: Verify that the appointment's patient and appointment type exist in the database:
+	if err := loadReferences(db.WithContext(ctx), &appointment); err != nil {
 		return models.Appointment{}, err
 	}
-	err = db.Model(&appointment).Association("AppointmentType").Error
+	if appointment.AppointmentType.Archived {
+		return models.Appointment{}, fmt.Errorf("%w: %s", ErrAppointmentTypeArchived, appointment.AppointmentType.Description)
+	}
+
+	// Check for overlapping appointments and create the new one while holding
+	// the schedule lock, so that no other booking can slip in between:
+	err := withScheduleLock(ctx, db, func(tx *gorm.DB) error {
+		pinned := pins{Practitioner: appointment.PractitionerID != nil, Resource: appointment.ResourceID != nil}
+		if err := checkAvailability(tx, &appointment, pinned); err != nil {
+			return err
+		}
+		return tx.Omit("Resource", "Practitioner").Create(&appointment).Error
+	})
 	if err != nil {
-		log.Fatalf(
-			"association error (of appointment with AppointmentType) when creating appointment.\nFailed with '%s'\n",
-			err,
-		)
 		return models.Appointment{}, err
 	}
 	return appointment, nil
 }
 
-// GetMonthAppointments retrieves all appointments for a specific month
+// GetMonthAppointments retrieves all appointments for the clinic's month that
+// includes appointmentDate
 func GetMonthAppointments(db *gorm.DB, appointmentDate time.Time) ([]models.Appointment, error) {
-	location, err := time.LoadLocation("Asia/Nicosia")
-	if err != nil {
-		panic(err)
-	}
-	startDate := time.Date(appointmentDate.Year(), appointmentDate.Month(), 1, 0, 0, 0, 0, location)
-	endDate := startDate.AddDate(0, 1, -1).Add(24 * time.Hour) // Last day of the month + 1 day
-	var appointments []models.Appointment
-	err = db.Preload("Patient").Preload("AppointmentType").Where("start_time BETWEEN ? AND ?", startDate, endDate).Order("start_time asc").Find(&appointments).Error
-	if err != nil {
-		return nil, err
-	}
-	return appointments, nil
+	from, to := frameBounds(Month, appointmentDate)
+	return GetAppointmentsBetween(db, from, to)
 }
 
-// GetDayAppointments retrieves all appointments for a specific day
+// GetDayAppointments retrieves all appointments for the clinic's day that
+// includes date
 func GetDayAppointments(db *gorm.DB, date time.Time) ([]models.Appointment, error) {
-
-	// Normalize the date to the start of the day
-	startDate := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, date.Location())
-	// End of the day (23:59:59.999)
-	endDate := startDate.Add(24 * time.Hour).Add(-time.Millisecond)
-	var appointments []models.Appointment
-
-	err := db.Preload("Patient").Preload("AppointmentType").Where("start_time BETWEEN ? AND ?", startDate, endDate).Order("start_time asc").Find(&appointments).Error
-	if err != nil {
-		return nil, err
-	}
-	return appointments, nil
+	from, to := frameBounds(Day, date)
+	return GetAppointmentsBetween(db, from, to)
 }
 
 func PrintAppointments(appointments []models.Appointment) {
@@ -212,86 +390,86 @@ func (h *HTTPHandler) NewAppointment(w http.ResponseWriter, r *http.Request) {
 
 	appointment, err = CreateAppointment(h.Ctx, h.DB, appointment)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
+	queueConfirmation(h.DB.WithContext(h.Ctx), appointment.Patient, appointment.AppointmentType, &appointment.ID, []time.Time{appointment.StartTime})
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(appointment)
 }
 
+// ListAppointments handles GET /appointments and GET /appointments/date,
+// listing the day of the start query parameter unless another frame or a
+// range is asked for, e.g. GET /appointments?frame=week&start=2025-03-12&type=4
+// or GET /appointments?from=2025-03-01&to=2025-03-31&patient=<uuid>&status=no-show.
 func (h *HTTPHandler) ListAppointments(w http.ResponseWriter, r *http.Request) {
-	var request appointmentRequest
-	//  check whether the request is empty:
-	if r.Body == nil {
-		request.Frame = "day"
-		request.StartDate = time.Now().Format("02-01-2006")
-	} else {
-		// the request should include a time frame and a start date:
-		err := json.NewDecoder(r.Body).Decode(&request)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
-	}
+	h.listAppointments(w, r, Day)
+}
+
+// ListWeekAppointments handles GET /appointments/week, which lists the week
+// of the start query parameter.
+func (h *HTTPHandler) ListWeekAppointments(w http.ResponseWriter, r *http.Request) {
+	h.listAppointments(w, r, Week)
+}
 
-	if err := request.Validate(); err != nil {
+// ListMonthAppointments handles GET /appointments/month, which lists the
+// month of the start query parameter.
+func (h *HTTPHandler) ListMonthAppointments(w http.ResponseWriter, r *http.Request) {
+	h.listAppointments(w, r, Month)
+}
+
+func (h *HTTPHandler) listAppointments(w http.ResponseWriter, r *http.Request, frame TimeFrame) {
+	request, err := parseListQuery(r.URL.Query(), frame)
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	var appointments []models.Appointment
-
-	// convert request.StartDate from string to time.Time:
-	requestStartTime, err := time.Parse("02-01-2006", request.StartDate)
+	// a range, or the frame around the start date:
+	var from, to time.Time
+	if request.From != "" {
+		from, to, err = parseRange(request.From, request.To, clinic.Location)
+	} else {
+		var date time.Time
+		date, err = parseDate(request.StartDate, clinic.Location)
+		from, to = frameBounds(request.Frame, date)
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	switch request.Frame {
-	case Day:
-		appointments, err = GetDayAppointments(h.DB, requestStartTime)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	case Month:
-		appointments, err = GetMonthAppointments(h.DB, requestStartTime)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-	case Week:
-		monthsAppointments, err := GetMonthAppointments(h.DB, requestStartTime)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
-		}
-		// Filter the appointments to only include the appointments for the week:
-		for _, appointment := range monthsAppointments {
-			if appointment.StartTime.Before(requestStartTime.AddDate(0, 0, 7)) {
-				appointments = append(appointments, appointment)
-			}
-		}
-
-	case Year:
-
-		for m := 0; m < 12; m++ {
-
-			monthsAppointments, err := GetMonthAppointments(h.DB, requestStartTime.AddDate(0, m, 0))
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			// append the Month's appointments to the appointments slice:
-			appointments = append(appointments, monthsAppointments...)
-		}
+	filtered, err := request.filter(h.DB)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	appointments, err := GetAppointmentsBetween(filtered, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
 
-	default:
-		http.Error(w, "invalid time frame", http.StatusInternalServerError)
+	// Include the time off blocks, so the calendar can show them:
+	var blocks []timeoff.Block
+	if request.PractitionerID != nil {
+		blocks, err = timeoff.OccurrencesFor(h.DB, from, to, request.PractitionerID)
+	} else {
+		blocks, err = timeoff.Occurrences(h.DB, from, to)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if appointments == nil {
+		appointments = []models.Appointment{}
 	}
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(appointments)
-
+	json.NewEncoder(w).Encode(appointmentListResponse{
+		Appointments:  appointments,
+		TimeOff:       blocks,
+		Practitioners: groupByPractitioner(appointments),
+		Resources:     groupByResource(appointments),
+	})
 }
 
 func (h *HTTPHandler) GetAppointment(w http.ResponseWriter, r *http.Request) {
@@ -301,7 +479,7 @@ func (h *HTTPHandler) GetAppointment(w http.ResponseWriter, r *http.Request) {
 
 	var appointment models.Appointment
 	// Find the appointment with the given UUID:
-	err := h.DB.Preload("Patient").Preload("AppointmentType").Where("uuid = ?", appointmentUUID).First(&appointment).Error
+	err := h.DB.Preload("Patient").Preload("AppointmentType").Preload("Resource").Preload("Practitioner").Where("uuid = ?", appointmentUUID).First(&appointment).Error
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotFound)
 		return
@@ -310,60 +488,127 @@ func (h *HTTPHandler) GetAppointment(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(appointment)
 }
 
+// UpdateAppointment changes the appointment with the given UUID as update
+// says, in a single transaction while holding the schedule lock. A new time,
+// duration or type is checked as MoveAppointment checks a move, and a new
+// time is kept in the appointment's history and sent to the patient. Only the
+// notification preferences that update sets are changed.
+func UpdateAppointment(ctx context.Context, db *gorm.DB, appointmentUUID string, update appointmentUpdateRequest) (models.Appointment, error) {
+	if update.Duration < 0 {
+		return models.Appointment{}, ErrInvalidDuration
+	}
+	var appointment, previous models.Appointment
+	var rescheduled bool
+	err := withScheduleLock(ctx, db, func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Patient").Preload("AppointmentType").
+			Where("uuid = ?", appointmentUUID).First(&appointment).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrAppointmentNotFound
+		}
+		if err != nil {
+			return err
+		}
+		previous = appointment
+
+		var columns []string
+		timeChanged := !update.StartTime.IsZero() && !update.StartTime.Equal(appointment.StartTime)
+		durationChanged := update.Duration != 0 && update.Duration != appointment.Duration
+		typeChanged := update.AppointmentTypeID != 0 && update.AppointmentTypeID != appointment.AppointmentTypeID
+		if timeChanged || durationChanged || typeChanged {
+			move := Move{StartTime: appointment.StartTime, Duration: update.Duration, AllowOutsideHours: update.AllowOutsideHours}
+			if timeChanged {
+				move.StartTime = update.StartTime
+			}
+			if err := reschedule(tx, &appointment, move, update.AppointmentTypeID); err != nil {
+				return err
+			}
+			columns = append(columns, "StartTime", "Duration", "AllowOutsideHours", "AppointmentTypeID", "ResourceID", "PractitionerID")
+			rescheduled = timeChanged || durationChanged
+		}
+		if update.Viber != nil {
+			appointment.Viber = *update.Viber
+			columns = append(columns, "Viber")
+		}
+		if update.Whatsapp != nil {
+			appointment.Whatsapp = *update.Whatsapp
+			columns = append(columns, "Whatsapp")
+		}
+		if update.SMS != nil {
+			appointment.SMS = *update.SMS
+			columns = append(columns, "SMS")
+		}
+		if update.EmailNotification != nil {
+			appointment.EmailNotification = *update.EmailNotification
+			columns = append(columns, "EmailNotification")
+		}
+		if update.Reminder != nil {
+			appointment.Reminder = *update.Reminder
+			columns = append(columns, "Reminder")
+		}
+		if len(columns) == 0 {
+			return nil
+		}
+
+		err = tx.Model(&appointment).Select(columns).Updates(&appointment).Error
+		if err == nil {
+			err = bumpSequence(tx, appointment.ID)
+		}
+		if err == nil && rescheduled {
+			err = recordChange(tx, appointment, previous.StartTime, previous.Duration, "", "")
+		}
+		if err != nil {
+			return err
+		}
+		return tx.Preload("Patient").Preload("AppointmentType").Preload("Resource").Preload("Practitioner").First(&appointment, appointment.ID).Error
+	})
+	if err != nil {
+		return models.Appointment{}, err
+	}
+	if rescheduled {
+		if !appointment.StartTime.Equal(previous.StartTime) {
+			queueMoveNotification(db.WithContext(ctx), appointment, previous.StartTime)
+		}
+		offerFreedSlot(db.WithContext(ctx), previous, appointment)
+	}
+	return appointment, nil
+}
+
+// UpdateAppointment handles PUT /appointments/{uuid}. It changes the
+// appointment type and notification preferences of the appointment in the
+// URL; preferences left out of the body are kept. A new StartTime or Duration
+// moves the appointment, with the same checks as
+// POST /appointments/{uuid}/move.
 func (h *HTTPHandler) UpdateAppointment(w http.ResponseWriter, r *http.Request) {
 	// Get the appointment UUID from the URL:
 	vars := mux.Vars(r)
 	appointmentUUID := vars["uuid"]
 
-	var newAppointment models.Appointment
-	err := json.NewDecoder(r.Body).Decode(&newAppointment)
+	var update appointmentUpdateRequest
+	err := json.NewDecoder(r.Body).Decode(&update)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	var appointmentInDB models.Appointment
-	// Find the appointment with the given UUID:
-	err = h.DB.Where("uuid = ?", appointmentUUID).First(&appointmentInDB).Error
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
-	}
-
-	// TODO:
-	// Refactor the UpdateAppointment function to use the .Update GORM method
-	// instead of creating a new appointment and saving it to the database.
-
-	// Update the appointment:
-	err = h.DB.Save(&newAppointment).Error
+	appointment, err := UpdateAppointment(h.Ctx, h.DB, appointmentUUID, update)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-
-	appointmentInDB.UpdatedAt = time.Now()
-
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(newAppointment)
+	json.NewEncoder(w).Encode(appointment)
 }
 
+// DeleteAppointment handles DELETE /appointments/{uuid}. Appointments are
+// never removed; they are cancelled with the "other" reason, so they stay in
+// the patient's history. Use POST /appointments/{uuid}/cancel to give a reason.
 func (h *HTTPHandler) DeleteAppointment(w http.ResponseWriter, r *http.Request) {
 	// Get the appointment UUID from the URL:
 	vars := mux.Vars(r)
 	appointmentUUID := vars["uuid"]
 
-	var appointment models.Appointment
-	// Find the appointment with the given UUID:
-	err := h.DB.Where("uuid = ?", appointmentUUID).First(&appointment).Error
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusNotFound)
-		return
-	}
-
-	// Delete the appointment:
-	err = h.DB.Delete(&appointment).Error
+	_, err := CancelAppointment(h.Ctx, h.DB, appointmentUUID, Cancellation{Reason: models.ReasonOther})
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 	w.WriteHeader(http.StatusNoContent)
@@ -0,0 +1,119 @@
+package appointments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"github.com/ipmess/dentistbackend/pkg/waitlist"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// LateCancellationWindow is how close to its start time an appointment can
+// be cancelled by the patient before the cancellation counts as late.
+const LateCancellationWindow = 24 * time.Hour
+
+// Cancellation holds the details of a cancellation.
+type Cancellation struct {
+	Reason      models.CancellationReason
+	CancelledBy string
+	Note        string
+	FeeApplies  *bool // nil: a fee applies to late cancellations only
+}
+
+func (c Cancellation) validate() error {
+	switch c.Reason {
+	case models.ReasonPatientRequest, models.ReasonDentistSick, models.ReasonLateCancellation, models.ReasonOther:
+		return nil
+	case "":
+		return fmt.Errorf("%w: missing Reason", ErrInvalidCancellation)
+	default:
+		return fmt.Errorf("%w: unknown Reason %q, expected patient-request, dentist-sick, late-cancellation or other", ErrInvalidCancellation, c.Reason)
+	}
+}
+
+// applyCancellation cancels appointment and records the details of the
+// cancellation. The cancellation is late if its reason says so, or if the
+// patient cancelled less than LateCancellationWindow before the start.
+func applyCancellation(appointment *models.Appointment, cancellation Cancellation, now time.Time) error {
+	if err := applyTransition(appointment, models.StatusCancelled, now); err != nil {
+		return err
+	}
+	late := cancellation.Reason == models.ReasonLateCancellation ||
+		(cancellation.Reason == models.ReasonPatientRequest && appointment.StartTime.Sub(now) < LateCancellationWindow)
+	fee := late
+	if cancellation.FeeApplies != nil {
+		fee = *cancellation.FeeApplies
+	}
+	appointment.CancellationReason = cancellation.Reason
+	appointment.CancelledBy = cancellation.CancelledBy
+	appointment.CancellationNote = cancellation.Note
+	appointment.LateCancellation = late
+	appointment.CancellationFee = fee
+	return nil
+}
+
+// saveCancellation writes the status and cancellation fields of appointment
+// to the database.
+func saveCancellation(tx *gorm.DB, appointment *models.Appointment) error {
+	if err := saveStatus(tx, appointment); err != nil {
+		return err
+	}
+	return tx.Model(appointment).
+		Select("CancellationReason", "CancelledBy", "CancellationNote", "LateCancellation", "CancellationFee").
+		Updates(appointment).Error
+}
+
+// CancelAppointment cancels the appointment with the given UUID. The
+// appointment stays in the patient's history, but no longer takes up its
+// slot, which is offered to the patients on the waitlist. Only scheduled or
+// confirmed appointments can be cancelled.
+func CancelAppointment(ctx context.Context, db *gorm.DB, appointmentUUID string, cancellation Cancellation) (models.Appointment, error) {
+	if err := cancellation.validate(); err != nil {
+		return models.Appointment{}, err
+	}
+	var appointment models.Appointment
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("uuid = ?", appointmentUUID).First(&appointment).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrAppointmentNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := applyCancellation(&appointment, cancellation, time.Now()); err != nil {
+			return err
+		}
+		return saveCancellation(tx, &appointment)
+	})
+	if err != nil {
+		return models.Appointment{}, err
+	}
+	waitlist.OfferFreedSlotOrLog(db.WithContext(ctx), appointment)
+	return appointment, nil
+}
+
+// CancelAppointment handles POST /appointments/{uuid}/cancel, e.g.
+// {"Reason": "patient-request", "CancelledBy": "patient", "FeeApplies": false}
+func (h *HTTPHandler) CancelAppointment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var cancellation Cancellation
+	err := json.NewDecoder(r.Body).Decode(&cancellation)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	appointment, err := CancelAppointment(h.Ctx, h.DB, vars["uuid"], cancellation)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(appointment)
+}
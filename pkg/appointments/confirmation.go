@@ -0,0 +1,72 @@
+package appointments
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"github.com/ipmess/dentistbackend/pkg/notifications"
+	"gorm.io/gorm"
+)
+
+// Instructions returns the preparation and aftercare instructions of
+// appointmentType in language ("el" or "en"), or in the other language if
+// they are only written in one.
+func Instructions(appointmentType models.AppointmentType, language string) string {
+	greek, english := strings.TrimSpace(appointmentType.InstructionsEL), strings.TrimSpace(appointmentType.InstructionsEN)
+	if (language == "en" && english != "") || greek == "" {
+		return english
+	}
+	return greek
+}
+
+// confirmationMessage returns the message confirming the booking of
+// appointments of appointmentType at starts for patient, in the patient's
+// language, followed by the type's instructions.
+func confirmationMessage(patient models.Patient, appointmentType models.AppointmentType, starts []time.Time) string {
+	var message string
+	if patient.Language == "en" {
+		dates := make([]string, len(starts))
+		for i, start := range starts {
+			dates[i] = start.In(clinic.Location).Format("Monday 02 Jan 2006 at 15:04")
+		}
+		message = fmt.Sprintf("Dear %s, your appointment for %s is booked for %s.",
+			patient.Name, appointmentType.Description, strings.Join(dates, ", "))
+		if len(starts) > 1 {
+			message = fmt.Sprintf("Dear %s, your appointments for %s are booked for %s.",
+				patient.Name, appointmentType.Description, strings.Join(dates, ", "))
+		}
+	} else {
+		dates := make([]string, len(starts))
+		for i, start := range starts {
+			dates[i] = start.In(clinic.Location).Format("02/01/2006 στις 15:04")
+		}
+		message = fmt.Sprintf("%s, το ραντεβού σας για %s κλείστηκε για τις %s.",
+			patient.Name, appointmentType.Description, strings.Join(dates, ", "))
+		if len(starts) > 1 {
+			message = fmt.Sprintf("%s, τα ραντεβού σας για %s κλείστηκαν για τις %s.",
+				patient.Name, appointmentType.Description, strings.Join(dates, ", "))
+		}
+	}
+	if instructions := Instructions(appointmentType, patient.Language); instructions != "" {
+		message += "\n\n" + instructions
+	}
+	return message
+}
+
+// queueConfirmation queues the confirmation of a booking for the patient.
+// appointmentID is optional, e.g. for a series. A failure is only logged,
+// since the booking itself has succeeded.
+func queueConfirmation(db *gorm.DB, patient models.Patient, appointmentType models.AppointmentType, appointmentID *uint, starts []time.Time) {
+	if len(starts) == 0 {
+		return
+	}
+	message := confirmationMessage(patient, appointmentType, starts)
+	_, err := notifications.Queue(db, patient, appointmentID, notifications.KindAppointmentConfirmation, message)
+	if err != nil {
+		log.Printf("couldn't queue the confirmation for patient %s: %s\n", patient.UUID, err)
+	}
+}
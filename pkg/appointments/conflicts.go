@@ -0,0 +1,177 @@
+package appointments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"github.com/ipmess/dentistbackend/pkg/timeoff"
+	"gorm.io/gorm"
+)
+
+// ConflictKind says what a proposed booking collides with.
+type ConflictKind string
+
+const (
+	ConflictAppointment ConflictKind = "appointment"
+	ConflictTimeOff     ConflictKind = "time-off"
+	ConflictOutOfHours  ConflictKind = "out-of-hours"
+)
+
+// Conflict describes one reason why a proposed booking cannot go ahead.
+type Conflict struct {
+	Kind        ConflictKind
+	Reason      string
+	Start       time.Time
+	End         time.Time
+	Appointment *models.Appointment `json:",omitempty"`
+	Block       *timeoff.Block      `json:",omitempty"`
+}
+
+type conflictCheckRequest struct {
+	// a structure to hold a prospective booking that should be checked for conflicts
+	StartTime         time.Time
+	Duration          int
+	AppointmentTypeID uint   // optional: limits the check to the practitioners and resources the type can use
+	PractitionerID    *uint  // optional: the practitioner to check; otherwise any suitable one
+	ResourceID        *uint  // optional: the room or chair to check; otherwise any suitable one
+	ExcludeUUID       string // optional: the appointment being moved, which must not conflict with itself
+}
+
+type conflictCheckResponse struct {
+	Available    bool
+	Conflicts    []Conflict
+	Practitioner *models.Practitioner `json:",omitempty"` // the practitioner the booking would be with
+	Resource     *models.Resource     `json:",omitempty"` // the room or chair the booking would go into
+}
+
+// CheckConflicts returns every conflict for the proposed booking, using its
+// StartTime, Duration, AppointmentTypeID, PractitionerID and ResourceID.
+// Other appointments only conflict if no practitioner, or no resource, the
+// booking can use is free; if they are, they are stored in proposed. It never
+// writes to the database. If excludeID is not zero, that appointment is
+// ignored.
+func CheckConflicts(ctx context.Context, db *gorm.DB, proposed *models.Appointment, excludeID uint) ([]Conflict, error) {
+	if proposed.Duration <= 0 {
+		return nil, ErrInvalidDuration
+	}
+	start := proposed.StartTime.In(clinic.Location)
+	end := start.Add(time.Duration(proposed.Duration) * time.Minute)
+
+	var excludeIDs []uint
+	if excludeID != 0 {
+		excludeIDs = append(excludeIDs, excludeID)
+	}
+	pinned := pins{Practitioner: proposed.PractitionerID != nil, Resource: proposed.ResourceID != nil}
+	result, err := evaluate(db.WithContext(ctx), proposed, pinned, excludeIDs...)
+	if err != nil {
+		return nil, err
+	}
+	conflicts := []Conflict{}
+
+	if result.OutOfHours {
+		conflicts = append(conflicts, Conflict{
+			Kind:   ConflictOutOfHours,
+			Reason: fmt.Sprintf("%s %s-%s is outside working hours", start.Format("Monday 02 Jan 2006"), start.Format("15:04"), end.Format("15:04")),
+			Start:  start,
+			End:    end,
+		})
+	}
+
+	blocks := result.Blocks
+	for i := range blocks {
+		block := blocks[i]
+		reason := "time off"
+		if block.Reason != "" {
+			reason = block.Reason
+		}
+		conflicts = append(conflicts, Conflict{
+			Kind:   ConflictTimeOff,
+			Reason: fmt.Sprintf("%s from %s to %s", reason, block.Start.Format("02 Jan 2006 15:04"), block.End.Format("02 Jan 2006 15:04")),
+			Start:  block.Start,
+			End:    block.End,
+			Block:  &block,
+		})
+	}
+
+	for i := range result.Conflicts {
+		other := result.Conflicts[i]
+		otherEnd := other.StartTime.Add(time.Duration(other.Duration) * time.Minute)
+		conflicts = append(conflicts, Conflict{
+			Kind:        ConflictAppointment,
+			Reason:      fmt.Sprintf("overlaps with %s (%s) from %s to %s", other.AppointmentType.Description, other.Patient.Name, other.StartTime.In(clinic.Location).Format("02 Jan 2006 15:04"), otherEnd.In(clinic.Location).Format("02 Jan 2006 15:04")),
+			Start:       other.StartTime,
+			End:         otherEnd,
+			Appointment: &other,
+		})
+	}
+	return conflicts, nil
+}
+
+// Bookable reports whether proposed could be booked as it is: CheckConflicts
+// finds no conflicts for it, and some practitioner may perform its type.
+func Bookable(db *gorm.DB, proposed *models.Appointment) (bool, error) {
+	conflicts, err := CheckConflicts(db.Statement.Context, db, proposed, 0)
+	if errors.Is(err, ErrPractitionerNotAllowed) || errors.Is(err, ErrResourceNotAllowed) {
+		return false, nil
+	}
+	return err == nil && len(conflicts) == 0, err
+}
+
+// CheckAppointment handles POST /appointments/check. It reports whether a
+// proposed booking is free, and lists every conflict otherwise.
+func (h *HTTPHandler) CheckAppointment(w http.ResponseWriter, r *http.Request) {
+	var request conflictCheckRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.StartTime.IsZero() {
+		http.Error(w, "missing StartTime", http.StatusBadRequest)
+		return
+	}
+
+	var excludeID uint
+	if request.ExcludeUUID != "" {
+		var excluded models.Appointment
+		err = h.DB.Where("uuid = ?", request.ExcludeUUID).First(&excluded).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			http.Error(w, "appointment to exclude not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		excludeID = excluded.ID
+	}
+
+	proposed := models.Appointment{
+		StartTime:         request.StartTime,
+		Duration:          request.Duration,
+		AppointmentTypeID: request.AppointmentTypeID,
+		PractitionerID:    request.PractitionerID,
+		ResourceID:        request.ResourceID,
+	}
+	conflicts, err := CheckConflicts(h.Ctx, h.DB, &proposed, excludeID)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	response := conflictCheckResponse{
+		Available: len(conflicts) == 0,
+		Conflicts: conflicts,
+	}
+	if response.Available {
+		response.Practitioner = proposed.Practitioner
+		response.Resource = proposed.Resource
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,110 @@
+package appointments
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"github.com/ipmess/dentistbackend/pkg/timeoff"
+)
+
+// Errors returned by the appointment functions. Callers should compare
+// against them with errors.Is, because they are usually wrapped with details.
+var (
+	ErrPatientNotFound         = errors.New("patient not found")
+	ErrAppointmentTypeNotFound = errors.New("appointment type not found")
+	ErrAppointmentTypeArchived = errors.New("the appointment type is archived")
+	ErrInvalidDuration         = errors.New("appointment duration must be a positive number of minutes")
+	ErrOverlap                 = errors.New("appointment overlaps with existing appointments")
+	ErrOutsideWorkingHours     = errors.New("appointment is outside working hours")
+	ErrTimeOff                 = errors.New("appointment falls within time off")
+	ErrAppointmentNotFound     = errors.New("appointment not found")
+	ErrSeriesNotFound          = errors.New("appointment series not found")
+	ErrInvalidRecurrence       = errors.New("invalid recurrence rule")
+	ErrInvalidScope            = errors.New("invalid scope")
+	ErrIllegalTransition       = errors.New("illegal appointment status transition")
+	ErrInvalidCancellation     = errors.New("invalid cancellation")
+	ErrMissingStartTime        = errors.New("a start time is required")
+	ErrResourceNotAllowed      = errors.New("the appointment type cannot use this resource")
+	ErrPractitionerNotAllowed  = errors.New("no practitioner who may perform this appointment type")
+	ErrCannotMove              = errors.New("only scheduled or confirmed appointments can be moved")
+)
+
+// OverlapError is returned by CreateAppointment when the requested time
+// collides with existing appointments or with time off. Conflicts holds every
+// appointment and Blocks every time off block that overlaps the requested
+// interval. errors.Is reports ErrOverlap and/or ErrTimeOff accordingly.
+type OverlapError struct {
+	Conflicts []models.Appointment
+	Blocks    []timeoff.Block
+}
+
+func (e *OverlapError) Error() string {
+	switch {
+	case len(e.Conflicts) == 0 && len(e.Blocks) == 1:
+		return fmt.Sprintf("appointment falls within time off (%s)", e.Blocks[0].Reason)
+	case len(e.Conflicts) == 0:
+		return fmt.Sprintf("appointment falls within %d time off blocks", len(e.Blocks))
+	case len(e.Conflicts) == 1 && len(e.Blocks) == 0:
+		return fmt.Sprintf("appointment overlaps with an existing appointment at %s", e.Conflicts[0].StartTime.Format("02 Jan 2006 15:04"))
+	case len(e.Blocks) == 0:
+		return fmt.Sprintf("appointment overlaps with %d existing appointments", len(e.Conflicts))
+	default:
+		return fmt.Sprintf("appointment overlaps with %d existing appointments and %d time off blocks", len(e.Conflicts), len(e.Blocks))
+	}
+}
+
+func (e *OverlapError) Unwrap() []error {
+	var errs []error
+	if len(e.Conflicts) > 0 {
+		errs = append(errs, ErrOverlap)
+	}
+	if len(e.Blocks) > 0 {
+		errs = append(errs, ErrTimeOff)
+	}
+	return errs
+}
+
+// errorResponse is the JSON body sent back for domain errors.
+type errorResponse struct {
+	Error     string
+	Conflicts []models.Appointment `json:",omitempty"`
+	Blocks    []timeoff.Block      `json:",omitempty"`
+	// for recurring series:
+	Occurrences []OccurrenceResult `json:",omitempty"`
+}
+
+// writeError maps the errors returned by the appointment functions to HTTP
+// status codes. Overlaps are reported together with the conflicting
+// appointments, so the dentist can see what is in the way.
+func writeError(w http.ResponseWriter, err error) {
+	var status int
+	response := errorResponse{Error: err.Error()}
+	var overlapErr *OverlapError
+	var seriesErr *SeriesConflictError
+	switch {
+	case errors.As(err, &overlapErr):
+		status = http.StatusConflict
+		response.Conflicts = overlapErr.Conflicts
+		response.Blocks = overlapErr.Blocks
+	case errors.As(err, &seriesErr):
+		status = http.StatusConflict
+		response.Occurrences = seriesErr.Occurrences
+	case errors.Is(err, ErrPatientNotFound), errors.Is(err, ErrAppointmentNotFound), errors.Is(err, ErrSeriesNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, ErrAppointmentTypeNotFound), errors.Is(err, ErrAppointmentTypeArchived), errors.Is(err, ErrInvalidDuration), errors.Is(err, ErrOutsideWorkingHours), errors.Is(err, ErrInvalidRecurrence), errors.Is(err, ErrInvalidCancellation), errors.Is(err, ErrMissingStartTime), errors.Is(err, ErrResourceNotAllowed), errors.Is(err, ErrPractitionerNotAllowed):
+		status = http.StatusUnprocessableEntity
+	case errors.Is(err, ErrIllegalTransition), errors.Is(err, ErrCannotMove):
+		status = http.StatusConflict
+	case errors.Is(err, ErrInvalidScope):
+		status = http.StatusBadRequest
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,103 @@
+package appointments
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/gorm"
+)
+
+// WeekStart is the first day of the week in the Week frame. ISO 8601 weeks
+// start on Monday, as they do in Cyprus.
+var WeekStart = time.Monday
+
+// ParseWeekday parses a day name such as "monday" or "Mon", e.g. for the
+// week_start setting of config.json.
+func ParseWeekday(name string) (time.Weekday, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		full := strings.ToLower(day.String())
+		if name == full || name == full[:3] {
+			return day, nil
+		}
+	}
+	return time.Sunday, fmt.Errorf("invalid weekday %q", name)
+}
+
+// frameBounds returns the interval [from, to) covered by a calendar view of
+// the given frame that includes date: the day itself, the week starting on
+// WeekStart, the calendar month, or the calendar year, on the clinic's wall
+// clock. AddDate keeps the bounds at midnight across daylight saving changes.
+func frameBounds(frame TimeFrame, date time.Time) (time.Time, time.Time) {
+	from := clinic.StartOfDay(date)
+	switch frame {
+	case Week:
+		from = from.AddDate(0, 0, -((int(from.Weekday()) - int(WeekStart) + 7) % 7))
+		return from, from.AddDate(0, 0, 7)
+	case Month:
+		from = from.AddDate(0, 0, 1-from.Day())
+		return from, from.AddDate(0, 1, 0)
+	case Year:
+		from = time.Date(from.Year(), time.January, 1, 0, 0, 0, 0, from.Location())
+		return from, from.AddDate(1, 0, 0)
+	default:
+		return from, from.AddDate(0, 0, 1)
+	}
+}
+
+// parseDate parses an ISO 8601 date ("2006-01-02"), or a date in the older
+// "02-01-2006" format.
+func parseDate(value string, location *time.Location) (time.Time, error) {
+	date, err := time.ParseInLocation("2006-01-02", value, location)
+	if err == nil {
+		return date, nil
+	}
+	date, legacyErr := time.ParseInLocation("02-01-2006", value, location)
+	if legacyErr == nil {
+		return date, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid date %q: use YYYY-MM-DD", value)
+}
+
+// parseRange parses the bounds of a range query. Each bound is an ISO 8601
+// date or date and time (RFC 3339). A date as the upper bound includes the
+// whole of that day.
+func parseRange(fromValue, toValue string, location *time.Location) (time.Time, time.Time, error) {
+	from, err := time.Parse(time.RFC3339, fromValue)
+	if err != nil {
+		from, err = time.ParseInLocation("2006-01-02", fromValue, location)
+		if err != nil {
+			return from, from, fmt.Errorf("invalid from %q: use YYYY-MM-DD or an RFC 3339 time", fromValue)
+		}
+	}
+	to, err := time.Parse(time.RFC3339, toValue)
+	if err != nil {
+		to, err = time.ParseInLocation("2006-01-02", toValue, location)
+		if err != nil {
+			return from, to, fmt.Errorf("invalid to %q: use YYYY-MM-DD or an RFC 3339 time", toValue)
+		}
+		to = to.AddDate(0, 0, 1)
+	}
+	if !to.After(from) {
+		return from, to, errors.New("to must be after from")
+	}
+	return from, to, nil
+}
+
+// GetAppointmentsBetween retrieves every appointment starting within
+// [from, to), in start time order.
+func GetAppointmentsBetween(db *gorm.DB, from, to time.Time) ([]models.Appointment, error) {
+	var appointments []models.Appointment
+	err := db.Preload("Patient").Preload("AppointmentType").Preload("Resource").Preload("Practitioner").
+		Where("start_time >= ? AND start_time < ?", from, to).
+		Order("start_time asc").
+		Find(&appointments).Error
+	if err != nil {
+		return nil, err
+	}
+	return appointments, nil
+}
@@ -0,0 +1,329 @@
+package appointments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ipmess/dentistbackend/pkg/ical"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/gorm"
+)
+
+// maxImportSize is the largest calendar file that can be imported, in bytes.
+const maxImportSize = 10 << 20
+
+// ImportItem is an event of an imported calendar, with the patient and the
+// appointment type it was matched to, and what stands in the way of booking
+// it.
+type ImportItem struct {
+	Event     ical.ParsedEvent
+	StartTime time.Time
+	Duration  int // minutes
+	// The patient, matched by "email", "phone" or "name". Candidates lists
+	// the patients an ambiguous event could be for.
+	PatientID  uint
+	Patient    *models.Patient  `json:",omitempty"`
+	MatchedBy  string           `json:",omitempty"`
+	Candidates []models.Patient `json:",omitempty"`
+	// The appointment type, matched by a keyword in the summary.
+	AppointmentTypeID uint
+	AppointmentType   *models.AppointmentType `json:",omitempty"`
+	Keyword           string                  `json:",omitempty"`
+	AlreadyImported   bool                    // an appointment was imported from this event before
+	Conflicts         []Conflict
+	Problems          []string
+	// Ready is set if the event can be booked as it is.
+	Ready bool
+}
+
+// ImportRequest is an event to book, as previewed and possibly corrected by
+// the dentist.
+type ImportRequest struct {
+	UID               string
+	StartTime         time.Time
+	Duration          int
+	PatientID         uint
+	AppointmentTypeID uint
+	PractitionerID    *uint // optional
+	ResourceID        *uint // optional
+	AllowOutsideHours bool
+}
+
+// ImportResult is the outcome of booking one ImportRequest.
+type ImportResult struct {
+	UID         string
+	StartTime   time.Time
+	Appointment *models.Appointment  `json:",omitempty"`
+	Error       string               `json:",omitempty"`
+	Conflicts   []models.Appointment `json:",omitempty"`
+}
+
+// normalizeText lowercases text and strips Greek accents, so that "Λεύκανση"
+// matches "λευκανση".
+var normalizeText = strings.NewReplacer(
+	"ά", "α", "έ", "ε", "ή", "η", "ί", "ι", "ϊ", "ι", "ΐ", "ι", "ό", "ο", "ύ", "υ", "ϋ", "υ", "ΰ", "υ", "ώ", "ω", "ς", "σ",
+)
+
+func normalize(text string) string {
+	return strings.Join(strings.Fields(normalizeText.Replace(strings.ToLower(text))), " ")
+}
+
+var phonePattern = regexp.MustCompile(`\+?\d[\d \-]{6,}\d`)
+
+// phoneKey returns the last 8 digits of a phone number, which is a full
+// number in Cyprus, or "" if it has fewer digits.
+func phoneKey(phone string) string {
+	var digits []rune
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, r)
+		}
+	}
+	if len(digits) < 8 {
+		return ""
+	}
+	return string(digits[len(digits)-8:])
+}
+
+// matchType returns the appointment type whose description or keyword
+// appears in summary, preferring the longest match.
+func matchType(summary string, types []models.AppointmentType) (*models.AppointmentType, string) {
+	text := normalize(summary)
+	var best *models.AppointmentType
+	bestKeyword := ""
+	for i := range types {
+		keywords := append([]string{types[i].Description}, strings.Split(types[i].Keywords, ",")...)
+		for _, keyword := range keywords {
+			keyword = normalize(keyword)
+			if keyword != "" && strings.Contains(text, keyword) && len(keyword) > len(bestKeyword) {
+				best, bestKeyword = &types[i], keyword
+			}
+		}
+	}
+	return best, bestKeyword
+}
+
+// matchPatient finds the patient an event is for: by an email address of an
+// attendee or in the text, then by a phone number in the text, then by name.
+// A name matches if every word of the patient's name is in the summary; a
+// name matching several patients is ambiguous.
+func matchPatient(event ical.ParsedEvent, patients []models.Patient) (*models.Patient, string, []models.Patient) {
+	text := event.Summary + "\n" + event.Description + "\n" + event.Location
+	emails := append([]string{}, event.Emails...)
+	for _, word := range strings.Fields(text) {
+		if strings.Contains(word, "@") {
+			emails = append(emails, strings.ToLower(strings.Trim(word, "<>()[],;:")))
+		}
+	}
+	for _, email := range emails {
+		for i := range patients {
+			if patients[i].Email != "" && strings.EqualFold(patients[i].Email, email) {
+				return &patients[i], "email", nil
+			}
+		}
+	}
+	for _, phone := range phonePattern.FindAllString(text, -1) {
+		key := phoneKey(phone)
+		if key == "" {
+			continue
+		}
+		for i := range patients {
+			if phoneKey(patients[i].PhoneNumber) == key {
+				return &patients[i], "phone", nil
+			}
+		}
+	}
+
+	words := map[string]bool{}
+	for _, word := range strings.Fields(normalize(strings.NewReplacer("-", " ", ",", " ", ":", " ", "(", " ", ")", " ").Replace(event.Summary))) {
+		words[word] = true
+	}
+	var candidates []models.Patient
+	for _, patient := range patients {
+		name := strings.Fields(normalize(patient.Name))
+		if len(name) == 0 {
+			continue
+		}
+		all := true
+		for _, word := range name {
+			if !words[word] {
+				all = false
+			}
+		}
+		if all {
+			candidates = append(candidates, patient)
+		}
+	}
+	if len(candidates) == 1 {
+		return &candidates[0], "name", nil
+	}
+	return nil, "", candidates
+}
+
+// PreviewImport matches the events of an iCalendar file to patients and
+// appointment types, and checks them for conflicts. It never writes to the
+// database.
+func PreviewImport(ctx context.Context, db *gorm.DB, events []ical.ParsedEvent) ([]ImportItem, error) {
+	db = db.WithContext(ctx)
+	var patients []models.Patient
+	if err := db.Find(&patients).Error; err != nil {
+		return nil, err
+	}
+	var types []models.AppointmentType
+	if err := db.Where("archived = ?", false).Find(&types).Error; err != nil {
+		return nil, err
+	}
+
+	items := []ImportItem{}
+	for _, event := range events {
+		item := ImportItem{
+			Event:     event,
+			StartTime: event.Start,
+			Duration:  int(event.End.Sub(event.Start).Minutes()),
+			Problems:  append([]string{}, event.Warnings...),
+			Conflicts: []Conflict{},
+		}
+		if patient, by, candidates := matchPatient(event, patients); patient != nil {
+			item.PatientID, item.Patient, item.MatchedBy = patient.ID, patient, by
+		} else {
+			item.Candidates = candidates
+			item.Problems = append(item.Problems, "no matching patient")
+		}
+		if appointmentType, keyword := matchType(event.Summary, types); appointmentType != nil {
+			item.AppointmentTypeID, item.AppointmentType, item.Keyword = appointmentType.ID, appointmentType, keyword
+			if item.Duration <= 0 {
+				item.Duration = appointmentType.DefaultDuration
+			}
+		} else {
+			item.Problems = append(item.Problems, "no matching appointment type")
+		}
+
+		switch {
+		case event.Start.IsZero():
+			item.Problems = append(item.Problems, "no start time")
+		case event.AllDay:
+			item.Problems = append(item.Problems, "all-day event")
+		case event.Status == "CANCELLED":
+			item.Problems = append(item.Problems, "cancelled event")
+		case item.Duration <= 0:
+			item.Problems = append(item.Problems, "no duration")
+		default:
+			if event.UID != "" {
+				var imported int64
+				err := db.Model(&models.Appointment{}).
+					Where("imported_uid = ? AND start_time = ? AND status <> ?", event.UID, event.Start, models.StatusCancelled).
+					Count(&imported).Error
+				if err != nil {
+					return nil, err
+				}
+				item.AlreadyImported = imported > 0
+			}
+			proposed := models.Appointment{
+				StartTime:         item.StartTime,
+				Duration:          item.Duration,
+				AppointmentTypeID: item.AppointmentTypeID,
+			}
+			conflicts, err := CheckConflicts(ctx, db, &proposed, 0)
+			switch {
+			case errors.Is(err, ErrPractitionerNotAllowed), errors.Is(err, ErrResourceNotAllowed):
+				item.Problems = append(item.Problems, err.Error())
+			case err != nil:
+				return nil, err
+			case !item.AlreadyImported:
+				item.Conflicts = conflicts
+			}
+		}
+		item.Ready = item.PatientID != 0 && item.AppointmentTypeID != 0 && len(item.Problems) == 0 &&
+			len(item.Conflicts) == 0 && !item.AlreadyImported
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// ImportAppointments books the requested events one by one through
+// CreateAppointment, so each is checked for conflicts with the schedule and
+// with the events booked before it. It returns the outcome of each.
+func ImportAppointments(ctx context.Context, db *gorm.DB, requests []ImportRequest) []ImportResult {
+	results := make([]ImportResult, len(requests))
+	for i, request := range requests {
+		results[i] = ImportResult{UID: request.UID, StartTime: request.StartTime}
+		if request.StartTime.IsZero() {
+			results[i].Error = ErrMissingStartTime.Error()
+			continue
+		}
+		var patient models.Patient
+		if err := db.WithContext(ctx).First(&patient, request.PatientID).Error; err != nil {
+			results[i].Error = fmt.Sprintf("%s: ID %d", ErrPatientNotFound, request.PatientID)
+			continue
+		}
+		tempUUID, _ := uuid.NewV7()
+		appointment := models.Appointment{
+			UUID:              tempUUID.String(),
+			PatientID:         request.PatientID,
+			AppointmentTypeID: request.AppointmentTypeID,
+			StartTime:         request.StartTime,
+			Duration:          request.Duration,
+			Viber:             patient.Viber,
+			Whatsapp:          patient.Whatsapp,
+			SMS:               patient.SMS,
+			EmailNotification: patient.EmailNotification,
+			Reminder:          patient.ReminderDays * 24,
+			AllowOutsideHours: request.AllowOutsideHours,
+			PractitionerID:    request.PractitionerID,
+			ResourceID:        request.ResourceID,
+			ImportedUID:       request.UID,
+		}
+		created, err := CreateAppointment(ctx, db, appointment)
+		if err != nil {
+			results[i].Error = err.Error()
+			var overlapErr *OverlapError
+			if errors.As(err, &overlapErr) {
+				results[i].Conflicts = overlapErr.Conflicts
+			}
+			continue
+		}
+		results[i].Appointment = &created
+	}
+	return results
+}
+
+// PreviewImport handles POST /appointments/import/preview. The body is an
+// iCalendar (.ics) file, e.g. exported from Outlook. The response lists each
+// event with its matches and conflicts; nothing is booked.
+func (h *HTTPHandler) PreviewImport(w http.ResponseWriter, r *http.Request) {
+	events, err := ical.Parse(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	items, err := PreviewImport(h.Ctx, h.DB, events)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// ImportAppointments handles POST /appointments/import, which books the
+// previewed events the dentist confirmed, e.g.
+// [{"UID": "040000008200E00074C5B7101A82E008", "StartTime": "2025-03-12T10:30:00+02:00",
+// "Duration": 30, "PatientID": 12, "AppointmentTypeID": 2}]
+func (h *HTTPHandler) ImportAppointments(w http.ResponseWriter, r *http.Request) {
+	var requests []ImportRequest
+	err := json.NewDecoder(r.Body).Decode(&requests)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	results := ImportAppointments(h.Ctx, h.DB, requests)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
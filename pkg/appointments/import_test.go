@@ -0,0 +1,127 @@
+package appointments
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/ipmess/dentistbackend/pkg/ical"
+	"github.com/ipmess/dentistbackend/pkg/models"
+)
+
+func TestMatchType(t *testing.T) {
+	types := []models.AppointmentType{
+		{ID: 1, Description: "Cleaning", Keywords: "hygiene,καθαρισμος"},
+		{ID: 2, Description: "Extraction", Keywords: "extraction,εξαγωγη"},
+		{ID: 3, Description: "Wisdom tooth extraction", Keywords: "wisdom"},
+		{ID: 4, Description: "Whitening", Keywords: " , λευκανση "},
+	}
+	tests := []struct {
+		summary string
+		want    uint // 0: no match
+		keyword string
+	}{
+		{"Cleaning - Maria Ioannou", 1, "cleaning"},
+		{"Maria: HYGIENE", 1, "hygiene"},
+		{"Καθαρισμός Μαρία", 1, "καθαρισμοσ"},
+		{"Εξαγωγή - Νίκος", 2, "εξαγωγη"},
+		{"Λεύκανση", 4, "λευκανση"},
+		// the longest match wins:
+		{"Wisdom tooth extraction, Andreas", 3, "wisdom tooth extraction"},
+		{"wisdom   tooth    extraction", 3, "wisdom tooth extraction"},
+		{"Check-up", 0, ""},
+		// empty keywords match nothing:
+		{"", 0, ""},
+	}
+	for _, test := range tests {
+		got, keyword := matchType(test.summary, types)
+		var id uint
+		if got != nil {
+			id = got.ID
+		}
+		if id != test.want || keyword != test.keyword {
+			t.Errorf("matchType(%q) = %d, %q, want %d, %q", test.summary, id, keyword, test.want, test.keyword)
+		}
+	}
+}
+
+func TestMatchPatient(t *testing.T) {
+	patients := []models.Patient{
+		{ID: 1, Name: "Maria Ioannou", PhoneNumber: "+357 99 123456", Email: "maria@example.com"},
+		{ID: 2, Name: "Νίκος Παπαδόπουλος", PhoneNumber: "99654321"},
+		{ID: 3, Name: "Andreas Georgiou", PhoneNumber: "99111222"},
+		{ID: 4, Name: "Andreas Georgiou", PhoneNumber: "99333444"},
+		{ID: 5, Name: "Eleni Ioannou", PhoneNumber: "123"},
+		{ID: 6, Name: " "},
+	}
+	tests := []struct {
+		name       string
+		event      ical.ParsedEvent
+		want       uint // 0: no match
+		by         string
+		candidates []uint
+	}{
+		{
+			name:  "an attendee's email",
+			event: ical.ParsedEvent{Summary: "Cleaning", Emails: []string{"MARIA@example.com"}},
+			want:  1, by: "email",
+		},
+		{
+			name:  "an email in the description",
+			event: ical.ParsedEvent{Summary: "Cleaning", Description: "Contact: <maria@example.com>"},
+			want:  1, by: "email",
+		},
+		{
+			name:  "the email wins over the name",
+			event: ical.ParsedEvent{Summary: "Nikos Andreas Georgiou", Emails: []string{"maria@example.com"}},
+			want:  1, by: "email",
+		},
+		{
+			name:  "a phone number with the country code and spaces",
+			event: ical.ParsedEvent{Summary: "Cleaning", Location: "tel 00357 99-654-321"},
+			want:  2, by: "phone",
+		},
+		{
+			name:  "the last 8 digits of the phone number",
+			event: ical.ParsedEvent{Description: "Call 99123456 first"},
+			want:  1, by: "phone",
+		},
+		{
+			name:  "a name in any order, with accents",
+			event: ical.ParsedEvent{Summary: "Εξαγωγή: ΠΑΠΑΔΟΠΟΥΛΟΣ Νικος"},
+			want:  2, by: "name",
+		},
+		{
+			name:  "a name followed by punctuation",
+			event: ical.ParsedEvent{Summary: "Cleaning (Eleni Ioannou)"},
+			want:  5, by: "name",
+		},
+		{
+			name:       "a name several patients have",
+			event:      ical.ParsedEvent{Summary: "Andreas Georgiou - filling"},
+			candidates: []uint{3, 4},
+		},
+		{
+			name:  "part of a name is not enough",
+			event: ical.ParsedEvent{Summary: "Maria - cleaning"},
+		},
+		{
+			name:  "a short number is not a phone number",
+			event: ical.ParsedEvent{Summary: "Room 123"},
+		},
+	}
+	for _, test := range tests {
+		got, by, candidates := matchPatient(test.event, patients)
+		var id uint
+		if got != nil {
+			id = got.ID
+		}
+		var candidateIDs []uint
+		for _, candidate := range candidates {
+			candidateIDs = append(candidateIDs, candidate.ID)
+		}
+		if id != test.want || by != test.by || !reflect.DeepEqual(candidateIDs, test.candidates) {
+			t.Errorf("%s: matchPatient = %d by %q, candidates %v, want %d by %q, candidates %v",
+				test.name, id, by, candidateIDs, test.want, test.by, test.candidates)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package appointments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"github.com/ipmess/dentistbackend/pkg/notifications"
+	"github.com/ipmess/dentistbackend/pkg/waitlist"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Move describes a new time for an appointment, e.g.
+// {"StartTime": "2025-03-12T10:30:00+02:00", "Duration": 45, "ChangedBy": "reception"}
+type Move struct {
+	StartTime         time.Time
+	Duration          int    // In minutes; 0 keeps the current duration
+	AllowOutsideHours *bool  // the dentist deliberately moves it outside working hours; nil keeps the appointment's setting
+	ResourceID        *uint  // the room or chair to move it to; nil keeps it in its resource if that is free
+	PractitionerID    *uint  // the practitioner to move it to; nil keeps it with its practitioner if they are free
+	ChangedBy         string // who moved it
+	Reason            string
+	// Notify queues a "your appointment was moved" message for the patient.
+	// It defaults to true.
+	Notify *bool
+}
+
+// recordChange stores the time appointment had before it was moved to its
+// current StartTime and Duration.
+func recordChange(tx *gorm.DB, appointment models.Appointment, oldStart time.Time, oldDuration int, changedBy, reason string) error {
+	change := models.AppointmentChange{
+		AppointmentID: appointment.ID,
+		OldStartTime:  oldStart,
+		OldDuration:   oldDuration,
+		NewStartTime:  appointment.StartTime,
+		NewDuration:   appointment.Duration,
+		ChangedBy:     changedBy,
+		Reason:        reason,
+	}
+	return tx.Create(&change).Error
+}
+
+// moveMessage returns the message telling the patient of appointment, in
+// their language, that it has moved from oldStart to its StartTime.
+func moveMessage(appointment models.Appointment, oldStart time.Time) string {
+	oldStart, newStart := oldStart.In(clinic.Location), appointment.StartTime.In(clinic.Location)
+	if appointment.Patient.Language == "en" {
+		return fmt.Sprintf("Dear %s, your appointment for %s on %s has been moved to %s.",
+			appointment.Patient.Name, appointment.AppointmentType.Description,
+			oldStart.Format("Monday 02 Jan 2006 at 15:04"), newStart.Format("Monday 02 Jan 2006 at 15:04"))
+	}
+	return fmt.Sprintf("%s, το ραντεβού σας για %s της %s μεταφέρθηκε για τις %s.",
+		appointment.Patient.Name, appointment.AppointmentType.Description,
+		oldStart.Format("02/01/2006 στις 15:04"), newStart.Format("02/01/2006 στις 15:04"))
+}
+
+// queueMoveNotification queues a message telling the patient that
+// appointment, which needs its patient and type loaded, has moved from
+// oldStart to its StartTime. Failures are only logged, since the appointment
+// has moved anyway.
+func queueMoveNotification(db *gorm.DB, appointment models.Appointment, oldStart time.Time) {
+	message := moveMessage(appointment, oldStart)
+	_, err := notifications.QueueFor(db, appointment, notifications.KindAppointmentMoved, message)
+	if err != nil {
+		log.Printf("couldn't queue the notification for moved appointment %s: %s\n", appointment.UUID, err)
+	}
+}
+
+// reschedule applies move to appointment, which is locked in tx, and
+// changes its type to appointmentTypeID unless that is zero. The new time and
+// type are checked against working hours, other appointments, time off, the
+// resources the type may use and the practitioners who may perform it,
+// ignoring the appointment itself. Nothing is written.
+func reschedule(tx *gorm.DB, appointment *models.Appointment, move Move, appointmentTypeID uint) error {
+	status := currentStatus(*appointment)
+	if status != models.StatusScheduled && status != models.StatusConfirmed {
+		return fmt.Errorf("%w: the appointment is %s", ErrCannotMove, status)
+	}
+	if appointmentTypeID != 0 && appointmentTypeID != appointment.AppointmentTypeID {
+		var appointmentType models.AppointmentType
+		err := tx.First(&appointmentType, appointmentTypeID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return fmt.Errorf("%w: appointment type ID %d", ErrAppointmentTypeNotFound, appointmentTypeID)
+		}
+		if err != nil {
+			return err
+		}
+		if appointmentType.Archived {
+			return fmt.Errorf("%w: %s", ErrAppointmentTypeArchived, appointmentType.Description)
+		}
+		appointment.AppointmentTypeID = appointmentType.ID
+		appointment.AppointmentType = appointmentType
+	}
+	appointment.StartTime = move.StartTime
+	if move.Duration > 0 {
+		appointment.Duration = move.Duration
+	}
+	if move.AllowOutsideHours != nil {
+		appointment.AllowOutsideHours = *move.AllowOutsideHours
+	}
+	if move.ResourceID != nil {
+		appointment.ResourceID = move.ResourceID
+	}
+	if move.PractitionerID != nil {
+		appointment.PractitionerID = move.PractitionerID
+	}
+	pinned := pins{Practitioner: move.PractitionerID != nil, Resource: move.ResourceID != nil}
+	return checkAvailability(tx, appointment, pinned, appointment.ID)
+}
+
+// offerFreedSlot offers the slot previous took up to the waitlist, if
+// appointment moved out of it.
+func offerFreedSlot(db *gorm.DB, previous, appointment models.Appointment) {
+	sameResource := (previous.ResourceID == nil && appointment.ResourceID == nil) ||
+		(previous.ResourceID != nil && appointment.ResourceID != nil && *previous.ResourceID == *appointment.ResourceID)
+	oldEnd := previous.StartTime.Add(time.Duration(previous.Duration) * time.Minute)
+	newEnd := appointment.StartTime.Add(time.Duration(appointment.Duration) * time.Minute)
+	if !sameResource || !appointment.StartTime.Before(oldEnd) || !newEnd.After(previous.StartTime) {
+		waitlist.OfferFreedSlotOrLog(db, previous)
+	}
+}
+
+// MoveAppointment moves the appointment with the given UUID to a new start
+// time and, optionally, a new duration. The new time is checked against
+// working hours, other appointments and time off, ignoring the appointment
+// itself, while holding the schedule lock. The old time is kept in the
+// appointment's history, the patient is notified, and the freed slot is
+// offered to the waitlist.
+func MoveAppointment(ctx context.Context, db *gorm.DB, appointmentUUID string, move Move) (models.Appointment, error) {
+	if move.StartTime.IsZero() {
+		return models.Appointment{}, ErrMissingStartTime
+	}
+	if move.Duration < 0 {
+		return models.Appointment{}, ErrInvalidDuration
+	}
+	var appointment, previous models.Appointment
+	err := withScheduleLock(ctx, db, func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Preload("Patient").Preload("AppointmentType").
+			Where("uuid = ?", appointmentUUID).First(&appointment).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrAppointmentNotFound
+		}
+		if err != nil {
+			return err
+		}
+		previous = appointment
+		if err := reschedule(tx, &appointment, move, 0); err != nil {
+			return err
+		}
+		err = tx.Model(&appointment).Select("StartTime", "Duration", "AllowOutsideHours", "ResourceID", "PractitionerID").Updates(&appointment).Error
+		if err == nil {
+			err = bumpSequence(tx, appointment.ID)
+		}
+		if err != nil {
+			return err
+		}
+		return recordChange(tx, appointment, previous.StartTime, previous.Duration, move.ChangedBy, move.Reason)
+	})
+	if err != nil {
+		return models.Appointment{}, err
+	}
+
+	if move.Notify == nil || *move.Notify {
+		queueMoveNotification(db.WithContext(ctx), appointment, previous.StartTime)
+	}
+	offerFreedSlot(db.WithContext(ctx), previous, appointment)
+	return appointment, nil
+}
+
+// MoveAppointment handles POST /appointments/{uuid}/move.
+func (h *HTTPHandler) MoveAppointment(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var move Move
+	err := json.NewDecoder(r.Body).Decode(&move)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	appointment, err := MoveAppointment(h.Ctx, h.DB, vars["uuid"], move)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(appointment)
+}
+
+// GetAppointmentHistory handles GET /appointments/{uuid}/history, listing
+// every time the appointment was moved, oldest first.
+func (h *HTTPHandler) GetAppointmentHistory(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var appointment models.Appointment
+	err := h.DB.Where("uuid = ?", vars["uuid"]).First(&appointment).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var changes []models.AppointmentChange
+	err = h.DB.Where("appointment_id = ?", appointment.ID).Order("created_at asc").Find(&changes).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
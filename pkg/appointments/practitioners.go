@@ -0,0 +1,251 @@
+package appointments
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"github.com/ipmess/dentistbackend/pkg/practitioners"
+	"github.com/ipmess/dentistbackend/pkg/timeoff"
+	"github.com/ipmess/dentistbackend/pkg/workinghours"
+	"gorm.io/gorm"
+)
+
+// pins says which assignments of an appointment must be kept as they are.
+// The others are only preferences: the appointment stays with its
+// practitioner and in its resource if they are free, or moves to other ones
+// that are.
+type pins struct {
+	Practitioner bool
+	Resource     bool
+}
+
+// availability describes whether an appointment can take place at its time.
+type availability struct {
+	OutOfHours bool                 // outside the working hours of every suitable practitioner
+	Blocks     []timeoff.Block      // time off in the way
+	Conflicts  []models.Appointment // appointments in the way
+	// Staffed is set when the clinic has practitioners, whose appointments
+	// only conflict with their own.
+	Staffed bool
+}
+
+func (a availability) free() bool {
+	return !a.OutOfHours && len(a.Blocks) == 0 && len(a.Conflicts) == 0
+}
+
+// merge adds the blocks and conflicts of other to a, skipping duplicates.
+func (a *availability) merge(other availability) {
+	for _, block := range other.Blocks {
+		duplicate := false
+		for _, existing := range a.Blocks {
+			if existing.UUID == block.UUID && existing.Holiday == block.Holiday && existing.Start.Equal(block.Start) {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			a.Blocks = append(a.Blocks, block)
+		}
+	}
+	for _, conflict := range other.Conflicts {
+		duplicate := false
+		for _, existing := range a.Conflicts {
+			if existing.ID == conflict.ID {
+				duplicate = true
+			}
+		}
+		if !duplicate {
+			a.Conflicts = append(a.Conflicts, conflict)
+		}
+	}
+}
+
+// practitionerSchedule is the part of a calendar view booked with one
+// practitioner.
+type practitionerSchedule struct {
+	Practitioner *models.Practitioner // nil for appointments booked before there were practitioners
+	Appointments []models.Appointment
+}
+
+// preferFirst returns items with the one at index moved to the front.
+func preferFirst[T any](items []T, index int) []T {
+	reordered := []T{items[index]}
+	for i, item := range items {
+		if i != index {
+			reordered = append(reordered, item)
+		}
+	}
+	return reordered
+}
+
+// checkPractitioner checks appointment against the working hours and time
+// off of practitioner, or of the clinic if practitioner is nil, and against
+// the practitioner's other appointments in overlapping.
+func checkPractitioner(tx *gorm.DB, appointment *models.Appointment, practitioner *models.Practitioner, overlapping []models.Appointment) (availability, error) {
+	var result availability
+	end := appointment.StartTime.Add(time.Duration(appointment.Duration) * time.Minute)
+	var practitionerID *uint
+	schedule, err := workinghours.Load(tx)
+	if practitioner != nil {
+		practitionerID = &practitioner.ID
+		schedule, err = workinghours.LoadFor(tx, practitioner.ID)
+	}
+	if err != nil {
+		return result, fmt.Errorf("error loading working hours: %w", err)
+	}
+	result.OutOfHours = !appointment.AllowOutsideHours && !schedule.Covers(appointment.StartTime, end)
+	result.Blocks, err = timeoff.OccurrencesFor(tx, appointment.StartTime, end, practitionerID)
+	if err != nil {
+		return result, fmt.Errorf("error checking for time off: %w", err)
+	}
+	if practitioner != nil {
+		// appointments without a practitioner were booked while there was
+		// only one, so they take up every practitioner's time:
+		for _, other := range overlapping {
+			if other.PractitionerID == nil || *other.PractitionerID == practitioner.ID {
+				result.Conflicts = append(result.Conflicts, other)
+			}
+		}
+	}
+	return result, nil
+}
+
+// assignPractitioner books appointment with a practitioner who may perform
+// its type and is free at its time. If pinned is set, only the appointment's
+// current PractitionerID is tried; otherwise the current practitioner is
+// preferred, then the others in order. If nobody is free, it returns what is
+// in the way: for the practitioners working at the time if there are any,
+// otherwise for all of them, with OutOfHours set. While the clinic has no
+// practitioners, the clinic's working hours and time off are checked.
+func assignPractitioner(tx *gorm.DB, appointment *models.Appointment, overlapping []models.Appointment, pinned bool) (availability, error) {
+	candidates, err := practitioners.AllowedFor(tx, appointment.AppointmentTypeID)
+	if err != nil {
+		return availability{}, fmt.Errorf("error loading practitioners: %w", err)
+	}
+	if len(candidates) == 0 {
+		active, err := practitioners.Active(tx)
+		if err != nil {
+			return availability{}, fmt.Errorf("error loading practitioners: %w", err)
+		}
+		if len(active) > 0 || (pinned && appointment.PractitionerID != nil) {
+			return availability{}, fmt.Errorf("%w: appointment type ID %d", ErrPractitionerNotAllowed, appointment.AppointmentTypeID)
+		}
+		appointment.PractitionerID = nil
+		appointment.Practitioner = nil
+		return checkPractitioner(tx, appointment, nil, overlapping)
+	}
+
+	if appointment.PractitionerID != nil {
+		current := -1
+		for i, practitioner := range candidates {
+			if practitioner.ID == *appointment.PractitionerID {
+				current = i
+			}
+		}
+		switch {
+		case current < 0 && pinned:
+			return availability{}, fmt.Errorf("%w: practitioner ID %d", ErrPractitionerNotAllowed, *appointment.PractitionerID)
+		case current >= 0 && pinned:
+			candidates = candidates[current : current+1]
+		case current > 0:
+			candidates = preferFirst(candidates, current)
+		}
+	}
+
+	working := availability{Staffed: true}
+	all := availability{Staffed: true}
+	anyWorking := false
+	for i := range candidates {
+		practitioner := candidates[i]
+		result, err := checkPractitioner(tx, appointment, &practitioner, overlapping)
+		if err != nil {
+			return availability{}, err
+		}
+		result.Staffed = true
+		if result.free() {
+			appointment.PractitionerID = &practitioner.ID
+			appointment.Practitioner = &practitioner
+			return result, nil
+		}
+		all.merge(result)
+		if !result.OutOfHours {
+			anyWorking = true
+			working.merge(result)
+		}
+	}
+	if anyWorking {
+		return working, nil
+	}
+	all.OutOfHours = true
+	return all, nil
+}
+
+// evaluate checks whether appointment can take place at its time, ignoring
+// the appointments in excludeIDs, and books it with a free practitioner and
+// into a free resource if there are any. Buffer time before and after
+// appointments keeps them apart, but working hours and time off only apply to
+// the appointment itself. It never writes to the database.
+func evaluate(tx *gorm.DB, appointment *models.Appointment, pinned pins, excludeIDs ...uint) (availability, error) {
+	appointment.StartTime = appointment.StartTime.In(clinic.Location)
+	if appointment.AppointmentTypeID != 0 && appointment.AppointmentType.ID != appointment.AppointmentTypeID {
+		appointment.AppointmentType = models.AppointmentType{}
+		err := tx.First(&appointment.AppointmentType, appointment.AppointmentTypeID).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return availability{}, fmt.Errorf("%w: appointment type ID %d", ErrAppointmentTypeNotFound, appointment.AppointmentTypeID)
+		}
+		if err != nil {
+			return availability{}, err
+		}
+	}
+	// other appointments are in the way if they overlap this one, including
+	// the buffer time of both:
+	start, end := occupied(*appointment)
+	overlapping, err := FindOverlappingAppointments(tx, start, end, excludeIDs...)
+	if err != nil {
+		return availability{}, fmt.Errorf("error checking for overlapping appointments: %w", err)
+	}
+	result, err := assignPractitioner(tx, appointment, overlapping, pinned.Practitioner)
+	if err != nil {
+		return availability{}, err
+	}
+	inTheWay, err := assignResource(tx, appointment, overlapping, pinned.Resource, result.Staffed)
+	if err != nil {
+		return availability{}, err
+	}
+	result.merge(availability{Conflicts: inTheWay})
+	sort.Slice(result.Conflicts, func(i, j int) bool {
+		return result.Conflicts[i].StartTime.Before(result.Conflicts[j].StartTime)
+	})
+	return result, nil
+}
+
+// groupByPractitioner splits appointments by practitioner, in practitioner ID
+// order. Appointments without a practitioner come last.
+func groupByPractitioner(appointments []models.Appointment) []practitionerSchedule {
+	groups := []practitionerSchedule{}
+	index := make(map[uint]int)
+	var unassigned []models.Appointment
+	for _, appointment := range appointments {
+		if appointment.PractitionerID == nil {
+			unassigned = append(unassigned, appointment)
+			continue
+		}
+		i, ok := index[*appointment.PractitionerID]
+		if !ok {
+			i = len(groups)
+			index[*appointment.PractitionerID] = i
+			groups = append(groups, practitionerSchedule{Practitioner: appointment.Practitioner})
+		}
+		groups[i].Appointments = append(groups[i].Appointments, appointment)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return *groups[i].Appointments[0].PractitionerID < *groups[j].Appointments[0].PractitionerID
+	})
+	if len(unassigned) > 0 {
+		groups = append(groups, practitionerSchedule{Appointments: unassigned})
+	}
+	return groups
+}
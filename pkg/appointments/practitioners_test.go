@@ -0,0 +1,238 @@
+package appointments
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"github.com/ipmess/dentistbackend/pkg/timeoff"
+)
+
+func TestPreferFirst(t *testing.T) {
+	tests := []struct {
+		items []string
+		index int
+		want  []string
+	}{
+		{[]string{"a", "b", "c"}, 0, []string{"a", "b", "c"}},
+		{[]string{"a", "b", "c"}, 1, []string{"b", "a", "c"}},
+		{[]string{"a", "b", "c"}, 2, []string{"c", "a", "b"}},
+		{[]string{"a"}, 0, []string{"a"}},
+	}
+	for _, test := range tests {
+		items := append([]string{}, test.items...)
+		if got := preferFirst(items, test.index); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("preferFirst(%v, %d) = %v, want %v", test.items, test.index, got, test.want)
+		}
+		if !reflect.DeepEqual(items, test.items) {
+			t.Errorf("preferFirst(%v, %d) changed its argument to %v", test.items, test.index, items)
+		}
+	}
+}
+
+func TestMerge(t *testing.T) {
+	start := wednesday(10, 0)
+	a := availability{
+		Blocks:    []timeoff.Block{{UUID: "lunch", Start: start}},
+		Conflicts: []models.Appointment{{ID: 1}},
+	}
+	a.merge(availability{
+		OutOfHours: true,
+		Blocks: []timeoff.Block{
+			{UUID: "lunch", Start: start},                     // the same block
+			{UUID: "lunch", Start: start.AddDate(0, 0, 7)},    // the next occurrence
+			{UUID: "", Holiday: "green-monday", Start: start}, // a holiday
+		},
+		Conflicts: []models.Appointment{{ID: 2}, {ID: 1}},
+	})
+	if len(a.Blocks) != 3 {
+		t.Errorf("merged into %d blocks, want 3: %+v", len(a.Blocks), a.Blocks)
+	}
+	var ids []uint
+	for _, conflict := range a.Conflicts {
+		ids = append(ids, conflict.ID)
+	}
+	if !reflect.DeepEqual(ids, []uint{1, 2}) {
+		t.Errorf("merged into conflicts %v, want [1 2]", ids)
+	}
+	if a.OutOfHours {
+		t.Error("merge set OutOfHours")
+	}
+	if a.free() {
+		t.Error("free() with blocks and conflicts")
+	}
+	if !(availability{}).free() {
+		t.Error("an empty availability is not free()")
+	}
+}
+
+func TestGroupByPractitioner(t *testing.T) {
+	maria := &models.Practitioner{ID: 1, Name: "Maria"}
+	nikos := &models.Practitioner{ID: 2, Name: "Nikos"}
+	tests := []struct {
+		name          string
+		appointments  []models.Appointment
+		want          [][]uint // the appointment IDs of each group
+		practitioners []*models.Practitioner
+	}{
+		{
+			name: "no appointments",
+		},
+		{
+			name: "in practitioner ID order, whatever the order of the appointments",
+			appointments: []models.Appointment{
+				{ID: 1, PractitionerID: uintPtr(2), Practitioner: nikos},
+				{ID: 2, PractitionerID: uintPtr(1), Practitioner: maria},
+				{ID: 3, PractitionerID: uintPtr(2), Practitioner: nikos},
+			},
+			want:          [][]uint{{2}, {1, 3}},
+			practitioners: []*models.Practitioner{maria, nikos},
+		},
+		{
+			name: "appointments without a practitioner come last",
+			appointments: []models.Appointment{
+				{ID: 1},
+				{ID: 2, PractitionerID: uintPtr(2), Practitioner: nikos},
+			},
+			want:          [][]uint{{2}, {1}},
+			practitioners: []*models.Practitioner{nikos, nil},
+		},
+	}
+	for _, test := range tests {
+		var got [][]uint
+		var practitioners []*models.Practitioner
+		for _, group := range groupByPractitioner(test.appointments) {
+			var ids []uint
+			for _, appointment := range group.Appointments {
+				ids = append(ids, appointment.ID)
+			}
+			got = append(got, ids)
+			practitioners = append(practitioners, group.Practitioner)
+		}
+		if !reflect.DeepEqual(got, test.want) || !reflect.DeepEqual(practitioners, test.practitioners) {
+			t.Errorf("%s: groupByPractitioner = %v with %v, want %v with %v", test.name, got, practitioners, test.want, test.practitioners)
+		}
+	}
+}
+
+func TestCheckConflictsPerPractitioner(t *testing.T) {
+	tests := []struct {
+		name          string
+		booked        []booking
+		afternoonOnly []int // practitioners who only work from 12:00 to 17:00 on Wednesdays
+		onlyBuffered  []int // practitioners who may only perform the buffered type
+		proposed      booking
+		conflicts     []int // indexes into booked
+		outOfHours    bool
+		practitioner  int // the practitioner the proposed appointment is booked with
+		wantErr       error
+	}{
+		{
+			name:         "another practitioner is free",
+			booked:       []booking{{10, 0, -1, 0, false}},
+			proposed:     booking{10, 0, -1, -1, false},
+			practitioner: 1,
+		},
+		{
+			name:      "the requested practitioner is busy",
+			booked:    []booking{{10, 0, -1, 0, false}},
+			proposed:  booking{10, 0, -1, 0, false},
+			conflicts: []int{0},
+		},
+		{
+			name:         "practitioners only conflict with their own appointments",
+			booked:       []booking{{10, 0, -1, 1, false}},
+			proposed:     booking{10, 0, -1, 0, false},
+			practitioner: 0,
+		},
+		{
+			name:      "everyone is busy",
+			booked:    []booking{{10, 15, -1, 1, false}, {10, 0, -1, 0, false}},
+			proposed:  booking{10, 0, -1, -1, false},
+			conflicts: []int{1, 0},
+		},
+		{
+			name:      "an appointment without a practitioner takes up everyone's time",
+			booked:    []booking{{10, 0, -1, -1, false}},
+			proposed:  booking{10, 0, -1, -1, false},
+			conflicts: []int{0},
+		},
+		{
+			name:          "only the conflicts of the practitioners working at the time",
+			booked:        []booking{{10, 0, -1, 0, false}},
+			afternoonOnly: []int{1},
+			proposed:      booking{10, 0, -1, -1, false},
+			conflicts:     []int{0},
+		},
+		{
+			name:          "a practitioner's own working hours",
+			afternoonOnly: []int{0},
+			proposed:      booking{12, 0, -1, 0, false},
+			practitioner:  0,
+		},
+		{
+			name:          "outside everyone's working hours",
+			afternoonOnly: []int{0, 1},
+			proposed:      booking{10, 0, -1, -1, false},
+			outOfHours:    true,
+		},
+		{
+			name:         "the type goes to a practitioner who may perform it",
+			onlyBuffered: []int{0},
+			proposed:     booking{10, 0, -1, -1, false},
+			practitioner: 1,
+		},
+		{
+			name:         "a practitioner who may not perform the type",
+			onlyBuffered: []int{0},
+			proposed:     booking{10, 0, -1, 0, false},
+			wantErr:      ErrPractitionerNotAllowed,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, 0, 2)
+			for _, i := range test.afternoonOnly {
+				hours := models.WorkingHours{PractitionerID: &f.practitioners[i].ID, Weekday: time.Wednesday, Opens: "12:00", Closes: "17:00"}
+				if err := f.db.Create(&hours).Error; err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, i := range test.onlyBuffered {
+				err := f.db.Exec("INSERT INTO practitioner_appointment_types (practitioner_id, appointment_type_id) VALUES (?, ?)", f.practitioners[i].ID, f.buffered.ID).Error
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			ids := f.book(t, test.booked)
+			proposed := f.appointment(test.proposed)
+			conflicts, err := CheckConflicts(context.Background(), f.db, &proposed, 0)
+			if test.wantErr != nil || err != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("CheckConflicts error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			var want []uint
+			for _, i := range test.conflicts {
+				want = append(want, ids[i])
+			}
+			if got := conflictingIDs(conflicts); !reflect.DeepEqual(got, want) {
+				t.Errorf("conflicts with %v, want %v", got, want)
+			}
+			outOfHours := false
+			for _, conflict := range conflicts {
+				outOfHours = outOfHours || conflict.Kind == ConflictOutOfHours
+			}
+			if outOfHours != test.outOfHours {
+				t.Errorf("out of hours = %v, want %v", outOfHours, test.outOfHours)
+			}
+			if len(conflicts) == 0 && (proposed.PractitionerID == nil || *proposed.PractitionerID != f.practitioners[test.practitioner].ID) {
+				t.Errorf("booked with practitioner %v, want %d", proposed.PractitionerID, f.practitioners[test.practitioner].ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package appointments
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"github.com/ipmess/dentistbackend/pkg/resources"
+	"gorm.io/gorm"
+)
+
+// resourceSchedule is the part of a calendar view booked into one resource.
+type resourceSchedule struct {
+	Resource     *models.Resource // nil for appointments booked before there were resources
+	Appointments []models.Appointment
+}
+
+// bookedInto returns the appointments in overlapping that occupy resourceID.
+// Appointments without a resource were booked while the clinic had a single
+// chair, so they occupy every resource.
+func bookedInto(resourceID uint, overlapping []models.Appointment) []models.Appointment {
+	var booked []models.Appointment
+	for _, other := range overlapping {
+		if other.ResourceID == nil || *other.ResourceID == resourceID {
+			booked = append(booked, other)
+		}
+	}
+	return booked
+}
+
+// assignResource books appointment into a resource that is free, given the
+// appointments overlapping its time. If pinned is set, only the appointment's
+// current ResourceID is tried; otherwise the current resource is preferred,
+// then the others the appointment type can use, in order. It returns the
+// appointments in the way if no resource is free. While the clinic has no
+// resources, every overlapping appointment is in the way, unless the clinic
+// is staffed by practitioners, who then keep their appointments apart.
+func assignResource(tx *gorm.DB, appointment *models.Appointment, overlapping []models.Appointment, pinned, staffed bool) ([]models.Appointment, error) {
+	allowed, err := resources.AllowedFor(tx, appointment.AppointmentTypeID)
+	if err != nil {
+		return nil, fmt.Errorf("error loading resources: %w", err)
+	}
+	if len(allowed) == 0 {
+		if pinned && appointment.ResourceID != nil {
+			return nil, fmt.Errorf("%w: resource ID %d", ErrResourceNotAllowed, *appointment.ResourceID)
+		}
+		appointment.ResourceID = nil
+		appointment.Resource = nil
+		if staffed {
+			return nil, nil
+		}
+		return overlapping, nil
+	}
+
+	candidates := allowed
+	if appointment.ResourceID != nil {
+		current := -1
+		for i, resource := range allowed {
+			if resource.ID == *appointment.ResourceID {
+				current = i
+			}
+		}
+		switch {
+		case current < 0 && pinned:
+			return nil, fmt.Errorf("%w: resource ID %d", ErrResourceNotAllowed, *appointment.ResourceID)
+		case current >= 0 && pinned:
+			candidates = allowed[current : current+1]
+		case current > 0:
+			candidates = preferFirst(allowed, current)
+		}
+	}
+
+	var inTheWay []models.Appointment
+	seen := make(map[uint]bool)
+	for i := range candidates {
+		resource := candidates[i]
+		booked := bookedInto(resource.ID, overlapping)
+		if len(booked) == 0 {
+			appointment.ResourceID = &resource.ID
+			appointment.Resource = &resource
+			return nil, nil
+		}
+		for _, other := range booked {
+			if !seen[other.ID] {
+				seen[other.ID] = true
+				inTheWay = append(inTheWay, other)
+			}
+		}
+	}
+	return inTheWay, nil
+}
+
+// groupByResource splits appointments by the resource they are booked into,
+// in resource ID order. Appointments without a resource come last.
+func groupByResource(appointments []models.Appointment) []resourceSchedule {
+	groups := []resourceSchedule{}
+	index := make(map[uint]int)
+	var unassigned []models.Appointment
+	for _, appointment := range appointments {
+		if appointment.ResourceID == nil {
+			unassigned = append(unassigned, appointment)
+			continue
+		}
+		i, ok := index[*appointment.ResourceID]
+		if !ok {
+			i = len(groups)
+			index[*appointment.ResourceID] = i
+			groups = append(groups, resourceSchedule{Resource: appointment.Resource})
+		}
+		groups[i].Appointments = append(groups[i].Appointments, appointment)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return *groups[i].Appointments[0].ResourceID < *groups[j].Appointments[0].ResourceID
+	})
+	if len(unassigned) > 0 {
+		groups = append(groups, resourceSchedule{Appointments: unassigned})
+	}
+	return groups
+}
@@ -0,0 +1,333 @@
+package appointments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+func uintPtr(id uint) *uint {
+	return &id
+}
+
+func TestBookedInto(t *testing.T) {
+	overlapping := []models.Appointment{
+		{ID: 1, ResourceID: uintPtr(1)},
+		{ID: 2, ResourceID: uintPtr(2)},
+		{ID: 3}, // booked before there were resources
+		{ID: 4, ResourceID: uintPtr(1)},
+	}
+	tests := []struct {
+		resourceID uint
+		want       []uint
+	}{
+		{1, []uint{1, 3, 4}},
+		{2, []uint{2, 3}},
+		{3, []uint{3}},
+	}
+	for _, test := range tests {
+		var got []uint
+		for _, appointment := range bookedInto(test.resourceID, overlapping) {
+			got = append(got, appointment.ID)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("bookedInto(%d) = %v, want %v", test.resourceID, got, test.want)
+		}
+	}
+}
+
+func TestGroupByResource(t *testing.T) {
+	chair := &models.Resource{ID: 1, Name: "Chair"}
+	hygiene := &models.Resource{ID: 2, Name: "Hygiene room"}
+	tests := []struct {
+		name         string
+		appointments []models.Appointment
+		want         [][]uint // the appointment IDs of each group
+		resources    []*models.Resource
+	}{
+		{
+			name:      "no appointments",
+			want:      nil,
+			resources: nil,
+		},
+		{
+			name: "in resource ID order, whatever the order of the appointments",
+			appointments: []models.Appointment{
+				{ID: 1, ResourceID: uintPtr(2), Resource: hygiene},
+				{ID: 2, ResourceID: uintPtr(1), Resource: chair},
+				{ID: 3, ResourceID: uintPtr(2), Resource: hygiene},
+			},
+			want:      [][]uint{{2}, {1, 3}},
+			resources: []*models.Resource{chair, hygiene},
+		},
+		{
+			name: "appointments without a resource come last",
+			appointments: []models.Appointment{
+				{ID: 1},
+				{ID: 2, ResourceID: uintPtr(1), Resource: chair},
+				{ID: 3},
+			},
+			want:      [][]uint{{2}, {1, 3}},
+			resources: []*models.Resource{chair, nil},
+		},
+	}
+	for _, test := range tests {
+		groups := groupByResource(test.appointments)
+		var got [][]uint
+		var resources []*models.Resource
+		for _, group := range groups {
+			var ids []uint
+			for _, appointment := range group.Appointments {
+				ids = append(ids, appointment.ID)
+			}
+			got = append(got, ids)
+			resources = append(resources, group.Resource)
+		}
+		if !reflect.DeepEqual(got, test.want) || !reflect.DeepEqual(resources, test.resources) {
+			t.Errorf("%s: groupByResource = %v with %v, want %v with %v", test.name, got, resources, test.want, test.resources)
+		}
+	}
+}
+
+// The conflict tests below need a MariaDB database they may empty, e.g.
+//
+//	DENTISTBACKEND_TEST_DSN='test:test@tcp(localhost:3306)/dentist_test?parseTime=true' go test ./pkg/appointments
+//
+// Without one, they are skipped.
+
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("DENTISTBACKEND_TEST_DSN")
+	if dsn == "" {
+		t.Skip("DENTISTBACKEND_TEST_DSN is not set")
+	}
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&models.Appointment{}, &models.Patient{}, &models.AppointmentType{}, &models.WorkingHours{}, &models.TimeOff{}, &models.HolidayOptOut{}, &models.AppointmentSeries{}, &models.AppointmentChange{}, &models.Resource{}, &models.Practitioner{}, &models.WaitlistEntry{}, &models.WaitlistOffer{}, &models.Notification{}, &models.GoogleCalendarEvent{}, &models.GoogleCalendarSync{}, &models.Charge{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range []string{"appointment_type_resources", "practitioner_appointment_types"} {
+		if err := db.Exec("DELETE FROM " + table).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, model := range []any{&models.GoogleCalendarEvent{}, &models.AppointmentChange{}, &models.Notification{},
+		&models.WaitlistOffer{}, &models.WaitlistEntry{}, &models.Charge{}, &models.Appointment{}, &models.AppointmentSeries{},
+		&models.WorkingHours{}, &models.TimeOff{}, &models.HolidayOptOut{}, &models.Patient{}, &models.AppointmentType{},
+		&models.Resource{}, &models.Practitioner{}} {
+		if err := db.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(model).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// fixture is the schedule of a conflict test: a patient, a 30 minute
+// appointment type without buffer time and one with 15 minutes of it after,
+// and a few resources or practitioners.
+type fixture struct {
+	db            *gorm.DB
+	patient       models.Patient
+	plain         models.AppointmentType
+	buffered      models.AppointmentType
+	resources     []models.Resource
+	practitioners []models.Practitioner
+	booked        int
+}
+
+func newFixture(t *testing.T, resources, practitioners int) *fixture {
+	f := &fixture{db: openTestDB(t)}
+	f.patient = models.Patient{Name: "Andreas Georgiou", UUID: "0192f0c4-0000-7000-8000-000000000001"}
+	if err := f.db.Create(&f.patient).Error; err != nil {
+		t.Fatal(err)
+	}
+	f.plain = models.AppointmentType{Description: "Check-up", DefaultDuration: 30, Color: "#FFD700"}
+	f.buffered = models.AppointmentType{Description: "Extraction", DefaultDuration: 30, BufferAfter: 15, Color: "#FF6347"}
+	for _, appointmentType := range []*models.AppointmentType{&f.plain, &f.buffered} {
+		if err := f.db.Omit("Appointments", "Resources").Create(appointmentType).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < resources; i++ {
+		resource := models.Resource{Name: fmt.Sprintf("Chair %d", i+1), UUID: fmt.Sprintf("0192f0c4-0000-7000-8000-2000000000%02d", i), Active: true}
+		if err := f.db.Create(&resource).Error; err != nil {
+			t.Fatal(err)
+		}
+		f.resources = append(f.resources, resource)
+	}
+	for i := 0; i < practitioners; i++ {
+		practitioner := models.Practitioner{Name: fmt.Sprintf("Dentist %d", i+1), UUID: fmt.Sprintf("0192f0c4-0000-7000-8000-3000000000%02d", i), Active: true}
+		if err := f.db.Omit("AppointmentTypes").Create(&practitioner).Error; err != nil {
+			t.Fatal(err)
+		}
+		f.practitioners = append(f.practitioners, practitioner)
+	}
+	return f
+}
+
+// wednesday returns the time on a future Wednesday that is not a holiday.
+func wednesday(hour, minute int) time.Time {
+	return time.Date(2030, time.March, 13, hour, minute, 0, 0, clinic.Location)
+}
+
+// booking is an appointment of a conflict test. resource and practitioner
+// are indexes into the fixture's, or -1 for none.
+type booking struct {
+	hour, minute int
+	resource     int
+	practitioner int
+	buffered     bool
+}
+
+// appointment builds the appointment of b, without storing it.
+func (f *fixture) appointment(b booking) models.Appointment {
+	appointment := models.Appointment{
+		PatientID:         f.patient.ID,
+		AppointmentTypeID: f.plain.ID,
+		StartTime:         wednesday(b.hour, b.minute),
+		Duration:          30,
+		Status:            models.StatusScheduled,
+	}
+	if b.buffered {
+		appointment.AppointmentTypeID = f.buffered.ID
+	}
+	if b.resource >= 0 {
+		appointment.ResourceID = &f.resources[b.resource].ID
+	}
+	if b.practitioner >= 0 {
+		appointment.PractitionerID = &f.practitioners[b.practitioner].ID
+	}
+	return appointment
+}
+
+// book stores the appointments of bookings, and returns their IDs.
+func (f *fixture) book(t *testing.T, bookings []booking) []uint {
+	t.Helper()
+	var ids []uint
+	for _, b := range bookings {
+		appointment := f.appointment(b)
+		f.booked++
+		appointment.UUID = fmt.Sprintf("0192f0c4-0000-7000-8000-1000000000%02d", f.booked)
+		if err := f.db.Omit("Patient", "AppointmentType", "Resource", "Practitioner").Create(&appointment).Error; err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, appointment.ID)
+	}
+	return ids
+}
+
+// conflictingIDs returns the IDs of the appointments among conflicts.
+func conflictingIDs(conflicts []Conflict) []uint {
+	var ids []uint
+	for _, conflict := range conflicts {
+		if conflict.Kind == ConflictAppointment {
+			ids = append(ids, conflict.Appointment.ID)
+		}
+	}
+	return ids
+}
+
+func TestCheckConflictsPerResource(t *testing.T) {
+	tests := []struct {
+		name      string
+		booked    []booking
+		allowed   []int // the resources the plain type may use; empty: any
+		proposed  booking
+		conflicts []int // indexes into booked
+		resource  int   // the resource the proposed appointment goes into
+		wantErr   error
+	}{
+		{
+			name:     "another resource is free",
+			booked:   []booking{{10, 0, 0, -1, false}},
+			proposed: booking{10, 0, -1, -1, false},
+			resource: 1,
+		},
+		{
+			name:      "the requested resource is taken",
+			booked:    []booking{{10, 0, 0, -1, false}},
+			proposed:  booking{10, 15, 0, -1, false},
+			conflicts: []int{0},
+		},
+		{
+			name:     "appointments that touch do not overlap",
+			booked:   []booking{{10, 0, 0, -1, false}},
+			proposed: booking{10, 30, 0, -1, false},
+			resource: 0,
+		},
+		{
+			name:      "the buffer time after an appointment",
+			booked:    []booking{{10, 0, 0, -1, true}},
+			proposed:  booking{10, 30, 0, -1, false},
+			conflicts: []int{0},
+		},
+		{
+			name:      "every resource is taken",
+			booked:    []booking{{10, 0, 0, -1, false}, {9, 45, 1, -1, false}},
+			proposed:  booking{10, 0, -1, -1, false},
+			conflicts: []int{1, 0},
+		},
+		{
+			name:      "an appointment without a resource takes up all of them",
+			booked:    []booking{{10, 0, -1, -1, false}},
+			proposed:  booking{10, 0, 1, -1, false},
+			conflicts: []int{0},
+		},
+		{
+			name:      "only the resources of the type are tried",
+			booked:    []booking{{10, 0, 0, -1, false}},
+			allowed:   []int{0},
+			proposed:  booking{10, 0, -1, -1, false},
+			conflicts: []int{0},
+		},
+		{
+			name:     "a resource the type may not use",
+			allowed:  []int{0},
+			proposed: booking{10, 0, 1, -1, false},
+			wantErr:  ErrResourceNotAllowed,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f := newFixture(t, 2, 0)
+			for _, i := range test.allowed {
+				err := f.db.Exec("INSERT INTO appointment_type_resources (appointment_type_id, resource_id) VALUES (?, ?)", f.plain.ID, f.resources[i].ID).Error
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			ids := f.book(t, test.booked)
+			proposed := f.appointment(test.proposed)
+			conflicts, err := CheckConflicts(context.Background(), f.db, &proposed, 0)
+			if test.wantErr != nil || err != nil {
+				if !errors.Is(err, test.wantErr) {
+					t.Fatalf("CheckConflicts error = %v, want %v", err, test.wantErr)
+				}
+				return
+			}
+			var want []uint
+			for _, i := range test.conflicts {
+				want = append(want, ids[i])
+			}
+			if got := conflictingIDs(conflicts); !reflect.DeepEqual(got, want) {
+				t.Errorf("conflicts with %v, want %v", got, want)
+			}
+			if len(want) == 0 && (proposed.ResourceID == nil || *proposed.ResourceID != f.resources[test.resource].ID) {
+				t.Errorf("booked into resource %v, want %d", proposed.ResourceID, f.resources[test.resource].ID)
+			}
+		})
+	}
+}
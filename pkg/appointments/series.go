@@ -0,0 +1,575 @@
+package appointments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"github.com/ipmess/dentistbackend/pkg/rrule"
+	"github.com/ipmess/dentistbackend/pkg/timeoff"
+	"github.com/ipmess/dentistbackend/pkg/waitlist"
+	"gorm.io/gorm"
+)
+
+// Scope says which occurrences of a series an edit or a cancellation applies to.
+type Scope string
+
+const (
+	ScopeThis      Scope = "this"      // only the selected occurrence
+	ScopeFollowing Scope = "following" // the selected occurrence and every later one
+	ScopeAll       Scope = "all"       // every occurrence that has not started yet
+)
+
+// maxSeriesOccurrences limits how many appointments a single series can create.
+const maxSeriesOccurrences = 260
+
+type seriesRequest struct {
+	// a structure to hold the request data for creating a recurring series
+	models.AppointmentSeries
+	AllowOutsideHours bool
+	SkipConflicts     bool // create the free occurrences even if some of them collide
+}
+
+type seriesResponse struct {
+	Series      models.AppointmentSeries
+	Occurrences []OccurrenceResult
+}
+
+type occurrenceEditRequest struct {
+	// a structure to hold the changes to one or more occurrences of a series
+	StartTime         time.Time // new start of the selected occurrence; zero keeps the time
+	Duration          int       // new duration in minutes; zero keeps the duration
+	AppointmentTypeID uint      // new appointment type; zero keeps the type
+	AllowOutsideHours *bool     // nil keeps the setting of each occurrence
+}
+
+// OccurrenceResult is the outcome of the overlap check for one occurrence of
+// a series.
+type OccurrenceResult struct {
+	StartTime   time.Time
+	Appointment *models.Appointment  `json:",omitempty"` // the appointment, if it was created or changed
+	Error       string               `json:",omitempty"` // why the occurrence could not be booked
+	Conflicts   []models.Appointment `json:",omitempty"`
+	Blocks      []timeoff.Block      `json:",omitempty"`
+}
+
+// SeriesConflictError is returned when some occurrences of a series cannot
+// be booked. Occurrences lists every occurrence; the ones that collide have
+// an Error. errors.Is(err, ErrOverlap) reports true for it.
+type SeriesConflictError struct {
+	Occurrences []OccurrenceResult
+}
+
+func (e *SeriesConflictError) Error() string {
+	failed := 0
+	for _, occurrence := range e.Occurrences {
+		if occurrence.Error != "" {
+			failed++
+		}
+	}
+	return fmt.Sprintf("%d of %d occurrences cannot be booked", failed, len(e.Occurrences))
+}
+
+func (e *SeriesConflictError) Unwrap() error {
+	return ErrOverlap
+}
+
+// ParseScope checks that value is one of "this", "following" or "all".
+func ParseScope(value string) (Scope, error) {
+	switch scope := Scope(value); scope {
+	case ScopeThis, ScopeFollowing, ScopeAll:
+		return scope, nil
+	default:
+		return "", fmt.Errorf("%w %q, expected this, following or all", ErrInvalidScope, value)
+	}
+}
+
+// occurrenceResult checks appointment for availability, booking it into a
+// free resource, and describes the outcome. The error is only set if the
+// check itself failed.
+func occurrenceResult(tx *gorm.DB, appointment *models.Appointment, excludeIDs ...uint) (OccurrenceResult, error) {
+	result := OccurrenceResult{StartTime: appointment.StartTime}
+	err := checkAvailability(tx, appointment, pins{}, excludeIDs...)
+	var overlapErr *OverlapError
+	switch {
+	case err == nil:
+	case errors.As(err, &overlapErr):
+		result.Error = err.Error()
+		result.Conflicts = overlapErr.Conflicts
+		result.Blocks = overlapErr.Blocks
+	case errors.Is(err, ErrOutsideWorkingHours):
+		result.Error = err.Error()
+	default:
+		return result, err
+	}
+	return result, nil
+}
+
+// CreateSeries creates a recurring series and one appointment per
+// occurrence of its RRule. Every occurrence is checked for overlaps, time off
+// and working hours. If any occurrence cannot be booked, nothing is created
+// and a *SeriesConflictError lists the ones that collide, unless
+// skipConflicts is set, in which case only the free occurrences are booked.
+func CreateSeries(ctx context.Context, db *gorm.DB, series models.AppointmentSeries, allowOutsideHours, skipConflicts bool) (models.AppointmentSeries, []OccurrenceResult, error) {
+	if series.Duration <= 0 {
+		return models.AppointmentSeries{}, nil, ErrInvalidDuration
+	}
+	rule, err := rrule.Parse(series.RRule)
+	if err != nil {
+		return models.AppointmentSeries{}, nil, fmt.Errorf("%w: %s", ErrInvalidRecurrence, err)
+	}
+	series.RRule = rule.String()
+	starts, more := rule.All(series.StartTime.In(clinic.Location), maxSeriesOccurrences)
+	if more {
+		return models.AppointmentSeries{}, nil, fmt.Errorf("%w: a series cannot have more than %d occurrences, use COUNT or UNTIL", ErrInvalidRecurrence, maxSeriesOccurrences)
+	}
+	if len(starts) == 0 {
+		return models.AppointmentSeries{}, nil, fmt.Errorf("%w: the rule has no occurrences", ErrInvalidRecurrence)
+	}
+
+	template := models.Appointment{
+		PatientID:         series.PatientID,
+		AppointmentTypeID: series.AppointmentTypeID,
+		Duration:          series.Duration,
+		Viber:             series.Viber,
+		Whatsapp:          series.Whatsapp,
+		SMS:               series.SMS,
+		EmailNotification: series.EmailNotification,
+		Reminder:          series.Reminder,
+		AllowOutsideHours: allowOutsideHours,
+	}
+	if err := loadReferences(db.WithContext(ctx), &template); err != nil {
+		return models.AppointmentSeries{}, nil, err
+	}
+	if template.AppointmentType.Archived {
+		return models.AppointmentSeries{}, nil, fmt.Errorf("%w: %s", ErrAppointmentTypeArchived, template.AppointmentType.Description)
+	}
+	series.ID = 0
+	series.Patient = template.Patient
+	series.AppointmentType = template.AppointmentType
+
+	var results []OccurrenceResult
+	err = withScheduleLock(ctx, db, func(tx *gorm.DB) error {
+		if err := tx.Omit("Patient", "AppointmentType", "Appointments").Create(&series).Error; err != nil {
+			return err
+		}
+		failed := 0
+		for _, start := range starts {
+			appointment := template
+			appointment.StartTime = start
+			appointment.SeriesID = &series.ID
+			result, err := occurrenceResult(tx, &appointment)
+			if err != nil {
+				return err
+			}
+			if result.Error == "" {
+				tempUUID, _ := uuid.NewV7()
+				appointment.UUID = tempUUID.String()
+				if err := tx.Omit("Patient", "AppointmentType", "Resource", "Practitioner").Create(&appointment).Error; err != nil {
+					return err
+				}
+				result.Appointment = &appointment
+			} else {
+				failed++
+			}
+			results = append(results, result)
+		}
+		if failed == len(starts) || (failed > 0 && !skipConflicts) {
+			return &SeriesConflictError{Occurrences: results}
+		}
+		return nil
+	})
+	if err != nil {
+		return models.AppointmentSeries{}, nil, err
+	}
+	return series, results, nil
+}
+
+// findOccurrence loads a series and one of its appointments.
+func findOccurrence(db *gorm.DB, seriesUUID, appointmentUUID string) (models.AppointmentSeries, models.Appointment, error) {
+	var series models.AppointmentSeries
+	err := db.Where("uuid = ?", seriesUUID).First(&series).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return series, models.Appointment{}, ErrSeriesNotFound
+	}
+	if err != nil {
+		return series, models.Appointment{}, err
+	}
+	var selected models.Appointment
+	err = db.Where("uuid = ? AND series_id = ?", appointmentUUID, series.ID).First(&selected).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return series, selected, fmt.Errorf("%w in this series", ErrAppointmentNotFound)
+	}
+	return series, selected, err
+}
+
+// selectOccurrences returns the appointments of series that scope applies to.
+func selectOccurrences(db *gorm.DB, series models.AppointmentSeries, selected models.Appointment, scope Scope) ([]models.Appointment, error) {
+	if scope == ScopeThis {
+		return []models.Appointment{selected}, nil
+	}
+	query := db.Where("series_id = ? AND status <> ?", series.ID, models.StatusCancelled)
+	if scope == ScopeFollowing {
+		query = query.Where("start_time >= ?", selected.StartTime)
+	} else {
+		query = query.Where("start_time >= ?", time.Now())
+	}
+	var occurrences []models.Appointment
+	err := query.Order("start_time asc").Find(&occurrences).Error
+	return occurrences, err
+}
+
+// shiftTo moves t by the same number of calendar days as from is moved to
+// to, and gives it the wall clock time of to. Moving a Tuesday 10:00
+// occurrence to Wednesday 11:00 moves every occurrence one day later, to
+// 11:00, even across daylight saving changes.
+func shiftTo(t, from, to time.Time) time.Time {
+	to = to.In(from.Location())
+	days := int(time.Date(to.Year(), to.Month(), to.Day(), 0, 0, 0, 0, time.UTC).Sub(time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, time.UTC)).Hours() / 24)
+	t = t.In(from.Location())
+	return time.Date(t.Year(), t.Month(), t.Day()+days, to.Hour(), to.Minute(), to.Second(), 0, from.Location())
+}
+
+func occurrenceIDs(occurrences []models.Appointment) []uint {
+	ids := make([]uint, 0, len(occurrences))
+	for _, occurrence := range occurrences {
+		ids = append(ids, occurrence.ID)
+	}
+	return ids
+}
+
+// EditSeriesOccurrences changes the time, duration or type of the occurrences
+// of a series selected by scope. Each changed occurrence is checked again for
+// overlaps; if any of them collides, nothing is changed and a
+// *SeriesConflictError is returned. As with MoveAppointment, only scheduled
+// or confirmed occurrences are changed, the patient is notified of every
+// new time, and the freed slots are offered to the waitlist. Editing "this and
+// following" splits the series in two at the selected occurrence.
+func EditSeriesOccurrences(ctx context.Context, db *gorm.DB, seriesUUID, appointmentUUID string, scope Scope, edit occurrenceEditRequest) ([]models.Appointment, error) {
+	if edit.Duration < 0 {
+		return nil, ErrInvalidDuration
+	}
+	var changed, previous []models.Appointment
+	err := withScheduleLock(ctx, db, func(tx *gorm.DB) error {
+		series, selected, err := findOccurrence(tx, seriesUUID, appointmentUUID)
+		if err != nil {
+			return err
+		}
+		occurrences, err := selectOccurrences(tx, series, selected, scope)
+		if err != nil {
+			return err
+		}
+		newStart := edit.StartTime
+		if newStart.IsZero() {
+			newStart = selected.StartTime
+		}
+
+		if status := currentStatus(selected); status != models.StatusScheduled && status != models.StatusConfirmed {
+			return fmt.Errorf("%w: the appointment is %s", ErrCannotMove, status)
+		}
+
+		var movable []models.Appointment
+		for _, occurrence := range occurrences {
+			// leave appointments that are already under way, or over, alone:
+			if status := currentStatus(occurrence); status == models.StatusScheduled || status == models.StatusConfirmed {
+				movable = append(movable, occurrence)
+			}
+		}
+
+		excludeIDs := occurrenceIDs(movable)
+		var results []OccurrenceResult
+		failed := 0
+		for _, occurrence := range movable {
+			previous = append(previous, occurrence)
+			occurrence.StartTime = shiftTo(occurrence.StartTime, selected.StartTime, newStart)
+			if edit.Duration > 0 {
+				occurrence.Duration = edit.Duration
+			}
+			if edit.AppointmentTypeID != 0 {
+				occurrence.AppointmentTypeID = edit.AppointmentTypeID
+			}
+			if edit.AllowOutsideHours != nil {
+				occurrence.AllowOutsideHours = *edit.AllowOutsideHours
+			}
+			if err := loadReferences(tx, &occurrence); err != nil {
+				return err
+			}
+			if edit.AppointmentTypeID != 0 && occurrence.AppointmentType.Archived {
+				return fmt.Errorf("%w: %s", ErrAppointmentTypeArchived, occurrence.AppointmentType.Description)
+			}
+			result, err := occurrenceResult(tx, &occurrence, excludeIDs...)
+			if err != nil {
+				return err
+			}
+			if result.Error != "" {
+				failed++
+			} else {
+				result.Appointment = &occurrence
+			}
+			results = append(results, result)
+			changed = append(changed, occurrence)
+		}
+		if failed > 0 {
+			return &SeriesConflictError{Occurrences: results}
+		}
+
+		switch scope {
+		case ScopeFollowing:
+			if err := splitSeries(tx, &series, selected, newStart, edit); err != nil {
+				return err
+			}
+			for i := range changed {
+				changed[i].SeriesID = &series.ID
+			}
+		case ScopeAll:
+			series.StartTime = shiftTo(series.StartTime, selected.StartTime, newStart)
+			if edit.Duration > 0 {
+				series.Duration = edit.Duration
+			}
+			if edit.AppointmentTypeID != 0 {
+				series.AppointmentTypeID = edit.AppointmentTypeID
+			}
+			err = tx.Model(&series).Select("StartTime", "Duration", "AppointmentTypeID").Updates(&series).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		for i, occurrence := range changed {
+			err = tx.Model(&occurrence).Select("StartTime", "Duration", "AppointmentTypeID", "AllowOutsideHours", "SeriesID", "ResourceID", "PractitionerID").Updates(&occurrence).Error
+			if err == nil {
+				err = bumpSequence(tx, occurrence.ID)
+			}
+			if err != nil {
+				return err
+			}
+			if !occurrence.StartTime.Equal(previous[i].StartTime) || occurrence.Duration != previous[i].Duration {
+				err = recordChange(tx, occurrence, previous[i].StartTime, previous[i].Duration, "", fmt.Sprintf("series edit (%s)", scope))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, occurrence := range changed {
+		if !occurrence.StartTime.Equal(previous[i].StartTime) {
+			queueMoveNotification(db.WithContext(ctx), occurrence, previous[i].StartTime)
+		}
+		if !occurrence.StartTime.Equal(previous[i].StartTime) || occurrence.Duration != previous[i].Duration {
+			offerFreedSlot(db.WithContext(ctx), previous[i], occurrence)
+		}
+	}
+	return changed, nil
+}
+
+// splitSeries ends series just before selected, and starts a new series at
+// newStart with the same recurrence rule and the occurrences the old one had
+// left. On return, series is the new series.
+func splitSeries(tx *gorm.DB, series *models.AppointmentSeries, selected models.Appointment, newStart time.Time, edit occurrenceEditRequest) error {
+	rule, err := rrule.Parse(series.RRule)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrInvalidRecurrence, err)
+	}
+	newRule := rule
+	if rule.Count > 0 {
+		// cancelled occurrences still count towards COUNT, so count the
+		// occurrences of the rule rather than the appointments:
+		starts, _ := rule.All(series.StartTime.In(clinic.Location), rule.Count)
+		before := 0
+		for _, start := range starts {
+			if start.Before(selected.StartTime) {
+				before++
+			}
+		}
+		newRule.Count = max(rule.Count-before, 1)
+	}
+	rule.Count = 0
+	rule.Until = selected.StartTime.Add(-time.Second)
+	err = tx.Model(series).Update("RRule", rule.String()).Error
+	if err != nil {
+		return err
+	}
+
+	following := *series
+	following.ID = 0
+	tempUUID, _ := uuid.NewV7()
+	following.UUID = tempUUID.String()
+	following.CreatedAt = time.Now()
+	following.UpdatedAt = time.Now()
+	following.StartTime = newStart
+	following.RRule = newRule.String()
+	if edit.Duration > 0 {
+		following.Duration = edit.Duration
+	}
+	if edit.AppointmentTypeID != 0 {
+		following.AppointmentTypeID = edit.AppointmentTypeID
+	}
+	err = tx.Omit("Patient", "AppointmentType", "Appointments").Create(&following).Error
+	if err != nil {
+		return err
+	}
+	*series = following
+	return nil
+}
+
+// CancelSeriesOccurrences cancels the occurrences of a series selected by
+// scope. Cancelling "this and following" ends the series before the
+// selected occurrence; cancelling "all" removes the series as well.
+func CancelSeriesOccurrences(ctx context.Context, db *gorm.DB, seriesUUID, appointmentUUID string, scope Scope, cancellation Cancellation) ([]models.Appointment, error) {
+	if err := cancellation.validate(); err != nil {
+		return nil, err
+	}
+	var cancelled []models.Appointment
+	err := withScheduleLock(ctx, db, func(tx *gorm.DB) error {
+		series, selected, err := findOccurrence(tx, seriesUUID, appointmentUUID)
+		if err != nil {
+			return err
+		}
+		occurrences, err := selectOccurrences(tx, series, selected, scope)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		for _, occurrence := range occurrences {
+			if scope != ScopeThis && currentStatus(occurrence) != models.StatusScheduled && currentStatus(occurrence) != models.StatusConfirmed {
+				// leave appointments that are already under way, or over, alone
+				continue
+			}
+			if err := applyCancellation(&occurrence, cancellation, now); err != nil {
+				return err
+			}
+			if err := saveCancellation(tx, &occurrence); err != nil {
+				return err
+			}
+			cancelled = append(cancelled, occurrence)
+		}
+		switch scope {
+		case ScopeFollowing:
+			rule, err := rrule.Parse(series.RRule)
+			if err != nil {
+				return fmt.Errorf("%w: %s", ErrInvalidRecurrence, err)
+			}
+			rule.Count = 0
+			rule.Until = selected.StartTime.Add(-time.Second)
+			return tx.Model(&series).Update("RRule", rule.String()).Error
+		case ScopeAll:
+			return tx.Delete(&series).Error
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, occurrence := range cancelled {
+		waitlist.OfferFreedSlotOrLog(db.WithContext(ctx), occurrence)
+	}
+	return cancelled, nil
+}
+
+// NewSeries handles POST /series.
+func (h *HTTPHandler) NewSeries(w http.ResponseWriter, r *http.Request) {
+	var request seriesRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	series := request.AppointmentSeries
+	series.CreatedAt = time.Now()
+	series.UpdatedAt = time.Now()
+	tempUUID, _ := uuid.NewV7()
+	series.UUID = tempUUID.String()
+
+	series, occurrences, err := CreateSeries(h.Ctx, h.DB, series, request.AllowOutsideHours, request.SkipConflicts)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var starts []time.Time
+	for _, occurrence := range occurrences {
+		if occurrence.Appointment != nil {
+			starts = append(starts, occurrence.StartTime)
+		}
+	}
+	queueConfirmation(h.DB.WithContext(h.Ctx), series.Patient, series.AppointmentType, nil, starts)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(seriesResponse{Series: series, Occurrences: occurrences})
+}
+
+// GetSeries handles GET /series/{uuid}.
+func (h *HTTPHandler) GetSeries(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var series models.AppointmentSeries
+	err := h.DB.Preload("Patient").Preload("AppointmentType").
+		Preload("Appointments", func(db *gorm.DB) *gorm.DB { return db.Order("start_time asc") }).
+		Where("uuid = ?", vars["uuid"]).First(&series).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(series)
+}
+
+// UpdateSeriesOccurrences handles
+// PUT /series/{uuid}/occurrences/{appointment}?scope=this|following|all.
+func (h *HTTPHandler) UpdateSeriesOccurrences(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	scope, err := ParseScope(r.URL.Query().Get("scope"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	var edit occurrenceEditRequest
+	err = json.NewDecoder(r.Body).Decode(&edit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	changed, err := EditSeriesOccurrences(h.Ctx, h.DB, vars["uuid"], vars["appointment"], scope, edit)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changed)
+}
+
+// DeleteSeriesOccurrences handles
+// DELETE /series/{uuid}/occurrences/{appointment}?scope=this|following|all.
+// The optional body gives the cancellation details, as for
+// POST /appointments/{uuid}/cancel; without it the reason is "other".
+func (h *HTTPHandler) DeleteSeriesOccurrences(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	scope, err := ParseScope(r.URL.Query().Get("scope"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	cancellation := Cancellation{Reason: models.ReasonOther}
+	if r.ContentLength != 0 {
+		err = json.NewDecoder(r.Body).Decode(&cancellation)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	cancelled, err := CancelSeriesOccurrences(h.Ctx, h.DB, vars["uuid"], vars["appointment"], scope, cancellation)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cancelled)
+}
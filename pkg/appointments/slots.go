@@ -0,0 +1,494 @@
+package appointments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"github.com/ipmess/dentistbackend/pkg/practitioners"
+	"github.com/ipmess/dentistbackend/pkg/resources"
+	"github.com/ipmess/dentistbackend/pkg/timeoff"
+	"github.com/ipmess/dentistbackend/pkg/workinghours"
+	"gorm.io/gorm"
+)
+
+// Defaults for the slot search, used when the request does not specify them.
+const (
+	defaultSlotGranularity = 15 // minutes
+	defaultSlotSearchDays  = 14
+	maxSlotSearchDays      = 366
+)
+
+// SlotQuery describes what kind of free time the dentist is looking for, e.g.
+// "40 minutes, on weekdays, after 16:00".
+type SlotQuery struct {
+	Duration    int            // length of the appointment, in minutes
+	From        time.Time      // first day to search (inclusive)
+	To          time.Time      // last day to search (inclusive)
+	Weekdays    []time.Weekday // days of the week to search; empty means every day
+	After       int            // earliest start, in minutes after midnight
+	Before      int            // latest end, in minutes after midnight
+	Granularity int            // slot starts are aligned to this many minutes
+	// Optional: only search the practitioners and resources (rooms or chairs)
+	// this appointment type can use, or just the given ones.
+	AppointmentTypeID uint
+	PractitionerID    *uint
+	ResourceID        *uint
+	// Buffer time around the appointment, in minutes, which must not overlap
+	// other appointments (or their own buffer time).
+	BufferBefore int
+	BufferAfter  int
+}
+
+// Slot is a free interval long enough for the requested appointment.
+// Practitioners lists the practitioners and Resources the rooms or chairs
+// that are free for the whole slot; they are empty while the clinic has none
+// set up.
+type Slot struct {
+	Start         time.Time
+	End           time.Time
+	Practitioners []models.Practitioner `json:",omitempty"`
+	Resources     []models.Resource     `json:",omitempty"`
+}
+
+// interval is a half-open time range [Start, End).
+type interval struct {
+	Start time.Time
+	End   time.Time
+}
+
+func (i interval) overlaps(other interval) bool {
+	return i.Start.Before(other.End) && other.Start.Before(i.End)
+}
+
+// calendar is the working time of one practitioner, or of the clinic while
+// it has no practitioners, as used by the slot search.
+type calendar struct {
+	practitioner *models.Practitioner
+	schedule     workinghours.Schedule
+	away         []interval // time off
+	booked       []interval // appointments, including their buffer time
+}
+
+// FindAvailableSlots returns every slot matching query in which a suitable
+// practitioner is working, is not on time off and has no other appointment,
+// and in which at least one suitable resource is not taken by another
+// appointment. While the clinic has no practitioners, the clinic's working
+// hours and time off apply. Slots in the past are never returned.
+func FindAvailableSlots(ctx context.Context, db *gorm.DB, query SlotQuery) ([]Slot, error) {
+	if query.Duration <= 0 {
+		return nil, ErrInvalidDuration
+	}
+	if query.Granularity <= 0 {
+		query.Granularity = defaultSlotGranularity
+	}
+	db = db.WithContext(ctx)
+	firstDay := clinic.StartOfDay(query.From)
+	lastDay := clinic.StartOfDay(query.To)
+	rangeEnd := lastDay.AddDate(0, 0, 1)
+
+	existing, err := FindOverlappingAppointments(db, firstDay, rangeEnd)
+	if err != nil {
+		return nil, err
+	}
+	blocks, err := timeoff.Occurrences(db, firstDay, rangeEnd)
+	if err != nil {
+		return nil, err
+	}
+	calendars, err := slotCalendars(db, query, existing, blocks)
+	if err != nil {
+		return nil, err
+	}
+	staffed := calendars[0].practitioner != nil
+	candidates, err := resources.AllowedFor(db, query.AppointmentTypeID)
+	if err != nil {
+		return nil, err
+	}
+	if query.ResourceID != nil {
+		var pinned []models.Resource
+		for _, resource := range candidates {
+			if resource.ID == *query.ResourceID {
+				pinned = append(pinned, resource)
+			}
+		}
+		if len(pinned) == 0 {
+			return nil, fmt.Errorf("%w: resource ID %d", ErrResourceNotAllowed, *query.ResourceID)
+		}
+		candidates = pinned
+	}
+
+	// shared holds the appointments that take up every resource: those
+	// without a resource, or every appointment while the clinic has neither
+	// resources nor practitioners to keep them apart. busyIn holds the
+	// appointments of each resource.
+	var shared []interval
+	busyIn := make(map[uint][]interval)
+	for _, appointment := range existing {
+		var taken interval
+		taken.Start, taken.End = occupied(appointment)
+		switch {
+		case len(candidates) == 0 && staffed:
+		case appointment.ResourceID == nil || len(candidates) == 0:
+			shared = append(shared, taken)
+		default:
+			busyIn[*appointment.ResourceID] = append(busyIn[*appointment.ResourceID], taken)
+		}
+	}
+
+	now := time.Now()
+	duration := time.Duration(query.Duration) * time.Minute
+	slots := []Slot{}
+	for day := firstDay; day.Before(rangeEnd); day = day.AddDate(0, 0, 1) {
+		if !weekdayIncluded(query.Weekdays, day.Weekday()) {
+			continue
+		}
+		window := interval{Start: atMinute(day, query.After), End: atMinute(day, query.Before)}
+		// the slots of the day, by start time, with the practitioners free in each:
+		var daySlots []Slot
+		index := make(map[int64]int)
+		for _, c := range calendars {
+			for _, open := range openIntervals(c.schedule, day) {
+				// only search the part of the opening period inside the requested window:
+				if open.Start.Before(window.Start) {
+					open.Start = window.Start
+				}
+				if open.End.After(window.End) {
+					open.End = window.End
+				}
+				for start := alignUp(open.Start, query.Granularity); !start.Add(duration).After(open.End); start = start.Add(time.Duration(query.Granularity) * time.Minute) {
+					if start.Before(now) {
+						continue
+					}
+					candidate := interval{Start: start, End: start.Add(duration)}
+					if overlapsAny(candidate, c.away) || overlapsAny(buffered(candidate, query), c.booked) || overlapsAny(buffered(candidate, query), shared) {
+						continue
+					}
+					i, ok := index[start.Unix()]
+					if !ok {
+						i = len(daySlots)
+						index[start.Unix()] = i
+						daySlots = append(daySlots, Slot{Start: candidate.Start, End: candidate.End})
+					}
+					if c.practitioner != nil {
+						daySlots[i].Practitioners = append(daySlots[i].Practitioners, *c.practitioner)
+					}
+				}
+			}
+		}
+		sort.Slice(daySlots, func(i, j int) bool { return daySlots[i].Start.Before(daySlots[j].Start) })
+
+		for _, slot := range daySlots {
+			candidate := buffered(interval{Start: slot.Start, End: slot.End}, query)
+			for _, resource := range candidates {
+				if !overlapsAny(candidate, busyIn[resource.ID]) {
+					slot.Resources = append(slot.Resources, resource)
+				}
+			}
+			if len(candidates) == 0 || len(slot.Resources) > 0 {
+				slots = append(slots, slot)
+			}
+		}
+	}
+	return slots, nil
+}
+
+// slotCalendars returns the calendars of the practitioners who may perform
+// the appointment type of query (or just the practitioner it asks for), with
+// the time they are busy. While the clinic has no practitioners, it returns
+// a single calendar for the clinic, which is only busy during time off.
+func slotCalendars(db *gorm.DB, query SlotQuery, existing []models.Appointment, blocks []timeoff.Block) ([]calendar, error) {
+	candidates, err := practitioners.AllowedFor(db, query.AppointmentTypeID)
+	if err != nil {
+		return nil, err
+	}
+	if query.PractitionerID != nil {
+		var pinned []models.Practitioner
+		for _, practitioner := range candidates {
+			if practitioner.ID == *query.PractitionerID {
+				pinned = append(pinned, practitioner)
+			}
+		}
+		if len(pinned) == 0 {
+			return nil, fmt.Errorf("%w: practitioner ID %d", ErrPractitionerNotAllowed, *query.PractitionerID)
+		}
+		candidates = pinned
+	}
+	if len(candidates) == 0 {
+		active, err := practitioners.Active(db)
+		if err != nil {
+			return nil, err
+		}
+		if len(active) > 0 {
+			return nil, fmt.Errorf("%w: appointment type ID %d", ErrPractitionerNotAllowed, query.AppointmentTypeID)
+		}
+		schedule, err := workinghours.Load(db)
+		if err != nil {
+			return nil, err
+		}
+		clinic := calendar{schedule: schedule}
+		for _, block := range blocks {
+			if block.PractitionerID == nil {
+				clinic.away = append(clinic.away, interval{Start: block.Start, End: block.End})
+			}
+		}
+		return []calendar{clinic}, nil
+	}
+
+	var calendars []calendar
+	for i := range candidates {
+		practitioner := candidates[i]
+		schedule, err := workinghours.LoadFor(db, practitioner.ID)
+		if err != nil {
+			return nil, err
+		}
+		c := calendar{practitioner: &practitioner, schedule: schedule}
+		for _, block := range blocks {
+			if block.PractitionerID == nil || *block.PractitionerID == practitioner.ID {
+				c.away = append(c.away, interval{Start: block.Start, End: block.End})
+			}
+		}
+		for _, appointment := range existing {
+			if appointment.PractitionerID == nil || *appointment.PractitionerID == practitioner.ID {
+				var taken interval
+				taken.Start, taken.End = occupied(appointment)
+				c.booked = append(c.booked, taken)
+			}
+		}
+		calendars = append(calendars, c)
+	}
+	return calendars, nil
+}
+
+// buffered extends candidate by the buffer time of query.
+func buffered(candidate interval, query SlotQuery) interval {
+	return interval{
+		Start: candidate.Start.Add(-time.Duration(query.BufferBefore) * time.Minute),
+		End:   candidate.End.Add(time.Duration(query.BufferAfter) * time.Minute),
+	}
+}
+
+func overlapsAny(candidate interval, busy []interval) bool {
+	for _, b := range busy {
+		if candidate.overlaps(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func weekdayIncluded(weekdays []time.Weekday, weekday time.Weekday) bool {
+	if len(weekdays) == 0 {
+		return true
+	}
+	for _, w := range weekdays {
+		if w == weekday {
+			return true
+		}
+	}
+	return false
+}
+
+// atMinute returns the time that is minute minutes after the start of day.
+func atMinute(day time.Time, minute int) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), minute/60, minute%60, 0, 0, day.Location())
+}
+
+// alignUp rounds t up so that its minutes after midnight are a multiple of
+// granularity.
+func alignUp(t time.Time, granularity int) time.Time {
+	minute := t.Hour()*60 + t.Minute()
+	if t.Second() != 0 || t.Nanosecond() != 0 {
+		minute++
+	}
+	if remainder := minute % granularity; remainder != 0 {
+		minute += granularity - remainder
+	}
+	return atMinute(t, minute)
+}
+
+// openIntervals returns the opening periods on day.
+func openIntervals(schedule workinghours.Schedule, day time.Time) []interval {
+	var open []interval
+	for _, period := range schedule.Periods(day) {
+		open = append(open, interval{Start: period.Start, End: period.End})
+	}
+	return open
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "sunday": time.Sunday,
+	"mon": time.Monday, "monday": time.Monday,
+	"tue": time.Tuesday, "tuesday": time.Tuesday,
+	"wed": time.Wednesday, "wednesday": time.Wednesday,
+	"thu": time.Thursday, "thursday": time.Thursday,
+	"fri": time.Friday, "friday": time.Friday,
+	"sat": time.Saturday, "saturday": time.Saturday,
+}
+
+// parseWeekdays parses a comma separated list of weekdays, e.g. "mon,thu".
+// "weekdays" and "weekend" are accepted as shorthands.
+func parseWeekdays(value string) ([]time.Weekday, error) {
+	var weekdays []time.Weekday
+	for _, name := range strings.Split(value, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "":
+			continue
+		case "weekdays":
+			weekdays = append(weekdays, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday)
+		case "weekend":
+			weekdays = append(weekdays, time.Saturday, time.Sunday)
+		default:
+			weekday, ok := weekdayNames[name]
+			if !ok {
+				return nil, fmt.Errorf("invalid weekday %q", name)
+			}
+			weekdays = append(weekdays, weekday)
+		}
+	}
+	return weekdays, nil
+}
+
+// parseSlotQuery builds a SlotQuery from the query string of a GET /slots
+// request. The duration comes either from "duration" (minutes) or from the
+// DefaultDuration of the appointment type given in "type". "type" also limits
+// the search to the practitioners and resources the appointment type can use;
+// "practitioner" and "resource" limit it to a single one.
+func parseSlotQuery(db *gorm.DB, values map[string][]string, location *time.Location) (SlotQuery, error) {
+	get := func(key string) string {
+		if v := values[key]; len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+	var err error
+	query := SlotQuery{
+		After:       0,
+		Before:      24 * 60,
+		Granularity: defaultSlotGranularity,
+	}
+
+	if value := get("type"); value != "" {
+		typeID, err := strconv.ParseUint(value, 10, 0)
+		if err != nil {
+			return query, fmt.Errorf("invalid type %q", value)
+		}
+		var appointmentType models.AppointmentType
+		err = db.First(&appointmentType, uint(typeID)).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return query, fmt.Errorf("%w: appointment type ID %d", ErrAppointmentTypeNotFound, typeID)
+		}
+		if err != nil {
+			return query, err
+		}
+		query.Duration = appointmentType.DefaultDuration
+		query.AppointmentTypeID = appointmentType.ID
+		query.BufferBefore = appointmentType.BufferBefore
+		query.BufferAfter = appointmentType.BufferAfter
+	}
+	if duration := get("duration"); duration != "" {
+		query.Duration, err = strconv.Atoi(duration)
+		if err != nil {
+			return query, fmt.Errorf("invalid duration %q", duration)
+		}
+	} else if query.AppointmentTypeID == 0 {
+		return query, errors.New("either duration or type is required")
+	}
+	if resource := get("resource"); resource != "" {
+		resourceID, err := strconv.ParseUint(resource, 10, 0)
+		if err != nil {
+			return query, fmt.Errorf("invalid resource %q", resource)
+		}
+		id := uint(resourceID)
+		query.ResourceID = &id
+	}
+	if practitioner := get("practitioner"); practitioner != "" {
+		practitionerID, err := strconv.ParseUint(practitioner, 10, 0)
+		if err != nil {
+			return query, fmt.Errorf("invalid practitioner %q", practitioner)
+		}
+		id := uint(practitionerID)
+		query.PractitionerID = &id
+	}
+
+	today := time.Now().In(location)
+	query.From = time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, location)
+	if from := get("from"); from != "" {
+		query.From, err = time.ParseInLocation("2006-01-02", from, location)
+		if err != nil {
+			return query, fmt.Errorf("invalid from date %q, expected YYYY-MM-DD", from)
+		}
+	}
+	query.To = query.From.AddDate(0, 0, defaultSlotSearchDays-1)
+	if to := get("to"); to != "" {
+		query.To, err = time.ParseInLocation("2006-01-02", to, location)
+		if err != nil {
+			return query, fmt.Errorf("invalid to date %q, expected YYYY-MM-DD", to)
+		}
+	}
+	if query.To.Before(query.From) {
+		return query, errors.New("to date is before from date")
+	}
+	if query.To.Sub(query.From) > maxSlotSearchDays*24*time.Hour {
+		return query, fmt.Errorf("cannot search more than %d days at once", maxSlotSearchDays)
+	}
+
+	if weekdays := get("weekdays"); weekdays != "" {
+		query.Weekdays, err = parseWeekdays(weekdays)
+		if err != nil {
+			return query, err
+		}
+	}
+	if after := get("after"); after != "" {
+		query.After, err = workinghours.ParseTimeOfDay(after)
+		if err != nil {
+			return query, err
+		}
+	}
+	if before := get("before"); before != "" {
+		query.Before, err = workinghours.ParseTimeOfDay(before)
+		if err != nil {
+			return query, err
+		}
+	}
+	if query.Before <= query.After {
+		return query, errors.New("before must be later than after")
+	}
+	if granularity := get("granularity"); granularity != "" {
+		query.Granularity, err = strconv.Atoi(granularity)
+		if err != nil || query.Granularity <= 0 {
+			return query, fmt.Errorf("invalid granularity %q", granularity)
+		}
+	}
+	return query, nil
+}
+
+// FindSlots handles GET /slots. For example
+// /slots?duration=40&weekdays=weekdays&after=16:00 lists every free 40 minute
+// slot after 16:00 on weekdays, for the next two weeks.
+func (h *HTTPHandler) FindSlots(w http.ResponseWriter, r *http.Request) {
+	query, err := parseSlotQuery(h.DB, r.URL.Query(), clinic.Location)
+	if errors.Is(err, ErrAppointmentTypeNotFound) {
+		writeError(w, err)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slots, err := FindAvailableSlots(h.Ctx, h.DB, query)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(slots)
+}
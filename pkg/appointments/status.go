@@ -0,0 +1,163 @@
+package appointments
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipmess/dentistbackend/pkg/charges"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// transitions lists the statuses each status can move to.
+var transitions = map[models.AppointmentStatus][]models.AppointmentStatus{
+	models.StatusScheduled: {models.StatusConfirmed, models.StatusCancelled, models.StatusNoShow},
+	models.StatusConfirmed: {models.StatusCheckedIn, models.StatusCancelled, models.StatusNoShow},
+	models.StatusCheckedIn: {models.StatusInChair},
+	models.StatusInChair:   {models.StatusCompleted},
+}
+
+// TransitionError is returned when an appointment cannot move from its
+// current status to the requested one.
+// errors.Is(err, ErrIllegalTransition) reports true for it.
+type TransitionError struct {
+	From models.AppointmentStatus
+	To   models.AppointmentStatus
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("cannot change an appointment from %s to %s", e.From, e.To)
+}
+
+func (e *TransitionError) Unwrap() error {
+	return ErrIllegalTransition
+}
+
+// currentStatus returns the status of appointment, treating rows created
+// before statuses existed as scheduled.
+func currentStatus(appointment models.Appointment) models.AppointmentStatus {
+	if appointment.Status == "" {
+		return models.StatusScheduled
+	}
+	return appointment.Status
+}
+
+// applyTransition moves appointment to status to, recording when it
+// happened, or returns a *TransitionError if that is not allowed.
+func applyTransition(appointment *models.Appointment, to models.AppointmentStatus, now time.Time) error {
+	from := currentStatus(*appointment)
+	allowed := false
+	for _, next := range transitions[from] {
+		if next == to {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return &TransitionError{From: from, To: to}
+	}
+	appointment.Status = to
+	switch to {
+	case models.StatusConfirmed:
+		appointment.ConfirmedAt = &now
+	case models.StatusCheckedIn:
+		appointment.CheckedInAt = &now
+	case models.StatusInChair:
+		appointment.InChairAt = &now
+	case models.StatusCompleted:
+		appointment.CompletedAt = &now
+	case models.StatusCancelled:
+		appointment.CancelledAt = &now
+	case models.StatusNoShow:
+		appointment.NoShowAt = &now
+	}
+	return nil
+}
+
+// saveStatus writes the status fields of appointment to the database.
+func saveStatus(tx *gorm.DB, appointment *models.Appointment) error {
+	err := tx.Model(appointment).
+		Select("Status", "ConfirmedAt", "CheckedInAt", "InChairAt", "CompletedAt", "CancelledAt", "NoShowAt").
+		Updates(appointment).Error
+	if err != nil {
+		return err
+	}
+	return bumpSequence(tx, appointment.ID)
+}
+
+// TransitionAppointment moves the appointment with the given UUID to status
+// to. Illegal transitions are rejected with a *TransitionError. Use
+// CancelAppointment to cancel, so the reason is recorded. Completing an
+// appointment pre-fills its charge from the appointment type's fee.
+func TransitionAppointment(ctx context.Context, db *gorm.DB, appointmentUUID string, to models.AppointmentStatus) (models.Appointment, error) {
+	var appointment models.Appointment
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).Where("uuid = ?", appointmentUUID).First(&appointment).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrAppointmentNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if err := applyTransition(&appointment, to, time.Now()); err != nil {
+			return err
+		}
+		if err := saveStatus(tx, &appointment); err != nil {
+			return err
+		}
+		if to == models.StatusCompleted {
+			// the fee of the appointment type is what the patient usually pays:
+			_, err = charges.Prefill(tx, appointment)
+		}
+		return err
+	})
+	if err != nil {
+		return models.Appointment{}, err
+	}
+	return appointment, nil
+}
+
+// transitionHandler returns an HTTP handler that moves the appointment in
+// the URL to status to.
+func (h *HTTPHandler) transitionHandler(to models.AppointmentStatus) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		appointment, err := TransitionAppointment(h.Ctx, h.DB, vars["uuid"], to)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(appointment)
+	}
+}
+
+// ConfirmAppointment handles POST /appointments/{uuid}/confirm.
+func (h *HTTPHandler) ConfirmAppointment(w http.ResponseWriter, r *http.Request) {
+	h.transitionHandler(models.StatusConfirmed)(w, r)
+}
+
+// CheckInAppointment handles POST /appointments/{uuid}/check-in.
+func (h *HTTPHandler) CheckInAppointment(w http.ResponseWriter, r *http.Request) {
+	h.transitionHandler(models.StatusCheckedIn)(w, r)
+}
+
+// SeatAppointment handles POST /appointments/{uuid}/in-chair.
+func (h *HTTPHandler) SeatAppointment(w http.ResponseWriter, r *http.Request) {
+	h.transitionHandler(models.StatusInChair)(w, r)
+}
+
+// CompleteAppointment handles POST /appointments/{uuid}/complete.
+func (h *HTTPHandler) CompleteAppointment(w http.ResponseWriter, r *http.Request) {
+	h.transitionHandler(models.StatusCompleted)(w, r)
+}
+
+// NoShowAppointment handles POST /appointments/{uuid}/no-show.
+func (h *HTTPHandler) NoShowAppointment(w http.ResponseWriter, r *http.Request) {
+	h.transitionHandler(models.StatusNoShow)(w, r)
+}
@@ -0,0 +1,333 @@
+package appointmenttypes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/ipmess/dentistbackend/pkg/appointments"
+	"github.com/ipmess/dentistbackend/pkg/charges"
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/gorm"
+)
+
+type HTTPHandler struct {
+	DB  *gorm.DB
+	Ctx context.Context
+}
+
+// typeWithWarnings is an appointment type together with the future
+// appointments that a change to it affects, so that they can be moved.
+type typeWithWarnings struct {
+	models.AppointmentType
+	Affected []models.Appointment
+}
+
+var colorPattern = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
+// validate checks an appointment type sent by the front end and tidies up
+// its description, colour and keywords.
+func validate(appointmentType *models.AppointmentType) error {
+	appointmentType.Description = strings.TrimSpace(appointmentType.Description)
+	if appointmentType.Description == "" {
+		return errors.New("Description is required")
+	}
+	if appointmentType.DefaultDuration <= 0 {
+		return errors.New("DefaultDuration must be a positive number of minutes")
+	}
+	if appointmentType.BufferBefore < 0 || appointmentType.BufferAfter < 0 {
+		return errors.New("BufferBefore and BufferAfter cannot be negative")
+	}
+	if !colorPattern.MatchString(appointmentType.Color) {
+		return fmt.Errorf("Color must be a hex colour such as #FFA07A, not %q", appointmentType.Color)
+	}
+	appointmentType.Color = strings.ToUpper(appointmentType.Color)
+	if appointmentType.DefaultFee < 0 {
+		return errors.New("DefaultFee cannot be negative")
+	}
+	if appointmentType.VATCategory == "" {
+		appointmentType.VATCategory = models.VATExempt
+	}
+	if !charges.ValidCategory(appointmentType.VATCategory) {
+		return fmt.Errorf("VATCategory must be exempt, zero, super-reduced, reduced or standard, not %q", appointmentType.VATCategory)
+	}
+	appointmentType.InstructionsEL = strings.TrimSpace(appointmentType.InstructionsEL)
+	appointmentType.InstructionsEN = strings.TrimSpace(appointmentType.InstructionsEN)
+	var keywords []string
+	for _, keyword := range strings.Split(appointmentType.Keywords, ",") {
+		if keyword = strings.TrimSpace(keyword); keyword != "" {
+			keywords = append(keywords, keyword)
+		}
+	}
+	appointmentType.Keywords = strings.Join(keywords, ",")
+	return nil
+}
+
+// descriptionTaken reports whether another appointment type, archived or
+// not, has the description.
+func descriptionTaken(db *gorm.DB, description string, id uint) (bool, error) {
+	var count int64
+	err := db.Model(&models.AppointmentType{}).Where("description = ? AND id <> ?", description, id).Count(&count).Error
+	return count > 0, err
+}
+
+// findAppointmentType looks up the appointment type in the {id} URL variable.
+func (h *HTTPHandler) findAppointmentType(w http.ResponseWriter, r *http.Request) (models.AppointmentType, bool) {
+	var appointmentType models.AppointmentType
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid appointment type ID", http.StatusBadRequest)
+		return appointmentType, false
+	}
+	err = h.DB.First(&appointmentType, id).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return appointmentType, false
+	}
+	return appointmentType, true
+}
+
+// NewAppointmentType handles POST /appointment-types, e.g.
+// {"Description": "Whitening", "DefaultDuration": 60, "Color": "#F0E68C", "Keywords": "whitening,λευκανση"}
+func (h *HTTPHandler) NewAppointmentType(w http.ResponseWriter, r *http.Request) {
+	var appointmentType models.AppointmentType
+	err := json.NewDecoder(r.Body).Decode(&appointmentType)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validate(&appointmentType); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	taken, err := descriptionTaken(h.DB, appointmentType.Description, 0)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "there already is an appointment type with this description", http.StatusConflict)
+		return
+	}
+	appointmentType.ID = 0
+	appointmentType.Archived = false
+	err = h.DB.Omit("Appointments", "Resources").Create(&appointmentType).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(appointmentType)
+}
+
+// ListAppointmentTypes handles GET /appointment-types, which lists the types
+// that can be booked, by description. ?archived=true lists the archived
+// ones too.
+func (h *HTTPHandler) ListAppointmentTypes(w http.ResponseWriter, r *http.Request) {
+	query := h.DB.Order("description asc")
+	if r.URL.Query().Get("archived") != "true" {
+		query = query.Where("archived = ?", false)
+	}
+	var list []models.AppointmentType
+	err := query.Find(&list).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// GetAppointmentType handles GET /appointment-types/{id}.
+func (h *HTTPHandler) GetAppointmentType(w http.ResponseWriter, r *http.Request) {
+	appointmentType, ok := h.findAppointmentType(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(appointmentType)
+}
+
+// futureAppointments returns the appointments of the type that have not
+// started yet, leaving out the cancelled ones.
+func futureAppointments(db *gorm.DB, appointmentTypeID uint) ([]models.Appointment, error) {
+	list := []models.Appointment{}
+	err := db.Preload("Patient").Preload("AppointmentType").
+		Where("appointment_type_id = ? AND start_time >= ?", appointmentTypeID, clinic.Now()).
+		Where("status <> ?", models.StatusCancelled).
+		Order("start_time asc").
+		Find(&list).Error
+	return list, err
+}
+
+// overlappingAppointments returns the future appointments of the type that
+// overlap another appointment with its current buffer time, or whose
+// practitioner or resource may no longer take it.
+func overlappingAppointments(ctx context.Context, db *gorm.DB, appointmentTypeID uint) ([]models.Appointment, error) {
+	future, err := futureAppointments(db, appointmentTypeID)
+	if err != nil {
+		return nil, err
+	}
+	overlapping := []models.Appointment{}
+	for _, appointment := range future {
+		proposed := appointment
+		conflicts, err := appointments.CheckConflicts(ctx, db, &proposed, appointment.ID)
+		if errors.Is(err, appointments.ErrPractitionerNotAllowed) || errors.Is(err, appointments.ErrResourceNotAllowed) {
+			overlapping = append(overlapping, appointment)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, conflict := range conflicts {
+			if conflict.Kind == appointments.ConflictAppointment {
+				overlapping = append(overlapping, appointment)
+				break
+			}
+		}
+	}
+	return overlapping, nil
+}
+
+// UpdateAppointmentType handles PUT /appointment-types/{id}, which replaces
+// every field of the type except Archived: fields left out of the body are
+// cleared. Appointments keep their own durations when the DefaultDuration
+// changes. If the buffer time grows, the response lists the future
+// appointments of the type that now overlap another one in Affected.
+func (h *HTTPHandler) UpdateAppointmentType(w http.ResponseWriter, r *http.Request) {
+	var changes models.AppointmentType
+	err := json.NewDecoder(r.Body).Decode(&changes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validate(&changes); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	appointmentType, ok := h.findAppointmentType(w, r)
+	if !ok {
+		return
+	}
+	taken, err := descriptionTaken(h.DB, changes.Description, appointmentType.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if taken {
+		http.Error(w, "there already is an appointment type with this description", http.StatusConflict)
+		return
+	}
+	buffersGrew := changes.BufferBefore > appointmentType.BufferBefore || changes.BufferAfter > appointmentType.BufferAfter
+	response := typeWithWarnings{Affected: []models.Appointment{}}
+	// the affected appointments are found before committing, so that an
+	// error leaves the type unchanged:
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&appointmentType).
+			Select("Description", "DefaultDuration", "BufferBefore", "BufferAfter", "Color", "Keywords",
+				"DefaultFee", "VATCategory", "InstructionsEL", "InstructionsEN").
+			Updates(&changes).Error
+		if err != nil || !buffersGrew {
+			return err
+		}
+		response.Affected, err = overlappingAppointments(h.Ctx, tx, appointmentType.ID)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.AppointmentType = appointmentType
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// ArchiveAppointmentType handles POST /appointment-types/{id}/archive, which
+// retires the type: it is kept for the appointments that have it, but no
+// longer booked. The response lists the future appointments of the type in
+// Affected.
+func (h *HTTPHandler) ArchiveAppointmentType(w http.ResponseWriter, r *http.Request) {
+	h.setArchived(w, r, true)
+}
+
+// UnarchiveAppointmentType handles POST /appointment-types/{id}/unarchive,
+// which makes the type bookable again.
+func (h *HTTPHandler) UnarchiveAppointmentType(w http.ResponseWriter, r *http.Request) {
+	h.setArchived(w, r, false)
+}
+
+func (h *HTTPHandler) setArchived(w http.ResponseWriter, r *http.Request, archived bool) {
+	appointmentType, ok := h.findAppointmentType(w, r)
+	if !ok {
+		return
+	}
+	response := typeWithWarnings{Affected: []models.Appointment{}}
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&appointmentType).Update("archived", archived).Error
+		if err != nil || !archived {
+			return err
+		}
+		response.Affected, err = futureAppointments(tx, appointmentType.ID)
+		return err
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.AppointmentType = appointmentType
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// DeleteAppointmentType handles DELETE /appointment-types/{id}. A type that
+// appointments, series or waitlist entries refer to is archived instead, and
+// returned; otherwise it is deleted.
+func (h *HTTPHandler) DeleteAppointmentType(w http.ResponseWriter, r *http.Request) {
+	appointmentType, ok := h.findAppointmentType(w, r)
+	if !ok {
+		return
+	}
+	var used int64
+	for _, model := range []any{&models.Appointment{}, &models.AppointmentSeries{}, &models.WaitlistEntry{}} {
+		var count int64
+		err := h.DB.Model(model).Unscoped().Where("appointment_type_id = ?", appointmentType.ID).Count(&count).Error
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		used += count
+	}
+	if used > 0 {
+		err := h.DB.Model(&appointmentType).Update("archived", true).Error
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(appointmentType)
+		return
+	}
+	err := h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM appointment_type_resources WHERE appointment_type_id = ?", appointmentType.ID).Error; err != nil {
+			return err
+		}
+		if err := tx.Exec("DELETE FROM practitioner_appointment_types WHERE appointment_type_id = ?", appointmentType.ID).Error; err != nil {
+			return err
+		}
+		// deleted for good, so the description can be used again:
+		return tx.Unscoped().Delete(&appointmentType).Error
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
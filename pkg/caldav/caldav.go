@@ -0,0 +1,293 @@
+// Package caldav serves the appointments as a CalDAV (RFC 4791) calendar, so
+// that native calendar apps such as Apple Calendar can show them and move
+// them around. Appointments cannot be created from the calendar app; moves
+// go through the same checks as POST /appointments/{uuid}/move, and deleting
+// an event cancels the appointment.
+package caldav
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/appointments"
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/ical"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/gorm"
+)
+
+type HTTPHandler struct {
+	DB  *gorm.DB
+	Ctx context.Context
+}
+
+// Username and Password are the credentials calendar apps sign in with.
+// CalDAV is switched off while Password is empty.
+var (
+	Username = "dentist"
+	Password = ""
+)
+
+// The URLs of the CalDAV tree: the root doubles as the principal of the only
+// user, whose calendar home holds the one calendar of appointments.
+const (
+	rootPath     = "/dav/"
+	homePath     = "/dav/calendars/"
+	calendarPath = "/dav/calendars/appointments/"
+)
+
+// historyDays is how far back the calendar goes. Later appointments are all
+// included.
+const historyDays = 90
+
+// XML namespaces
+const (
+	nsDAV    = "DAV:"
+	nsCalDAV = "urn:ietf:params:xml:ns:caldav"
+	nsCS     = "http://calendarserver.org/ns/"
+	nsApple  = "http://apple.com/ns/ical/"
+	nsClinic = "urn:dentistbackend"
+)
+
+var prefixes = map[string]string{nsDAV: "D", nsCalDAV: "C", nsCS: "CS", nsApple: "A", nsClinic: "X"}
+
+// ServeDAV handles every request under /dav/.
+func (h *HTTPHandler) ServeDAV(w http.ResponseWriter, r *http.Request) {
+	if Password == "" {
+		http.Error(w, "CalDAV is not configured", http.StatusNotFound)
+		return
+	}
+	username, password, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(username), []byte(Username)) != 1 ||
+		subtle.ConstantTimeCompare([]byte(password), []byte(Password)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="dentistbackend"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	w.Header().Set("DAV", "1, 3, calendar-access")
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("Allow", "OPTIONS, GET, HEAD, PUT, DELETE, PROPFIND, REPORT")
+		w.WriteHeader(http.StatusOK)
+	case "PROPFIND":
+		h.propfind(w, r)
+	case "REPORT":
+		h.report(w, r)
+	case "GET", "HEAD":
+		h.get(w, r)
+	case "PUT":
+		h.put(w, r)
+	case "DELETE":
+		h.delete(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// WellKnown handles /.well-known/caldav (RFC 6764), which points calendar
+// apps to the CalDAV root.
+func (h *HTTPHandler) WellKnown(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, rootPath, http.StatusMovedPermanently)
+}
+
+// eventUUID returns the appointment UUID in the URL of an event, e.g.
+// /dav/calendars/appointments/0192f0c4-....ics.
+func eventUUID(path string) (string, bool) {
+	if !strings.HasPrefix(path, calendarPath) || !strings.HasSuffix(path, ".ics") {
+		return "", false
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(path, calendarPath), ".ics")
+	return name, name != "" && !strings.Contains(name, "/")
+}
+
+func eventPath(appointment models.Appointment) string {
+	return calendarPath + appointment.UUID + ".ics"
+}
+
+// etag changes whenever the appointment does.
+func etag(appointment models.Appointment) string {
+	return fmt.Sprintf(`"%d-%d"`, appointment.Sequence, appointment.UpdatedAt.UnixNano())
+}
+
+// calendarData renders appointment as a calendar object resource.
+func calendarData(appointment models.Appointment) string {
+	var buffer bytes.Buffer
+	ical.Write(&buffer, ical.Calendar{}, []ical.Event{ical.EventFor(appointment)})
+	return buffer.String()
+}
+
+// query selects the appointments in the calendar: the ones that are not
+// cancelled, from historyDays ago on.
+func (h *HTTPHandler) query() *gorm.DB {
+	return h.DB.Preload("Patient").Preload("AppointmentType").Preload("Resource").Preload("Practitioner").
+		Where("start_time >= ?", clinic.StartOfDay(time.Now()).AddDate(0, 0, -historyDays)).
+		Where("status <> ?", models.StatusCancelled)
+}
+
+// find loads the appointment of an event URL. It also finds cancelled ones,
+// which are no longer in the calendar.
+func (h *HTTPHandler) find(path string) (models.Appointment, error) {
+	var appointment models.Appointment
+	appointmentUUID, ok := eventUUID(path)
+	if !ok {
+		return appointment, gorm.ErrRecordNotFound
+	}
+	err := h.DB.Preload("Patient").Preload("AppointmentType").Preload("Resource").Preload("Practitioner").
+		Where("uuid = ?", appointmentUUID).First(&appointment).Error
+	return appointment, err
+}
+
+// ctag changes whenever an appointment in the calendar changes, is added or
+// is cancelled.
+func (h *HTTPHandler) ctag() (string, error) {
+	// every change increases the Sequence of an appointment, so their sum
+	// only ever goes up:
+	var result struct {
+		Count     int64
+		Sequences int64
+	}
+	err := h.DB.Model(&models.Appointment{}).Unscoped().
+		Select("COUNT(*) AS count, COALESCE(SUM(sequence), 0) AS sequences").
+		Scan(&result).Error
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d-%d", result.Count, result.Sequences), nil
+}
+
+// get handles GET and HEAD of an event.
+func (h *HTTPHandler) get(w http.ResponseWriter, r *http.Request) {
+	appointment, err := h.find(r.URL.Path)
+	if err != nil || appointment.Status == models.StatusCancelled {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("ETag", etag(appointment))
+	if r.Method == "GET" {
+		w.Write([]byte(calendarData(appointment)))
+	}
+}
+
+// put handles PUT of an event, which moves the appointment to the event's
+// new time. Other changes to the event are ignored: the calendar app cannot
+// rename appointments or change their patients.
+func (h *HTTPHandler) put(w http.ResponseWriter, r *http.Request) {
+	appointment, err := h.find(r.URL.Path)
+	if errors.Is(err, gorm.ErrRecordNotFound) || appointment.Status == models.StatusCancelled {
+		writeDAVError(w, http.StatusForbidden, nsClinic, "creation-not-supported",
+			"appointments cannot be booked from the calendar app")
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != etag(appointment) {
+		http.Error(w, "the appointment has changed", http.StatusPreconditionFailed)
+		return
+	}
+
+	events, err := ical.Parse(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil || len(events) != 1 {
+		writeDAVError(w, http.StatusBadRequest, nsCalDAV, "valid-calendar-data", "expected a calendar with one event")
+		return
+	}
+	event := events[0]
+	if event.UID != ical.UID(appointment) {
+		writeDAVError(w, http.StatusConflict, nsCalDAV, "no-uid-conflict", "the UID of the event cannot change")
+		return
+	}
+	if event.Start.IsZero() || event.AllDay || !event.End.After(event.Start) {
+		writeDAVError(w, http.StatusForbidden, nsCalDAV, "valid-calendar-object-resource", "the event needs a start and an end time")
+		return
+	}
+
+	duration := int(event.End.Sub(event.Start).Minutes())
+	if !event.Start.Equal(appointment.StartTime) || duration != appointment.Duration {
+		appointment, err = appointments.MoveAppointment(h.Ctx, h.DB, appointment.UUID, appointments.Move{
+			StartTime: event.Start,
+			Duration:  duration,
+			ChangedBy: "calendar app",
+			Reason:    "moved in the calendar app",
+		})
+		if err != nil {
+			writeMoveError(w, err)
+			return
+		}
+		// reload, for the new revision:
+		appointment, err = h.find(eventPath(appointment))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("ETag", etag(appointment))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeMoveError rejects a move that MoveAppointment refused.
+func writeMoveError(w http.ResponseWriter, err error) {
+	var overlapErr *appointments.OverlapError
+	switch {
+	case errors.As(err, &overlapErr), errors.Is(err, appointments.ErrOutsideWorkingHours):
+		writeDAVError(w, http.StatusConflict, nsClinic, "schedule-conflict", err.Error())
+	case errors.Is(err, appointments.ErrCannotMove):
+		writeDAVError(w, http.StatusForbidden, nsClinic, "cannot-move", err.Error())
+	case errors.Is(err, appointments.ErrInvalidDuration), errors.Is(err, appointments.ErrPractitionerNotAllowed), errors.Is(err, appointments.ErrResourceNotAllowed):
+		writeDAVError(w, http.StatusForbidden, nsCalDAV, "valid-calendar-object-resource", err.Error())
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// delete handles DELETE of an event, which cancels the appointment.
+func (h *HTTPHandler) delete(w http.ResponseWriter, r *http.Request) {
+	appointment, err := h.find(r.URL.Path)
+	if err != nil || appointment.Status == models.StatusCancelled {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if match := r.Header.Get("If-Match"); match != "" && match != "*" && match != etag(appointment) {
+		http.Error(w, "the appointment has changed", http.StatusPreconditionFailed)
+		return
+	}
+	_, err = appointments.CancelAppointment(h.Ctx, h.DB, appointment.UUID, appointments.Cancellation{
+		Reason:      models.ReasonOther,
+		CancelledBy: "calendar app",
+	})
+	if errors.Is(err, appointments.ErrIllegalTransition) {
+		writeDAVError(w, http.StatusForbidden, nsClinic, "cannot-cancel", err.Error())
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeDAVError writes a DAV:error body (RFC 4918, section 16) naming the
+// precondition that failed.
+func writeDAVError(w http.ResponseWriter, status int, namespace, condition, message string) {
+	var body strings.Builder
+	body.WriteString(xml.Header)
+	body.WriteString(`<D:error xmlns:D="DAV:"`)
+	if namespace != nsDAV {
+		fmt.Fprintf(&body, ` xmlns:%s="%s"`, prefixes[namespace], namespace)
+	}
+	fmt.Fprintf(&body, `><%s:%s>`, prefixes[namespace], condition)
+	xml.EscapeText(&body, []byte(message))
+	fmt.Fprintf(&body, `</%s:%s></D:error>`, prefixes[namespace], condition)
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write([]byte(body.String()))
+}
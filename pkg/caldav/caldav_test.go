@@ -0,0 +1,80 @@
+package caldav
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEventUUID(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+		ok   bool
+	}{
+		{"/dav/calendars/appointments/0192f0c4-7b1e-7d3a-9c1a-2f6e4b8d0a11.ics", "0192f0c4-7b1e-7d3a-9c1a-2f6e4b8d0a11", true},
+		{"/dav/calendars/appointments/abc.ics", "abc", true},
+		{"/dav/calendars/appointments/.ics", "", false},
+		{"/dav/calendars/appointments/a/b.ics", "a/b", false},
+		{"/dav/calendars/appointments/abc", "", false},
+		{"/dav/calendars/appointments/", "", false},
+		{"/dav/calendars/other/abc.ics", "", false},
+		{"/appointments/abc.ics", "", false},
+	}
+	for _, test := range tests {
+		got, ok := eventUUID(test.path)
+		if ok != test.ok || (ok && got != test.want) {
+			t.Errorf("eventUUID(%q) = %q, %v, want %q, %v", test.path, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestWriteDAVError(t *testing.T) {
+	tests := []struct {
+		status    int
+		namespace string
+		condition string
+		message   string
+	}{
+		{http.StatusForbidden, nsDAV, "need-privileges", "read only"},
+		{http.StatusBadRequest, nsCalDAV, "valid-calendar-data", "expected a calendar with one event"},
+		{http.StatusConflict, nsClinic, "schedule-conflict", `overlaps "Cleaning" <10:00 & 10:30>`},
+	}
+	for _, test := range tests {
+		recorder := httptest.NewRecorder()
+		writeDAVError(recorder, test.status, test.namespace, test.condition, test.message)
+		body := recorder.Body.String()
+		if recorder.Code != test.status {
+			t.Errorf("%s: status = %d, want %d", test.condition, recorder.Code, test.status)
+		}
+		if got := recorder.Header().Get("Content-Type"); !strings.HasPrefix(got, "application/xml") {
+			t.Errorf("%s: Content-Type = %q", test.condition, got)
+		}
+		// encoding/xml accepts repeated attributes, so count them:
+		if count := strings.Count(body, `xmlns:D=`); count != 1 {
+			t.Errorf("%s: the DAV: namespace is declared %d times in %s", test.condition, count, body)
+		}
+		var parsed struct {
+			XMLName   xml.Name
+			Condition struct {
+				XMLName xml.Name
+				Text    string `xml:",chardata"`
+			} `xml:",any"`
+		}
+		if err := xml.Unmarshal([]byte(body), &parsed); err != nil {
+			t.Errorf("%s: %s in %s", test.condition, err, body)
+			continue
+		}
+		if parsed.XMLName != (xml.Name{Space: nsDAV, Local: "error"}) {
+			t.Errorf("%s: root element %v, want DAV: error", test.condition, parsed.XMLName)
+		}
+		if want := (xml.Name{Space: test.namespace, Local: test.condition}); parsed.Condition.XMLName != want {
+			t.Errorf("%s: condition %v, want %v", test.condition, parsed.Condition.XMLName, want)
+		}
+		if parsed.Condition.Text != test.message {
+			t.Errorf("%s: message %q, want %q", test.condition, parsed.Condition.Text, test.message)
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package caldav
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/models"
+)
+
+// propName is the name of a requested property.
+type propName struct {
+	XMLName xml.Name
+}
+
+type propRequest struct {
+	Names []propName `xml:",any"`
+}
+
+type propfindRequest struct {
+	Prop     *propRequest `xml:"DAV: prop"`
+	AllProp  *struct{}    `xml:"DAV: allprop"`
+	PropName *struct{}    `xml:"DAV: propname"`
+}
+
+// reportRequest is a calendar-multiget or calendar-query REPORT.
+type reportRequest struct {
+	XMLName   xml.Name
+	Prop      propRequest `xml:"DAV: prop"`
+	Hrefs     []string    `xml:"DAV: href"`
+	TimeRange *struct {
+		Start string `xml:"start,attr"`
+		End   string `xml:"end,attr"`
+	} `xml:"filter>comp-filter>comp-filter>time-range"`
+}
+
+// properties maps the properties of a resource to their XML values.
+type properties map[xml.Name]string
+
+func name(namespace, local string) xml.Name {
+	return xml.Name{Space: namespace, Local: local}
+}
+
+func href(path string) string {
+	return "<D:href>" + path + "</D:href>"
+}
+
+// collectionProperties returns the properties of the root (the principal),
+// the calendar home, or the calendar.
+func (h *HTTPHandler) collectionProperties(path string) (properties, error) {
+	props := properties{
+		name(nsDAV, "current-user-principal"): href(rootPath),
+		name(nsDAV, "principal-URL"):          href(rootPath),
+		name(nsCalDAV, "calendar-home-set"):   href(homePath),
+		name(nsDAV, "current-user-privilege-set"): "<D:privilege><D:read/></D:privilege>" +
+			"<D:privilege><D:write-content/></D:privilege><D:privilege><D:unbind/></D:privilege>",
+	}
+	switch path {
+	case rootPath:
+		props[name(nsDAV, "resourcetype")] = "<D:collection/><D:principal/>"
+		props[name(nsDAV, "displayname")] = Username
+	case homePath:
+		props[name(nsDAV, "resourcetype")] = "<D:collection/>"
+		props[name(nsDAV, "displayname")] = "Calendars"
+	case calendarPath:
+		ctag, err := h.ctag()
+		if err != nil {
+			return nil, err
+		}
+		props[name(nsDAV, "resourcetype")] = "<D:collection/><C:calendar/>"
+		props[name(nsDAV, "displayname")] = "Appointments"
+		props[name(nsCalDAV, "supported-calendar-component-set")] = `<C:comp name="VEVENT"/>`
+		props[name(nsDAV, "supported-report-set")] = "<D:supported-report><D:report><C:calendar-multiget/></D:report></D:supported-report>" +
+			"<D:supported-report><D:report><C:calendar-query/></D:report></D:supported-report>"
+		props[name(nsCS, "getctag")] = ctag
+		props[name(nsApple, "calendar-color")] = "#4682B4FF"
+	}
+	return props, nil
+}
+
+// eventProperties returns the properties of the event of appointment.
+func eventProperties(appointment models.Appointment) properties {
+	return properties{
+		name(nsDAV, "resourcetype"):     "",
+		name(nsDAV, "getetag"):          escape(etag(appointment)),
+		name(nsDAV, "getcontenttype"):   "text/calendar; charset=utf-8; component=VEVENT",
+		name(nsDAV, "getlastmodified"):  appointment.UpdatedAt.UTC().Format(http.TimeFormat),
+		name(nsCalDAV, "calendar-data"): escape(calendarData(appointment)),
+		name(nsDAV, "displayname"):      escape(appointment.Patient.Name),
+	}
+}
+
+func escape(text string) string {
+	var escaped strings.Builder
+	xml.EscapeText(&escaped, []byte(text))
+	return escaped.String()
+}
+
+// multistatus collects the responses of a PROPFIND or REPORT.
+type multistatus struct {
+	body strings.Builder
+}
+
+// add adds the response for the resource at path: the requested properties
+// it has, and the ones it doesn't (as 404 Not Found). With no names, it
+// lists every property but calendar-data.
+func (m *multistatus) add(path string, props properties, names []xml.Name) {
+	if names == nil {
+		for n := range props {
+			if n != name(nsCalDAV, "calendar-data") {
+				names = append(names, n)
+			}
+		}
+	}
+	var found, missing strings.Builder
+	for _, n := range names {
+		prefix, known := prefixes[n.Space]
+		value, ok := props[n]
+		switch {
+		case ok && value == "":
+			fmt.Fprintf(&found, "<%s:%s/>", prefix, n.Local)
+		case ok:
+			fmt.Fprintf(&found, "<%s:%s>%s</%s:%s>", prefix, n.Local, value, prefix, n.Local)
+		case known:
+			fmt.Fprintf(&missing, "<%s:%s/>", prefix, n.Local)
+		default:
+			fmt.Fprintf(&missing, `<x:%s xmlns:x="%s"/>`, n.Local, escape(n.Space))
+		}
+	}
+	m.body.WriteString("<D:response>" + href(path))
+	if found.Len() > 0 {
+		m.body.WriteString("<D:propstat><D:prop>" + found.String() + "</D:prop><D:status>HTTP/1.1 200 OK</D:status></D:propstat>")
+	}
+	if missing.Len() > 0 {
+		m.body.WriteString("<D:propstat><D:prop>" + missing.String() + "</D:prop><D:status>HTTP/1.1 404 Not Found</D:status></D:propstat>")
+	}
+	m.body.WriteString("</D:response>")
+}
+
+// addMissing adds a 404 Not Found response for path.
+func (m *multistatus) addMissing(path string) {
+	m.body.WriteString("<D:response>" + href(path) + "<D:status>HTTP/1.1 404 Not Found</D:status></D:response>")
+}
+
+func (m *multistatus) write(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header+`<D:multistatus xmlns:D="DAV:" xmlns:C="`+nsCalDAV+`" xmlns:CS="`+nsCS+`" xmlns:A="`+nsApple+`">`)
+	io.WriteString(w, m.body.String())
+	io.WriteString(w, "</D:multistatus>")
+}
+
+// requestedNames returns the property names of a prop element, or nil for
+// all properties.
+func requestedNames(prop *propRequest) []xml.Name {
+	if prop == nil {
+		return nil
+	}
+	names := []xml.Name{}
+	for _, n := range prop.Names {
+		names = append(names, n.XMLName)
+	}
+	return names
+}
+
+// propfind handles PROPFIND with Depth 0 or 1.
+func (h *HTTPHandler) propfind(w http.ResponseWriter, r *http.Request) {
+	var request propfindRequest
+	err := xml.NewDecoder(r.Body).Decode(&request)
+	if err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	names := requestedNames(request.Prop)
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		// an infinite depth is not needed for a single calendar
+		depth = "1"
+	}
+
+	var response multistatus
+	path := r.URL.Path
+	switch path {
+	case rootPath, homePath, calendarPath:
+		props, err := h.collectionProperties(path)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response.add(path, props, names)
+		if depth == "0" {
+			break
+		}
+		switch path {
+		case rootPath:
+			props, err := h.collectionProperties(homePath)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			response.add(homePath, props, names)
+		case homePath:
+			props, err := h.collectionProperties(calendarPath)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			response.add(calendarPath, props, names)
+		case calendarPath:
+			var list []models.Appointment
+			if err := h.query().Order("start_time asc").Find(&list).Error; err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			for _, appointment := range list {
+				response.add(eventPath(appointment), eventProperties(appointment), names)
+			}
+		}
+	default:
+		appointment, err := h.find(path)
+		if err != nil || appointment.Status == models.StatusCancelled {
+			http.Error(w, "not found", http.StatusNotFound)
+			return
+		}
+		response.add(path, eventProperties(appointment), names)
+	}
+	response.write(w)
+}
+
+// report handles the calendar-multiget and calendar-query REPORTs on the
+// calendar. calendar-query only filters by time range.
+func (h *HTTPHandler) report(w http.ResponseWriter, r *http.Request) {
+	var request reportRequest
+	err := xml.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	names := requestedNames(&request.Prop)
+	var response multistatus
+
+	switch {
+	case request.XMLName == name(nsCalDAV, "calendar-multiget"):
+		for _, path := range request.Hrefs {
+			path = strings.TrimSpace(path)
+			appointment, err := h.find(path)
+			if err != nil || appointment.Status == models.StatusCancelled {
+				response.addMissing(path)
+				continue
+			}
+			response.add(path, eventProperties(appointment), names)
+		}
+	case request.XMLName == name(nsCalDAV, "calendar-query"):
+		query := h.query()
+		if request.TimeRange != nil {
+			// events that end after start and begin before end:
+			if request.TimeRange.Start != "" {
+				start, err := time.Parse("20060102T150405Z", request.TimeRange.Start)
+				if err != nil {
+					writeDAVError(w, http.StatusForbidden, nsCalDAV, "valid-filter", "invalid time-range start")
+					return
+				}
+				query = query.Where("DATE_ADD(start_time, INTERVAL duration MINUTE) > ?", start)
+			}
+			if request.TimeRange.End != "" {
+				end, err := time.Parse("20060102T150405Z", request.TimeRange.End)
+				if err != nil {
+					writeDAVError(w, http.StatusForbidden, nsCalDAV, "valid-filter", "invalid time-range end")
+					return
+				}
+				query = query.Where("start_time < ?", end)
+			}
+		}
+		var list []models.Appointment
+		if err := query.Order("start_time asc").Find(&list).Error; err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, appointment := range list {
+			response.add(eventPath(appointment), eventProperties(appointment), names)
+		}
+	default:
+		writeDAVError(w, http.StatusForbidden, nsDAV, "supported-report", "unsupported report "+request.XMLName.Local)
+		return
+	}
+	response.write(w)
+}
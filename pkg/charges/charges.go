@@ -0,0 +1,181 @@
+package charges
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/gorm"
+)
+
+type HTTPHandler struct {
+	DB  *gorm.DB
+	Ctx context.Context
+}
+
+// Rates are the VAT rates of the categories in Cyprus, in percent.
+var Rates = map[models.VATCategory]int{
+	models.VATExempt:       0,
+	models.VATZero:         0,
+	models.VATSuperReduced: 5,
+	models.VATReduced:      9,
+	models.VATStandard:     19,
+}
+
+// ValidCategory reports whether category is a known VAT category.
+func ValidCategory(category models.VATCategory) bool {
+	_, ok := Rates[category]
+	return ok
+}
+
+// vatIncluded returns the VAT in amount, which includes VAT at rate percent,
+// rounded to the cent.
+func vatIncluded(amount, rate int) int {
+	return int(math.Round(float64(amount) * float64(rate) / float64(100+rate)))
+}
+
+// Prefill creates the charge of a completed appointment from the fee and VAT
+// category of its appointment type. Types without a fee, and appointments
+// that already have a charge, are left alone; it then returns nil.
+func Prefill(tx *gorm.DB, appointment models.Appointment) (*models.Charge, error) {
+	var appointmentType models.AppointmentType
+	if err := tx.First(&appointmentType, appointment.AppointmentTypeID).Error; err != nil {
+		return nil, err
+	}
+	if appointmentType.DefaultFee <= 0 {
+		return nil, nil
+	}
+	var existing int64
+	if err := tx.Model(&models.Charge{}).Where("appointment_id = ?", appointment.ID).Count(&existing).Error; err != nil {
+		return nil, err
+	}
+	if existing > 0 {
+		return nil, nil
+	}
+	category := appointmentType.VATCategory
+	if !ValidCategory(category) {
+		category = models.VATExempt
+	}
+	tempUUID, _ := uuid.NewV7()
+	charge := models.Charge{
+		UUID:          tempUUID.String(),
+		AppointmentID: appointment.ID,
+		PatientID:     appointment.PatientID,
+		Description:   appointmentType.Description,
+		Amount:        appointmentType.DefaultFee,
+		VATCategory:   category,
+		VATRate:       Rates[category],
+		VATAmount:     vatIncluded(appointmentType.DefaultFee, Rates[category]),
+	}
+	if err := tx.Omit("Patient").Create(&charge).Error; err != nil {
+		return nil, err
+	}
+	return &charge, nil
+}
+
+// ListCharges handles GET /charges. ?patient={uuid} limits the list to one
+// patient, ?appointment={uuid} to one appointment, and ?unpaid=true to the
+// charges that have not been paid yet.
+func (h *HTTPHandler) ListCharges(w http.ResponseWriter, r *http.Request) {
+	query := h.DB.Preload("Patient").Order("created_at asc")
+	if patientUUID := r.URL.Query().Get("patient"); patientUUID != "" {
+		query = query.Where("patient_id = (SELECT id FROM patients WHERE uuid = ?)", patientUUID)
+	}
+	if appointmentUUID := r.URL.Query().Get("appointment"); appointmentUUID != "" {
+		query = query.Where("appointment_id = (SELECT id FROM appointments WHERE uuid = ?)", appointmentUUID)
+	}
+	if r.URL.Query().Get("unpaid") == "true" {
+		query = query.Where("paid_at IS NULL")
+	}
+	var list []models.Charge
+	err := query.Find(&list).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// GetCharge handles GET /charges/{uuid}.
+func (h *HTTPHandler) GetCharge(w http.ResponseWriter, r *http.Request) {
+	var charge models.Charge
+	err := h.DB.Preload("Patient").Where("uuid = ?", mux.Vars(r)["uuid"]).First(&charge).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(charge)
+}
+
+// chargeUpdate is the body of PUT /charges/{uuid}.
+type chargeUpdate struct {
+	Description string
+	Amount      int
+	VATCategory models.VATCategory
+	Paid        bool
+}
+
+// validate checks a corrected charge.
+func (u *chargeUpdate) validate() error {
+	u.Description = strings.TrimSpace(u.Description)
+	if u.Description == "" {
+		return errors.New("Description is required")
+	}
+	if u.Amount < 0 {
+		return errors.New("Amount cannot be negative")
+	}
+	if !ValidCategory(u.VATCategory) {
+		return errors.New("VATCategory must be exempt, zero, super-reduced, reduced or standard")
+	}
+	return nil
+}
+
+// UpdateCharge handles PUT /charges/{uuid}, which corrects a charge or marks
+// it as paid, e.g. {"Description": "Extraction", "Amount": 6000,
+// "VATCategory": "exempt", "Paid": true}. The VAT is worked out again.
+func (h *HTTPHandler) UpdateCharge(w http.ResponseWriter, r *http.Request) {
+	var update chargeUpdate
+	err := json.NewDecoder(r.Body).Decode(&update)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := update.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	var charge models.Charge
+	err = h.DB.Where("uuid = ?", mux.Vars(r)["uuid"]).First(&charge).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	charge.Description = update.Description
+	charge.Amount = update.Amount
+	charge.VATCategory = update.VATCategory
+	charge.VATRate = Rates[update.VATCategory]
+	charge.VATAmount = vatIncluded(update.Amount, charge.VATRate)
+	switch {
+	case update.Paid && charge.PaidAt == nil:
+		now := time.Now()
+		charge.PaidAt = &now
+	case !update.Paid:
+		charge.PaidAt = nil
+	}
+	err = h.DB.Model(&charge).Select("Description", "Amount", "VATCategory", "VATRate", "VATAmount", "PaidAt").Updates(&charge).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(charge)
+}
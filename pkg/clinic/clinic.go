@@ -0,0 +1,52 @@
+// Package clinic holds the clinic's time zone. Times are stored in UTC;
+// working hours, time off, day boundaries and the calendar views follow the
+// clinic's wall clock, in this time zone.
+package clinic
+
+import (
+	"fmt"
+	"time"
+
+	// embed the time zone database, so the time zone loads even on hosts
+	// without one:
+	_ "time/tzdata"
+)
+
+// DefaultTimeZone is the clinic's time zone unless config.json sets another.
+const DefaultTimeZone = "Asia/Nicosia"
+
+// Location is the clinic's time zone.
+var Location = mustLoad(DefaultTimeZone)
+
+func mustLoad(name string) *time.Location {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		// cannot happen with the embedded time zone database
+		panic(err)
+	}
+	return location
+}
+
+// SetTimeZone sets the clinic's time zone to an IANA time zone name, such as
+// "Europe/Athens".
+func SetTimeZone(name string) error {
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return fmt.Errorf("invalid time zone %q: %w", name, err)
+	}
+	Location = location
+	return nil
+}
+
+// Now returns the current time on the clinic's wall clock.
+func Now() time.Time {
+	return time.Now().In(Location)
+}
+
+// StartOfDay returns midnight at the start of the clinic's day that includes
+// t. Days are not always 24 hours long: use AddDate, not Add, to move
+// between them.
+func StartOfDay(t time.Time) time.Time {
+	t = t.In(Location)
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, Location)
+}
@@ -0,0 +1,281 @@
+package googlecalendar
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultBaseURL is the address of the Google Calendar API.
+const DefaultBaseURL = "https://www.googleapis.com/calendar/v3"
+
+// DefaultTokenURL is where OAuth 2.0 access tokens are obtained from Google.
+const DefaultTokenURL = "https://oauth2.googleapis.com/token"
+
+// ErrSyncTokenExpired is returned by Changes when Google no longer accepts
+// the sync token, and the calendar has to be synced in full again.
+var ErrSyncTokenExpired = errors.New("the sync token has expired")
+
+// API is the part of the Google Calendar API that the sync uses. APIClient
+// talks to Google; tests can point it to a local fake server instead, or
+// replace it altogether.
+type API interface {
+	// Insert creates event and returns it with its ID.
+	Insert(ctx context.Context, calendarID string, event Event) (Event, error)
+	// Update replaces the event with ID event.ID.
+	Update(ctx context.Context, calendarID string, event Event) (Event, error)
+	// Delete deletes an event. Deleting an event that is already gone is
+	// not an error.
+	Delete(ctx context.Context, calendarID, eventID string) error
+	// Changes returns the events that changed since the sync that returned
+	// syncToken, including deleted ones, and the token for the next sync.
+	// With an empty syncToken, it returns every event.
+	Changes(ctx context.Context, calendarID, syncToken string) ([]Event, string, error)
+	// Watch asks Google to post notifications of changes to the calendar to
+	// channel.Address.
+	Watch(ctx context.Context, calendarID string, channel Channel) (Channel, error)
+	// Stop stops the notifications of a channel.
+	Stop(ctx context.Context, channel Channel) error
+}
+
+// Event is a Google Calendar event, with the fields the sync uses.
+type Event struct {
+	ID                 string              `json:"id,omitempty"`
+	Status             string              `json:"status,omitempty"` // "confirmed", "tentative" or "cancelled" (deleted)
+	Summary            string              `json:"summary,omitempty"`
+	Description        string              `json:"description,omitempty"`
+	Start              *EventTime          `json:"start,omitempty"`
+	End                *EventTime          `json:"end,omitempty"`
+	ExtendedProperties *ExtendedProperties `json:"extendedProperties,omitempty"`
+}
+
+// EventTime is the start or end of an event: a DateTime (RFC 3339) for timed
+// events, or a Date (YYYY-MM-DD) for all-day events.
+type EventTime struct {
+	DateTime string `json:"dateTime,omitempty"`
+	Date     string `json:"date,omitempty"`
+	TimeZone string `json:"timeZone,omitempty"`
+}
+
+// ExtendedProperties holds the properties the backend stores with events.
+type ExtendedProperties struct {
+	Private map[string]string `json:"private,omitempty"`
+}
+
+// Channel is a push notification channel.
+type Channel struct {
+	ID         string `json:"id"`
+	Type       string `json:"type,omitempty"`    // "web_hook"
+	Address    string `json:"address,omitempty"` // the HTTPS URL notifications are posted to
+	Token      string `json:"token,omitempty"`
+	ResourceID string `json:"resourceId,omitempty"`
+	Expiration int64  `json:"expiration,omitempty,string"` // in Unix milliseconds
+}
+
+// APIError is an error response of the Google Calendar API.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("Google Calendar API: %d %s", e.StatusCode, e.Message)
+}
+
+// APIClient implements API over HTTP.
+type APIClient struct {
+	BaseURL    string       // DefaultBaseURL, or the URL of a fake server
+	HTTPClient *http.Client // http.DefaultClient if nil
+	Auth       *OAuth       // nil sends no credentials, e.g. to a fake server
+}
+
+// OAuth obtains access tokens with a refresh token of the clinic's Google
+// account, and keeps them until they expire.
+type OAuth struct {
+	ClientID     string
+	ClientSecret string
+	RefreshToken string
+	TokenURL     string // DefaultTokenURL if empty
+
+	mutex   sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// Token returns a valid access token.
+func (o *OAuth) Token(ctx context.Context, client *http.Client) (string, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.token != "" && time.Now().Before(o.expires) {
+		return o.token, nil
+	}
+	tokenURL := o.TokenURL
+	if tokenURL == "" {
+		tokenURL = DefaultTokenURL
+	}
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {o.ClientID},
+		"client_secret": {o.ClientSecret},
+		"refresh_token": {o.RefreshToken},
+	}
+	request, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response, err := client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("couldn't obtain a Google access token: %w", err)
+	}
+	defer response.Body.Close()
+	var result struct {
+		AccessToken      string `json:"access_token"`
+		ExpiresIn        int    `json:"expires_in"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("couldn't obtain a Google access token: %w", err)
+	}
+	if response.StatusCode != http.StatusOK || result.AccessToken == "" {
+		return "", fmt.Errorf("couldn't obtain a Google access token: %d %s %s", response.StatusCode, result.Error, result.ErrorDescription)
+	}
+	o.token = result.AccessToken
+	// renew a minute early, so a token never expires on the way:
+	o.expires = time.Now().Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+	return o.token, nil
+}
+
+// do sends a request to the API and decodes the response into result, if it
+// isn't nil.
+func (c *APIClient) do(ctx context.Context, method, path string, query url.Values, body, result any) error {
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	baseURL := c.BaseURL
+	if baseURL == "" {
+		baseURL = DefaultBaseURL
+	}
+	address := strings.TrimSuffix(baseURL, "/") + path
+	if len(query) > 0 {
+		address += "?" + query.Encode()
+	}
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, address, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	if c.Auth != nil {
+		token, err := c.Auth.Token(ctx, client)
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		var failure struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		json.NewDecoder(response.Body).Decode(&failure)
+		return &APIError{StatusCode: response.StatusCode, Message: failure.Error.Message}
+	}
+	if result == nil {
+		return nil
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func eventsPath(calendarID string) string {
+	return "/calendars/" + url.PathEscape(calendarID) + "/events"
+}
+
+func (c *APIClient) Insert(ctx context.Context, calendarID string, event Event) (Event, error) {
+	var created Event
+	err := c.do(ctx, "POST", eventsPath(calendarID), nil, event, &created)
+	return created, err
+}
+
+func (c *APIClient) Update(ctx context.Context, calendarID string, event Event) (Event, error) {
+	var updated Event
+	err := c.do(ctx, "PUT", eventsPath(calendarID)+"/"+url.PathEscape(event.ID), nil, event, &updated)
+	return updated, err
+}
+
+func (c *APIClient) Delete(ctx context.Context, calendarID, eventID string) error {
+	err := c.do(ctx, "DELETE", eventsPath(calendarID)+"/"+url.PathEscape(eventID), nil, nil, nil)
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusGone) {
+		return nil
+	}
+	return err
+}
+
+func (c *APIClient) Changes(ctx context.Context, calendarID, syncToken string) ([]Event, string, error) {
+	var events []Event
+	pageToken := ""
+	for {
+		query := url.Values{"maxResults": {"250"}}
+		if syncToken != "" {
+			query.Set("syncToken", syncToken)
+		}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		var page struct {
+			Items         []Event `json:"items"`
+			NextPageToken string  `json:"nextPageToken"`
+			NextSyncToken string  `json:"nextSyncToken"`
+		}
+		err := c.do(ctx, "GET", eventsPath(calendarID), query, nil, &page)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusGone {
+			return nil, "", ErrSyncTokenExpired
+		}
+		if err != nil {
+			return nil, "", err
+		}
+		events = append(events, page.Items...)
+		if page.NextPageToken == "" {
+			return events, page.NextSyncToken, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (c *APIClient) Watch(ctx context.Context, calendarID string, channel Channel) (Channel, error) {
+	channel.Type = "web_hook"
+	var watched Channel
+	err := c.do(ctx, "POST", eventsPath(calendarID)+"/watch", nil, channel, &watched)
+	return watched, err
+}
+
+func (c *APIClient) Stop(ctx context.Context, channel Channel) error {
+	return c.do(ctx, "POST", "/channels/stop", nil, Channel{ID: channel.ID, ResourceID: channel.ResourceID}, nil)
+}
@@ -0,0 +1,95 @@
+package googlecalendar
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestClientEvents(t *testing.T) {
+	fake := newFakeGoogle(t)
+	client := fake.client()
+	ctx := context.Background()
+
+	created, err := client.Insert(ctx, "primary", Event{Summary: "Cleaning"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.ID == "" || created.Summary != "Cleaning" {
+		t.Fatalf("Insert = %+v", created)
+	}
+	created.Summary = "Filling"
+	if _, err := client.Update(ctx, "primary", created); err != nil {
+		t.Fatal(err)
+	}
+	if event, _ := fake.event(created.ID); event.Summary != "Filling" {
+		t.Errorf("the event's summary is %q after Update, want Filling", event.Summary)
+	}
+
+	if err := client.Delete(ctx, "primary", created.ID); err != nil {
+		t.Fatal(err)
+	}
+	// deleting an event that is gone (410) or never was (404) is not an error:
+	if err := client.Delete(ctx, "primary", created.ID); err != nil {
+		t.Errorf("deleting a deleted event: %s", err)
+	}
+	if err := client.Delete(ctx, "primary", "missing"); err != nil {
+		t.Errorf("deleting a missing event: %s", err)
+	}
+
+	// but updating one is:
+	_, err = client.Update(ctx, "primary", created)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusGone {
+		t.Errorf("updating a deleted event: %v, want a 410 APIError", err)
+	}
+	_, err = client.Update(ctx, "primary", Event{ID: "missing"})
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("updating a missing event: %v, want a 404 APIError", err)
+	}
+}
+
+func TestClientChanges(t *testing.T) {
+	fake := newFakeGoogle(t)
+	client := fake.client()
+	ctx := context.Background()
+
+	var ids []string
+	for _, summary := range []string{"one", "two", "three"} {
+		created, err := client.Insert(ctx, "primary", Event{Summary: summary})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, created.ID)
+	}
+
+	// a full sync returns every event, over several pages:
+	events, syncToken, err := client.Changes(ctx, "primary", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 3 || syncToken == "" {
+		t.Fatalf("full sync = %d events and token %q, want 3 events and a token", len(events), syncToken)
+	}
+
+	// an incremental sync returns what changed, deleted events included:
+	if err := client.Delete(ctx, "primary", ids[1]); err != nil {
+		t.Fatal(err)
+	}
+	events, nextToken, err := client.Changes(ctx, "primary", syncToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].ID != ids[1] || events[0].Status != "cancelled" {
+		t.Errorf("incremental sync = %+v, want the deleted event %s", events, ids[1])
+	}
+	if events, _, _ = client.Changes(ctx, "primary", nextToken); len(events) != 0 {
+		t.Errorf("nothing changed, but the sync returned %+v", events)
+	}
+
+	// a token Google no longer accepts asks for a full sync:
+	if _, _, err := client.Changes(ctx, "primary", "expired"); !errors.Is(err, ErrSyncTokenExpired) {
+		t.Errorf("Changes with an expired token: %v, want ErrSyncTokenExpired", err)
+	}
+}
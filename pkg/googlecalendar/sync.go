@@ -0,0 +1,388 @@
+// Package googlecalendar keeps a Google Calendar in sync with the
+// appointments. Appointments are pushed to the calendar as they are booked,
+// changed and cancelled. Events the dentist moves in Google Calendar move the
+// appointments too, with the same checks as POST /appointments/{uuid}/move;
+// moves that are refused are undone in the calendar. Events cannot be booked
+// from Google Calendar: events the backend didn't create are left alone.
+//
+// Google announces changes to the calendar on a webhook; the calendar is
+// also synced every SyncInterval, which is when appointment changes are
+// pushed.
+package googlecalendar
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/ipmess/dentistbackend/pkg/appointments"
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/ical"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/gorm"
+)
+
+type HTTPHandler struct {
+	DB  *gorm.DB
+	Ctx context.Context
+}
+
+// Client is the Google Calendar API. The sync is switched off while it is
+// nil.
+var Client API
+
+// CalendarID is the Google Calendar the appointments are kept in.
+var CalendarID = "primary"
+
+// WebhookURL is the public HTTPS address of the webhook that Google posts
+// change notifications to. Without it, changes in Google Calendar are only
+// picked up every SyncInterval.
+var WebhookURL = ""
+
+// SyncInterval is how often the calendar is synced.
+var SyncInterval = time.Minute
+
+// historyDays is how far back appointments are pushed to the calendar.
+const historyDays = 30
+
+// channelRenewal is how long before it expires a notification channel is
+// replaced.
+const channelRenewal = 24 * time.Hour
+
+// appointmentProperty is the private extended property of an event that
+// holds the UUID of its appointment.
+const appointmentProperty = "appointmentUUID"
+
+// wake asks Run to sync straight away.
+var wake = make(chan struct{}, 1)
+
+// Wake makes Run sync as soon as it can.
+func Wake() {
+	select {
+	case wake <- struct{}{}:
+	default:
+		// a sync is already due
+	}
+}
+
+// Run syncs the calendar every SyncInterval, and whenever Wake is called,
+// until ctx is done.
+func Run(ctx context.Context, db *gorm.DB) {
+	if Client == nil {
+		return
+	}
+	ticker := time.NewTicker(SyncInterval)
+	defer ticker.Stop()
+	for {
+		Sync(ctx, db)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wake:
+		}
+	}
+}
+
+// Sync renews the notification channel if needed, applies the changes made
+// in Google Calendar, and then pushes the changed appointments. Errors are
+// logged; the next sync tries again.
+func Sync(ctx context.Context, db *gorm.DB) {
+	if err := Watch(ctx, db); err != nil {
+		log.Printf("couldn't watch Google Calendar %s: %s\n", CalendarID, err)
+	}
+	if err := Pull(ctx, db); err != nil {
+		log.Printf("couldn't pull the changes from Google Calendar %s: %s\n", CalendarID, err)
+	}
+	if err := Push(ctx, db); err != nil {
+		log.Printf("couldn't push the appointments to Google Calendar %s: %s\n", CalendarID, err)
+	}
+}
+
+// syncState loads the sync state of the calendar, creating it on the first
+// sync.
+func syncState(db *gorm.DB) (models.GoogleCalendarSync, error) {
+	var state models.GoogleCalendarSync
+	err := db.Where(models.GoogleCalendarSync{CalendarID: CalendarID}).FirstOrCreate(&state).Error
+	return state, err
+}
+
+// eventFor returns the Google Calendar event for appointment, whose Patient
+// and AppointmentType must be loaded. It has the same summary and
+// description as in the calendar feed.
+func eventFor(appointment models.Appointment) Event {
+	feedEvent := ical.EventFor(appointment)
+	event := Event{
+		Status:      "confirmed",
+		Summary:     feedEvent.Summary,
+		Description: feedEvent.Description,
+		Start:       &EventTime{DateTime: feedEvent.Start.Format(time.RFC3339), TimeZone: clinic.Location.String()},
+		End:         &EventTime{DateTime: feedEvent.End.Format(time.RFC3339), TimeZone: clinic.Location.String()},
+		ExtendedProperties: &ExtendedProperties{
+			Private: map[string]string{appointmentProperty: appointment.UUID},
+		},
+	}
+	if feedEvent.Status == "TENTATIVE" {
+		event.Status = "tentative"
+	}
+	return event
+}
+
+// Push writes the appointments that changed since they were last pushed to
+// the calendar: new ones are added, changed ones updated, and cancelled ones
+// deleted.
+func Push(ctx context.Context, db *gorm.DB) error {
+	if Client == nil {
+		return nil
+	}
+	db = db.WithContext(ctx)
+	var pending []models.Appointment
+	err := db.Preload("Patient").Preload("AppointmentType").Preload("Resource").Preload("Practitioner").
+		Joins("LEFT JOIN google_calendar_events ON google_calendar_events.appointment_id = appointments.id "+
+			"AND google_calendar_events.calendar_id = ? AND google_calendar_events.deleted_at IS NULL", CalendarID).
+		Where("(google_calendar_events.id IS NULL AND appointments.status <> ? AND appointments.start_time >= ?) "+
+			"OR (google_calendar_events.id IS NOT NULL AND NOT google_calendar_events.deleted "+
+			"AND google_calendar_events.sequence < appointments.sequence)",
+			models.StatusCancelled, clinic.StartOfDay(time.Now()).AddDate(0, 0, -historyDays)).
+		Order("appointments.start_time asc").
+		Find(&pending).Error
+	if err != nil {
+		return err
+	}
+	for _, appointment := range pending {
+		if err := pushAppointment(ctx, db, appointment); err != nil {
+			return fmt.Errorf("appointment %s: %w", appointment.UUID, err)
+		}
+	}
+	return nil
+}
+
+// pushAppointment writes one appointment to the calendar and records the
+// event it was written to.
+func pushAppointment(ctx context.Context, db *gorm.DB, appointment models.Appointment) error {
+	var link models.GoogleCalendarEvent
+	err := db.Where("appointment_id = ? AND calendar_id = ?", appointment.ID, CalendarID).First(&link).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return err
+	}
+	link.AppointmentID = appointment.ID
+	link.CalendarID = CalendarID
+	link.Sequence = appointment.Sequence
+
+	if appointment.Status == models.StatusCancelled {
+		if link.ID == 0 {
+			return nil
+		}
+		if err := Client.Delete(ctx, CalendarID, link.EventID); err != nil {
+			return err
+		}
+		link.Deleted = true
+		return db.Save(&link).Error
+	}
+
+	event := eventFor(appointment)
+	insert := link.ID == 0
+	if !insert {
+		event.ID = link.EventID
+		_, err = Client.Update(ctx, CalendarID, event)
+		var apiErr *APIError
+		if errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusNotFound || apiErr.StatusCode == http.StatusGone) {
+			// the event was removed from the calendar; add it again:
+			insert = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if insert {
+		event.ID = ""
+		created, err := Client.Insert(ctx, CalendarID, event)
+		if err != nil {
+			return err
+		}
+		link.EventID = created.ID
+	}
+	return db.Save(&link).Error
+}
+
+// Pull applies the changes made in the calendar since the last sync.
+func Pull(ctx context.Context, db *gorm.DB) error {
+	if Client == nil {
+		return nil
+	}
+	db = db.WithContext(ctx)
+	state, err := syncState(db)
+	if err != nil {
+		return err
+	}
+	events, syncToken, err := Client.Changes(ctx, CalendarID, state.SyncToken)
+	if errors.Is(err, ErrSyncTokenExpired) {
+		// start over with a full sync:
+		events, syncToken, err = Client.Changes(ctx, CalendarID, "")
+	}
+	if err != nil {
+		return err
+	}
+	for _, event := range events {
+		if err := apply(ctx, db, event); err != nil {
+			return fmt.Errorf("event %s: %w", event.ID, err)
+		}
+	}
+	return db.Model(&state).Update("sync_token", syncToken).Error
+}
+
+// change is what a change to an event in the calendar asks of its
+// appointment.
+type change int
+
+const (
+	unchanged change = iota // nothing, e.g. our own update coming back
+	moved                   // move the appointment to the event's time
+	deleted                 // the event was deleted; add it again
+	refused                 // the event cannot be taken over; put it back
+)
+
+// remoteChange works out what event asks of appointment, and the start and
+// duration of a move.
+func remoteChange(event Event, appointment models.Appointment) (change, time.Time, int) {
+	if event.Status == "cancelled" {
+		if appointment.Status == models.StatusCancelled {
+			return unchanged, time.Time{}, 0
+		}
+		return deleted, time.Time{}, 0
+	}
+	if event.Start == nil || event.End == nil || event.Start.DateTime == "" || event.End.DateTime == "" {
+		// made an all-day event
+		return refused, time.Time{}, 0
+	}
+	start, err := time.Parse(time.RFC3339, event.Start.DateTime)
+	if err != nil {
+		return refused, time.Time{}, 0
+	}
+	end, err := time.Parse(time.RFC3339, event.End.DateTime)
+	if err != nil {
+		return refused, time.Time{}, 0
+	}
+	duration := int(end.Sub(start).Minutes())
+	if start.Equal(appointment.StartTime) && duration == appointment.Duration {
+		return unchanged, time.Time{}, 0
+	}
+	if appointment.Status == models.StatusCancelled {
+		// the next Push deletes the event
+		return unchanged, time.Time{}, 0
+	}
+	if duration <= 0 {
+		return refused, time.Time{}, 0
+	}
+	return moved, start.In(clinic.Location), duration
+}
+
+// apply applies a change to an event of the calendar to its appointment.
+// Moved events move the appointment; if the move is refused, the event is
+// put back at the appointment's time by the next Push. Deleted events are
+// added again: appointments are only cancelled in the backend.
+func apply(ctx context.Context, db *gorm.DB, event Event) error {
+	var link models.GoogleCalendarEvent
+	err := db.Where("calendar_id = ? AND event_id = ? AND NOT deleted", CalendarID, event.ID).First(&link).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// not an appointment's event, e.g. a private appointment of the dentist
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var appointment models.Appointment
+	if err := db.First(&appointment, link.AppointmentID).Error; err != nil {
+		return err
+	}
+
+	// revert has the next Push write the appointment to its event again:
+	revert := func() error {
+		return db.Model(&link).Update("sequence", -1).Error
+	}
+	what, start, duration := remoteChange(event, appointment)
+	switch what {
+	case deleted:
+		log.Printf("the event of appointment %s was deleted in Google Calendar; adding it again\n", appointment.UUID)
+		return db.Unscoped().Delete(&link).Error
+	case refused:
+		log.Printf("the event of appointment %s was changed in Google Calendar in a way that cannot be applied; putting it back\n", appointment.UUID)
+		return revert()
+	case moved:
+		_, err = appointments.MoveAppointment(ctx, db, appointment.UUID, appointments.Move{
+			StartTime: start,
+			Duration:  duration,
+			ChangedBy: "Google Calendar",
+			Reason:    "moved in Google Calendar",
+		})
+		if err != nil {
+			log.Printf("couldn't move appointment %s as in Google Calendar: %s; putting the event back\n", appointment.UUID, err)
+			return revert()
+		}
+	}
+	return nil
+}
+
+// Watch sets up the channel Google posts change notifications on, and
+// replaces it before it expires.
+func Watch(ctx context.Context, db *gorm.DB) error {
+	if Client == nil || WebhookURL == "" {
+		return nil
+	}
+	db = db.WithContext(ctx)
+	state, err := syncState(db)
+	if err != nil {
+		return err
+	}
+	if state.ChannelExpiration != nil && time.Until(*state.ChannelExpiration) > channelRenewal {
+		return nil
+	}
+	channelID, _ := uuid.NewV7()
+	channelToken, _ := uuid.NewRandom()
+	channel, err := Client.Watch(ctx, CalendarID, Channel{
+		ID:      channelID.String(),
+		Address: WebhookURL,
+		Token:   channelToken.String(),
+	})
+	if err != nil {
+		return err
+	}
+	if state.ChannelID != "" {
+		old := Channel{ID: state.ChannelID, ResourceID: state.ResourceID}
+		if err := Client.Stop(ctx, old); err != nil {
+			log.Printf("couldn't stop Google Calendar channel %s: %s\n", state.ChannelID, err)
+		}
+	}
+	expiration := time.UnixMilli(channel.Expiration)
+	return db.Model(&state).Updates(map[string]any{
+		"channel_id":         channelID.String(),
+		"channel_token":      channelToken.String(),
+		"resource_id":        channel.ResourceID,
+		"channel_expiration": expiration,
+	}).Error
+}
+
+// Notification handles POST /google-calendar/notifications, where Google
+// announces that the calendar changed. The changes are pulled right after.
+func (h *HTTPHandler) Notification(w http.ResponseWriter, r *http.Request) {
+	var state models.GoogleCalendarSync
+	err := h.DB.Where("calendar_id = ?", CalendarID).First(&state).Error
+	if err != nil || state.ChannelID == "" || r.Header.Get("X-Goog-Channel-ID") != state.ChannelID {
+		http.Error(w, "unknown channel", http.StatusNotFound)
+		return
+	}
+	token := r.Header.Get("X-Goog-Channel-Token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(state.ChannelToken)) != 1 {
+		http.Error(w, "invalid token", http.StatusForbidden)
+		return
+	}
+	// "sync" only confirms that the channel works:
+	if r.Header.Get("X-Goog-Resource-State") != "sync" {
+		Wake()
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,589 @@
+package googlecalendar
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/driver/mysql"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// fakeGoogle is an in-memory Google Calendar behind an httptest.Server. It
+// keeps a version number per event, and sync tokens are the version the
+// calendar was at, so Changes returns what changed since.
+type fakeGoogle struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	events   map[string]*fakeEvent
+	version  int
+	nextID   int
+	pageSize int // the events per page of a list
+	calls    map[string]int
+}
+
+type fakeEvent struct {
+	Event
+	version int
+}
+
+func newFakeGoogle(t *testing.T) *fakeGoogle {
+	fake := &fakeGoogle{events: map[string]*fakeEvent{}, pageSize: 2, calls: map[string]int{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /calendars/{calendar}/events", fake.insert)
+	mux.HandleFunc("PUT /calendars/{calendar}/events/{event}", fake.update)
+	mux.HandleFunc("DELETE /calendars/{calendar}/events/{event}", fake.delete)
+	mux.HandleFunc("GET /calendars/{calendar}/events", fake.list)
+	mux.HandleFunc("POST /calendars/{calendar}/events/watch", fake.watch)
+	mux.HandleFunc("POST /channels/stop", func(w http.ResponseWriter, r *http.Request) {
+		fake.count("stop")
+		w.WriteHeader(http.StatusNoContent)
+	})
+	fake.Server = httptest.NewServer(mux)
+	t.Cleanup(fake.Close)
+	return fake
+}
+
+func (f *fakeGoogle) count(call string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.calls[call]++
+}
+
+func (f *fakeGoogle) callCount(call string) int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.calls[call]
+}
+
+func (f *fakeGoogle) client() *APIClient {
+	return &APIClient{BaseURL: f.URL, HTTPClient: f.Client()}
+}
+
+func writeFailure(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error": {"code": %d, "message": %q}}`, status, message)
+}
+
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+// save stores event as a new version.
+func (f *fakeGoogle) save(event Event) Event {
+	f.version++
+	f.events[event.ID] = &fakeEvent{Event: event, version: f.version}
+	return event
+}
+
+func (f *fakeGoogle) insert(w http.ResponseWriter, r *http.Request) {
+	f.count("insert")
+	var event Event
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		writeFailure(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.nextID++
+	event.ID = "event" + strconv.Itoa(f.nextID)
+	if event.Status == "" {
+		event.Status = "confirmed"
+	}
+	writeJSON(w, f.save(event))
+}
+
+// existing returns the event in the URL, or writes 404 if there never was
+// one, and 410 if it was deleted, as Google does.
+func (f *fakeGoogle) existing(w http.ResponseWriter, r *http.Request) *fakeEvent {
+	event, ok := f.events[r.PathValue("event")]
+	switch {
+	case !ok:
+		writeFailure(w, http.StatusNotFound, "Not Found")
+		return nil
+	case event.Status == "cancelled":
+		writeFailure(w, http.StatusGone, "Resource has been deleted")
+		return nil
+	}
+	return event
+}
+
+func (f *fakeGoogle) update(w http.ResponseWriter, r *http.Request) {
+	f.count("update")
+	var event Event
+	if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+		writeFailure(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.existing(w, r) == nil {
+		return
+	}
+	event.ID = r.PathValue("event")
+	writeJSON(w, f.save(event))
+}
+
+func (f *fakeGoogle) delete(w http.ResponseWriter, r *http.Request) {
+	f.count("delete")
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	event := f.existing(w, r)
+	if event == nil {
+		return
+	}
+	f.save(Event{ID: event.ID, Status: "cancelled"})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *fakeGoogle) list(w http.ResponseWriter, r *http.Request) {
+	f.count("list")
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	since := 0
+	if token := r.URL.Query().Get("syncToken"); token != "" {
+		var err error
+		since, err = strconv.Atoi(token)
+		if err != nil {
+			writeFailure(w, http.StatusGone, "Sync token is no longer valid, a full sync is required.")
+			return
+		}
+	}
+	var changed []*fakeEvent
+	for _, event := range f.events {
+		// a full sync leaves out deleted events:
+		if event.version > since && (since > 0 || event.Status != "cancelled") {
+			changed = append(changed, event)
+		}
+	}
+	sort.Slice(changed, func(i, j int) bool { return changed[i].version < changed[j].version })
+	offset, _ := strconv.Atoi(r.URL.Query().Get("pageToken"))
+	var page struct {
+		Items         []Event `json:"items"`
+		NextPageToken string  `json:"nextPageToken,omitempty"`
+		NextSyncToken string  `json:"nextSyncToken,omitempty"`
+	}
+	for i := offset; i < len(changed) && i < offset+f.pageSize; i++ {
+		page.Items = append(page.Items, changed[i].Event)
+	}
+	if offset+f.pageSize < len(changed) {
+		page.NextPageToken = strconv.Itoa(offset + f.pageSize)
+	} else {
+		page.NextSyncToken = strconv.Itoa(f.version)
+	}
+	writeJSON(w, page)
+}
+
+func (f *fakeGoogle) watch(w http.ResponseWriter, r *http.Request) {
+	f.count("watch")
+	var channel Channel
+	if err := json.NewDecoder(r.Body).Decode(&channel); err != nil {
+		writeFailure(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	channel.ResourceID = "resource-" + channel.ID
+	channel.Expiration = time.Now().Add(7 * 24 * time.Hour).UnixMilli()
+	writeJSON(w, channel)
+}
+
+// event returns the current state of an event.
+func (f *fakeGoogle) event(id string) (Event, bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	event, ok := f.events[id]
+	if !ok {
+		return Event{}, false
+	}
+	return event.Event, true
+}
+
+// move moves an event, as the dentist does in Google Calendar.
+func (f *fakeGoogle) move(t *testing.T, id string, start time.Time, duration int) {
+	t.Helper()
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	event, ok := f.events[id]
+	if !ok {
+		t.Fatalf("no event %s", id)
+	}
+	moved := event.Event
+	moved.Start = &EventTime{DateTime: start.Format(time.RFC3339)}
+	moved.End = &EventTime{DateTime: start.Add(time.Duration(duration) * time.Minute).Format(time.RFC3339)}
+	f.save(moved)
+}
+
+// remove deletes an event in Google Calendar, bypassing the backend.
+func (f *fakeGoogle) remove(id string) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.save(Event{ID: id, Status: "cancelled"})
+}
+
+func TestRemoteChange(t *testing.T) {
+	start := time.Date(2030, time.March, 13, 10, 0, 0, 0, clinic.Location)
+	scheduled := models.Appointment{StartTime: start, Duration: 30, Status: models.StatusScheduled}
+	cancelled := models.Appointment{StartTime: start, Duration: 30, Status: models.StatusCancelled}
+	at := func(start time.Time, duration int) Event {
+		return Event{
+			Status: "confirmed",
+			Start:  &EventTime{DateTime: start.Format(time.RFC3339)},
+			End:    &EventTime{DateTime: start.Add(time.Duration(duration) * time.Minute).Format(time.RFC3339)},
+		}
+	}
+	tests := []struct {
+		name         string
+		event        Event
+		appointment  models.Appointment
+		want         change
+		wantStart    time.Time
+		wantDuration int
+	}{
+		{"our own update", at(start, 30), scheduled, unchanged, time.Time{}, 0},
+		{"the same time in UTC", at(start.UTC(), 30), scheduled, unchanged, time.Time{}, 0},
+		{"moved", at(start.Add(2*time.Hour), 30), scheduled, moved, start.Add(2 * time.Hour), 30},
+		{"made longer", at(start, 45), scheduled, moved, start, 45},
+		{"moved after the appointment was cancelled", at(start.Add(time.Hour), 30), cancelled, unchanged, time.Time{}, 0},
+		{"deleted", Event{Status: "cancelled"}, scheduled, deleted, time.Time{}, 0},
+		{"deleted with its appointment", Event{Status: "cancelled"}, cancelled, unchanged, time.Time{}, 0},
+		{"made an all-day event", Event{Status: "confirmed", Start: &EventTime{Date: "2030-03-13"}, End: &EventTime{Date: "2030-03-14"}}, scheduled, refused, time.Time{}, 0},
+		{"ends before it starts", at(start, -30), scheduled, refused, time.Time{}, 0},
+	}
+	for _, test := range tests {
+		got, gotStart, gotDuration := remoteChange(test.event, test.appointment)
+		if got != test.want || !gotStart.Equal(test.wantStart) || gotDuration != test.wantDuration {
+			t.Errorf("%s: remoteChange = %d, %s, %d, want %d, %s, %d", test.name, got, gotStart, gotDuration, test.want, test.wantStart, test.wantDuration)
+		}
+		if got == moved && gotStart.Location() != clinic.Location {
+			t.Errorf("%s: the new start is in %s, not in the clinic's time zone", test.name, gotStart.Location())
+		}
+	}
+}
+
+// The sync tests below need a MariaDB database they may empty, e.g.
+//
+//	DENTISTBACKEND_TEST_DSN='test:test@tcp(localhost:3306)/dentist_test?parseTime=true' go test ./pkg/googlecalendar
+//
+// Without one, they are skipped.
+
+func openTestDB(t *testing.T) *gorm.DB {
+	t.Helper()
+	dsn := os.Getenv("DENTISTBACKEND_TEST_DSN")
+	if dsn == "" {
+		t.Skip("DENTISTBACKEND_TEST_DSN is not set")
+	}
+	db, err := gorm.Open(mysql.Open(dsn), &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.AutoMigrate(&models.Appointment{}, &models.Patient{}, &models.AppointmentType{}, &models.WorkingHours{}, &models.TimeOff{}, &models.HolidayOptOut{}, &models.AppointmentSeries{}, &models.AppointmentChange{}, &models.Resource{}, &models.Practitioner{}, &models.WaitlistEntry{}, &models.WaitlistOffer{}, &models.Notification{}, &models.GoogleCalendarEvent{}, &models.GoogleCalendarSync{}, &models.Charge{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, model := range []any{&models.GoogleCalendarEvent{}, &models.GoogleCalendarSync{}, &models.AppointmentChange{}, &models.Notification{},
+		&models.WaitlistOffer{}, &models.WaitlistEntry{}, &models.Charge{}, &models.Appointment{}, &models.AppointmentSeries{},
+		&models.WorkingHours{}, &models.TimeOff{}, &models.Patient{}, &models.AppointmentType{}} {
+		if err := db.Session(&gorm.Session{AllowGlobalUpdate: true}).Unscoped().Delete(model).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+// setUp points the sync to a fake Google Calendar, and books two
+// appointments on a future Wednesday, at 10:00 and 11:00.
+func setUp(t *testing.T) (*gorm.DB, *fakeGoogle, []models.Appointment) {
+	db := openTestDB(t)
+	fake := newFakeGoogle(t)
+	previous := Client
+	Client = fake.client()
+	t.Cleanup(func() { Client = previous })
+
+	patient := models.Patient{Name: "Andreas Georgiou", UUID: "0192f0c4-0000-7000-8000-000000000001"}
+	appointmentType := models.AppointmentType{Description: "Cleaning", DefaultDuration: 30, Color: "#FFD700"}
+	if err := db.Create(&patient).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Omit("Appointments", "Resources").Create(&appointmentType).Error; err != nil {
+		t.Fatal(err)
+	}
+	var booked []models.Appointment
+	for i, hour := range []int{10, 11} {
+		appointment := models.Appointment{
+			UUID:              fmt.Sprintf("0192f0c4-0000-7000-8000-1000000000%02d", i),
+			PatientID:         patient.ID,
+			AppointmentTypeID: appointmentType.ID,
+			StartTime:         time.Date(2030, time.March, 13, hour, 0, 0, 0, clinic.Location),
+			Duration:          30,
+			Status:            models.StatusScheduled,
+		}
+		if err := db.Omit("Patient", "AppointmentType", "Resource", "Practitioner").Create(&appointment).Error; err != nil {
+			t.Fatal(err)
+		}
+		booked = append(booked, appointment)
+	}
+	return db, fake, booked
+}
+
+func linkOf(t *testing.T, db *gorm.DB, appointment models.Appointment) models.GoogleCalendarEvent {
+	t.Helper()
+	var link models.GoogleCalendarEvent
+	if err := db.Unscoped().Where("appointment_id = ?", appointment.ID).First(&link).Error; err != nil {
+		t.Fatalf("appointment %s has no event: %s", appointment.UUID, err)
+	}
+	return link
+}
+
+// eventStart returns the start of the event of appointment.
+func eventStart(t *testing.T, db *gorm.DB, fake *fakeGoogle, appointment models.Appointment) time.Time {
+	t.Helper()
+	event, ok := fake.event(linkOf(t, db, appointment).EventID)
+	if !ok || event.Start == nil {
+		t.Fatalf("the event of appointment %s is not in the calendar", appointment.UUID)
+	}
+	start, err := time.Parse(time.RFC3339, event.Start.DateTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return start
+}
+
+// bump updates an appointment as the backend does, bumping its Sequence.
+func bump(t *testing.T, db *gorm.DB, appointment models.Appointment, values map[string]any) {
+	t.Helper()
+	values["sequence"] = gorm.Expr("sequence + 1")
+	if err := db.Model(&models.Appointment{}).Where("id = ?", appointment.ID).Updates(values).Error; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPush(t *testing.T) {
+	db, fake, booked := setUp(t)
+	ctx := context.Background()
+
+	// new appointments are inserted:
+	if err := Push(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.callCount("insert"); got != 2 {
+		t.Fatalf("%d events inserted, want 2", got)
+	}
+	if start := eventStart(t, db, fake, booked[0]); !start.Equal(booked[0].StartTime) {
+		t.Errorf("the event starts at %s, want %s", start, booked[0].StartTime)
+	}
+
+	// appointments whose Sequence didn't change are left alone:
+	if err := Push(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if fake.callCount("insert") != 2 || fake.callCount("update") != 0 {
+		t.Errorf("unchanged appointments were pushed again: %v", fake.calls)
+	}
+
+	// changed appointments are updated:
+	newStart := booked[0].StartTime.Add(3 * time.Hour)
+	bump(t, db, booked[0], map[string]any{"start_time": newStart})
+	if err := Push(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.callCount("update"); got != 1 {
+		t.Errorf("%d events updated, want 1", got)
+	}
+	if start := eventStart(t, db, fake, booked[0]); !start.Equal(newStart) {
+		t.Errorf("the event starts at %s, want %s", start, newStart)
+	}
+
+	// an event removed from the calendar is added again when its appointment
+	// changes, since Google answers the update with 410 Gone:
+	oldEventID := linkOf(t, db, booked[0]).EventID
+	fake.remove(oldEventID)
+	bump(t, db, booked[0], map[string]any{"duration": 45})
+	if err := Push(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	link := linkOf(t, db, booked[0])
+	if link.EventID == oldEventID {
+		t.Errorf("the removed event %s was not added again", oldEventID)
+	}
+	if event, ok := fake.event(link.EventID); !ok || event.Status == "cancelled" {
+		t.Errorf("the event %s is not in the calendar", link.EventID)
+	}
+
+	// cancelled appointments are deleted, even if their event is already gone:
+	fake.remove(linkOf(t, db, booked[1]).EventID)
+	bump(t, db, booked[0], map[string]any{"status": models.StatusCancelled})
+	bump(t, db, booked[1], map[string]any{"status": models.StatusCancelled})
+	if err := Push(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	for _, appointment := range booked {
+		link := linkOf(t, db, appointment)
+		if !link.Deleted {
+			t.Errorf("the event of cancelled appointment %s was not marked deleted", appointment.UUID)
+		}
+		if event, _ := fake.event(link.EventID); event.Status != "cancelled" {
+			t.Errorf("the event of cancelled appointment %s is still in the calendar", appointment.UUID)
+		}
+	}
+	deletes := fake.callCount("delete")
+	if err := Push(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if fake.callCount("delete") != deletes {
+		t.Errorf("deleted events were deleted again")
+	}
+}
+
+func TestPullMovesAppointment(t *testing.T) {
+	db, fake, booked := setUp(t)
+	ctx := context.Background()
+	if err := Push(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := Pull(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// the dentist drags the first appointment to 15:00 and makes it longer:
+	newStart := time.Date(2030, time.March, 13, 15, 0, 0, 0, clinic.Location)
+	fake.move(t, linkOf(t, db, booked[0]).EventID, newStart, 45)
+	if err := Pull(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	var moved models.Appointment
+	if err := db.First(&moved, booked[0].ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !moved.StartTime.Equal(newStart) || moved.Duration != 45 {
+		t.Fatalf("the appointment is at %s for %d minutes, want %s for 45", moved.StartTime, moved.Duration, newStart)
+	}
+	if moved.Sequence <= booked[0].Sequence {
+		t.Errorf("the move did not bump the appointment's Sequence")
+	}
+	var history []models.AppointmentChange
+	db.Where("appointment_id = ?", moved.ID).Find(&history)
+	if len(history) != 1 || history[0].ChangedBy != "Google Calendar" || !history[0].OldStartTime.Equal(booked[0].StartTime) {
+		t.Errorf("the move was not recorded in the history: %+v", history)
+	}
+
+	// the bumped Sequence has the move pushed back once, which comes back
+	// from Google as an unchanged event:
+	updates := fake.callCount("update")
+	if err := Push(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if fake.callCount("update") != updates+1 {
+		t.Errorf("the moved appointment was not pushed")
+	}
+	if err := Pull(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&models.AppointmentChange{}).Where("appointment_id = ?", moved.ID).Find(&history).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 1 {
+		t.Errorf("our own update was applied as another move: %+v", history)
+	}
+}
+
+func TestPullRevertsRefusedMove(t *testing.T) {
+	db, fake, booked := setUp(t)
+	ctx := context.Background()
+	if err := Push(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := Pull(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first appointment is dragged onto the second one:
+	fake.move(t, linkOf(t, db, booked[0]).EventID, booked[1].StartTime, 30)
+	if err := Pull(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	var unmoved models.Appointment
+	if err := db.First(&unmoved, booked[0].ID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if !unmoved.StartTime.Equal(booked[0].StartTime) {
+		t.Fatalf("the overlapping move was applied: the appointment is at %s", unmoved.StartTime)
+	}
+	if link := linkOf(t, db, booked[0]); link.Sequence >= unmoved.Sequence {
+		t.Errorf("the event is not marked for a push: its sequence is %d, the appointment's %d", link.Sequence, unmoved.Sequence)
+	}
+
+	// the next push puts the event back:
+	if err := Push(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if start := eventStart(t, db, fake, booked[0]); !start.Equal(booked[0].StartTime) {
+		t.Errorf("the event was not put back: it starts at %s, want %s", start, booked[0].StartTime)
+	}
+}
+
+func TestPullReaddsDeletedEvent(t *testing.T) {
+	db, fake, booked := setUp(t)
+	ctx := context.Background()
+	if err := Push(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := Pull(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	oldEventID := linkOf(t, db, booked[0]).EventID
+	fake.remove(oldEventID)
+	if err := Pull(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	var appointment models.Appointment
+	db.First(&appointment, booked[0].ID)
+	if appointment.Status != models.StatusScheduled {
+		t.Errorf("deleting the event changed the appointment to %s", appointment.Status)
+	}
+	if err := Push(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if link := linkOf(t, db, booked[0]); link.EventID == oldEventID {
+		t.Errorf("the deleted event was not added again")
+	}
+}
+
+func TestPullStartsOverWhenTheSyncTokenExpires(t *testing.T) {
+	db, fake, booked := setUp(t)
+	ctx := context.Background()
+	if err := Push(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	state, err := syncState(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Model(&state).Update("sync_token", "expired").Error; err != nil {
+		t.Fatal(err)
+	}
+	newStart := time.Date(2030, time.March, 13, 16, 0, 0, 0, clinic.Location)
+	fake.move(t, linkOf(t, db, booked[1]).EventID, newStart, 30)
+	if err := Pull(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	var moved models.Appointment
+	db.First(&moved, booked[1].ID)
+	if !moved.StartTime.Equal(newStart) {
+		t.Errorf("the appointment is at %s, want %s", moved.StartTime, newStart)
+	}
+	if state, _ = syncState(db); state.SyncToken == "expired" || state.SyncToken == "" {
+		t.Errorf("the sync token is %q after a full sync", state.SyncToken)
+	}
+}
@@ -0,0 +1,313 @@
+package holidays
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+type HTTPHandler struct {
+	DB  *gorm.DB
+	Ctx context.Context
+}
+
+// Holiday is a Cyprus public holiday on a particular date.
+type Holiday struct {
+	Key       string // stable identifier, used to opt out of the holiday
+	Name      string
+	NameGreek string
+	Date      time.Time // midnight at the start of the holiday
+}
+
+// holidayWithWarnings is a holiday as returned by the API: whether the clinic
+// is closed on it, and any appointments already booked on it.
+type holidayWithWarnings struct {
+	Holiday
+	Observed     bool
+	Appointments []models.Appointment
+}
+
+type optOutRequest struct {
+	// a structure to hold the year a holiday opt-out applies to
+	Year int // 0 means every year
+}
+
+type fixedHoliday struct {
+	key, name, nameGreek string
+	month                time.Month
+	day                  int
+}
+
+type easterHoliday struct {
+	key, name, nameGreek string
+	offset               int // days after Orthodox Easter Sunday
+}
+
+var fixedHolidays = []fixedHoliday{
+	{"new-year", "New Year's Day", "Πρωτοχρονιά", time.January, 1},
+	{"epiphany", "Epiphany", "Θεοφάνεια", time.January, 6},
+	{"greek-independence-day", "Greek Independence Day", "Ευαγγελισμός της Θεοτόκου - Εθνική Επέτειος", time.March, 25},
+	{"cyprus-national-day", "Cyprus National Day", "Εθνική Επέτειος της Κύπρου", time.April, 1},
+	{"labour-day", "Labour Day", "Πρωτομαγιά", time.May, 1},
+	{"assumption", "Assumption of Mary", "Κοίμηση της Θεοτόκου", time.August, 15},
+	{"cyprus-independence-day", "Cyprus Independence Day", "Ημέρα της Κυπριακής Ανεξαρτησίας", time.October, 1},
+	{"ochi-day", "Ochi Day", "Επέτειος του Όχι", time.October, 28},
+	{"christmas", "Christmas Day", "Χριστούγεννα", time.December, 25},
+	{"boxing-day", "Boxing Day", "Σύναξη της Θεοτόκου", time.December, 26},
+}
+
+var easterHolidays = []easterHoliday{
+	{"green-monday", "Green Monday", "Καθαρά Δευτέρα", -48},
+	{"good-friday", "Orthodox Good Friday", "Μεγάλη Παρασκευή", -2},
+	{"easter-sunday", "Orthodox Easter Sunday", "Κυριακή του Πάσχα", 0},
+	{"easter-monday", "Orthodox Easter Monday", "Δευτέρα του Πάσχα", 1},
+	{"easter-tuesday", "Orthodox Easter Tuesday", "Τρίτη της Διακαινησίμου", 2},
+	{"pentecost-monday", "Pentecost Monday (Kataklysmos)", "Αγίου Πνεύματος - Κατακλυσμός", 50},
+}
+
+// OrthodoxEaster returns the date of Orthodox Easter Sunday in year, in the
+// Gregorian calendar. It uses Meeus' Julian Easter algorithm and converts the
+// result from the Julian calendar.
+func OrthodoxEaster(year int, location *time.Location) time.Time {
+	a := year % 4
+	b := year % 7
+	c := year % 19
+	d := (19*c + 15) % 30
+	e := (2*a + 4*b - d + 34) % 7
+	month := (d + e + 114) / 31
+	day := (d+e+114)%31 + 1
+	// days between the Julian and the Gregorian calendar (13 for 1900-2099):
+	julianOffset := year/100 - year/400 - 2
+	return time.Date(year, time.Month(month), day+julianOffset, 0, 0, 0, 0, location)
+}
+
+// Cyprus returns the Cyprus public holidays of year, in date order.
+func Cyprus(year int, location *time.Location) []Holiday {
+	easter := OrthodoxEaster(year, location)
+	var holidays []Holiday
+	for _, h := range fixedHolidays {
+		holidays = append(holidays, Holiday{
+			Key:       h.key,
+			Name:      h.name,
+			NameGreek: h.nameGreek,
+			Date:      time.Date(year, h.month, h.day, 0, 0, 0, 0, location),
+		})
+	}
+	for _, h := range easterHolidays {
+		holidays = append(holidays, Holiday{
+			Key:       h.key,
+			Name:      h.name,
+			NameGreek: h.nameGreek,
+			Date:      easter.AddDate(0, 0, h.offset),
+		})
+	}
+	sort.Slice(holidays, func(i, j int) bool { return holidays[i].Date.Before(holidays[j].Date) })
+	return holidays
+}
+
+func isKnownKey(key string) bool {
+	for _, h := range fixedHolidays {
+		if h.key == key {
+			return true
+		}
+	}
+	for _, h := range easterHolidays {
+		if h.key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Observed returns the holidays between from and to (exclusive) on which the
+// clinic is closed, i.e. all holidays the dentist has not opted out of.
+func Observed(db *gorm.DB, from, to time.Time) ([]Holiday, error) {
+	var optOuts []models.HolidayOptOut
+	err := db.Find(&optOuts).Error
+	if err != nil {
+		return nil, err
+	}
+	var observed []Holiday
+	for year := from.In(clinic.Location).Year(); year <= to.In(clinic.Location).Year(); year++ {
+		for _, holiday := range Cyprus(year, clinic.Location) {
+			if !holiday.Date.AddDate(0, 0, 1).After(from) || !holiday.Date.Before(to) {
+				continue
+			}
+			if !optedOut(optOuts, holiday) {
+				observed = append(observed, holiday)
+			}
+		}
+	}
+	return observed, nil
+}
+
+func optedOut(optOuts []models.HolidayOptOut, holiday Holiday) bool {
+	for _, optOut := range optOuts {
+		if optOut.Key == holiday.Key && (optOut.Year == 0 || optOut.Year == holiday.Date.Year()) {
+			return true
+		}
+	}
+	return false
+}
+
+// appointmentsOn returns the appointments booked on the day of holiday,
+// leaving out the cancelled ones.
+func appointmentsOn(db *gorm.DB, holiday Holiday) ([]models.Appointment, error) {
+	var appointments []models.Appointment
+	err := db.Preload("Patient").Preload("AppointmentType").
+		Where("start_time >= ? AND start_time < ?", holiday.Date, holiday.Date.AddDate(0, 0, 1)).
+		Where("status <> ?", models.StatusCancelled).
+		Order("start_time asc").
+		Find(&appointments).Error
+	return appointments, err
+}
+
+// WarnAboutBookedHolidays logs every appointment booked on an observed
+// holiday between from and to, so that they can be moved.
+func WarnAboutBookedHolidays(db *gorm.DB, from, to time.Time) error {
+	observed, err := Observed(db, from, to)
+	if err != nil {
+		return err
+	}
+	for _, holiday := range observed {
+		appointments, err := appointmentsOn(db, holiday)
+		if err != nil {
+			return err
+		}
+		for _, appointment := range appointments {
+			log.Printf("Warning: appointment %s (%s) at %s falls on %s (%s)\n",
+				appointment.UUID, appointment.Patient.Name, appointment.StartTime.Format("02 Jan 2006 15:04"), holiday.Name, holiday.NameGreek)
+		}
+	}
+	return nil
+}
+
+// ListHolidays handles GET /holidays?year=2025. Each holiday says whether the
+// clinic is closed on it, and lists the appointments already booked on it.
+func (h *HTTPHandler) ListHolidays(w http.ResponseWriter, r *http.Request) {
+	year := clinic.Now().Year()
+	if value := r.URL.Query().Get("year"); value != "" {
+		var err error
+		year, err = strconv.Atoi(value)
+		if err != nil || year < 1900 || year > 2099 {
+			http.Error(w, fmt.Sprintf("invalid year %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var optOuts []models.HolidayOptOut
+	err := h.DB.Find(&optOuts).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response := []holidayWithWarnings{}
+	for _, holiday := range Cyprus(year, clinic.Location) {
+		appointments, err := appointmentsOn(h.DB, holiday)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		response = append(response, holidayWithWarnings{
+			Holiday:      holiday,
+			Observed:     !optedOut(optOuts, holiday),
+			Appointments: appointments,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// OptOut handles PUT /holidays/{key}/opt-out: the clinic stays open on that
+// holiday, either in the given Year or (with Year 0) every year.
+func (h *HTTPHandler) OptOut(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	if !isKnownKey(key) {
+		http.Error(w, fmt.Sprintf("unknown holiday %q", key), http.StatusNotFound)
+		return
+	}
+	var request optOutRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	optOut := models.HolidayOptOut{Key: key, Year: request.Year}
+	err := h.DB.Clauses(clause.OnConflict{DoNothing: true}).Create(&optOut).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(optOut)
+}
+
+// OptIn handles DELETE /holidays/{key}/opt-out?year=2025, closing the clinic
+// on the holiday again. Without a year, the every-year opt-out is removed.
+// The response lists the appointments already booked on the holiday.
+func (h *HTTPHandler) OptIn(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	if !isKnownKey(key) {
+		http.Error(w, fmt.Sprintf("unknown holiday %q", key), http.StatusNotFound)
+		return
+	}
+	year := 0
+	if value := r.URL.Query().Get("year"); value != "" {
+		var err error
+		year, err = strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid year %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+
+	err := h.DB.Unscoped().Where("`key` = ? AND year = ?", key, year).Delete(&models.HolidayOptOut{}).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// warn about appointments booked on the holiday, which is now closed:
+	from := time.Date(year, time.January, 1, 0, 0, 0, 0, clinic.Location)
+	to := from.AddDate(1, 0, 0)
+	if year == 0 {
+		from = time.Now()
+		to = from.AddDate(1, 0, 0)
+	}
+	observed, err := Observed(h.DB, from, to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var warnings []models.Appointment
+	for _, holiday := range observed {
+		if holiday.Key != key {
+			continue
+		}
+		appointments, err := appointmentsOn(h.DB, holiday)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		warnings = append(warnings, appointments...)
+	}
+	if warnings == nil {
+		warnings = []models.Appointment{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(warnings)
+}
@@ -0,0 +1,83 @@
+package holidays
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOrthodoxEaster(t *testing.T) {
+	tests := []struct {
+		year int
+		want string
+	}{
+		{2021, "2021-05-02"},
+		{2023, "2023-04-16"},
+		{2024, "2024-05-05"},
+		{2025, "2025-04-20"},
+		{2026, "2026-04-12"},
+		{2027, "2027-05-02"},
+	}
+	for _, test := range tests {
+		easter := OrthodoxEaster(test.year, time.UTC)
+		if got := easter.Format("2006-01-02"); got != test.want {
+			t.Errorf("OrthodoxEaster(%d) = %s, want %s", test.year, got, test.want)
+		}
+		if easter.Weekday() != time.Sunday {
+			t.Errorf("OrthodoxEaster(%d) is a %s", test.year, easter.Weekday())
+		}
+	}
+}
+
+func TestCyprusEasterHolidays(t *testing.T) {
+	tests := []struct {
+		year int
+		key  string
+		want string
+	}{
+		{2024, "green-monday", "2024-03-18"},
+		{2024, "good-friday", "2024-05-03"},
+		{2024, "pentecost-monday", "2024-06-24"},
+		{2025, "green-monday", "2025-03-03"},
+		{2025, "easter-monday", "2025-04-21"},
+		{2025, "easter-tuesday", "2025-04-22"},
+		{2025, "pentecost-monday", "2025-06-09"},
+		{2026, "green-monday", "2026-02-23"},
+		{2026, "good-friday", "2026-04-10"},
+		{2026, "pentecost-monday", "2026-06-01"},
+	}
+	location, err := time.LoadLocation("Asia/Nicosia")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range tests {
+		var found *Holiday
+		for _, holiday := range Cyprus(test.year, location) {
+			if holiday.Key == test.key {
+				found = &holiday
+			}
+		}
+		if found == nil {
+			t.Errorf("Cyprus(%d) has no %s", test.year, test.key)
+			continue
+		}
+		if got := found.Date.Format("2006-01-02"); got != test.want {
+			t.Errorf("%s %d = %s, want %s", test.key, test.year, got, test.want)
+		}
+		if found.Date.Hour() != 0 || found.Date.Location() != location {
+			t.Errorf("%s %d = %s, want midnight in %s", test.key, test.year, found.Date, location)
+		}
+	}
+}
+
+func TestCyprusIsSorted(t *testing.T) {
+	holidays := Cyprus(2025, time.UTC)
+	if len(holidays) != len(fixedHolidays)+len(easterHolidays) {
+		t.Fatalf("Cyprus(2025) has %d holidays, want %d", len(holidays), len(fixedHolidays)+len(easterHolidays))
+	}
+	for i := 1; i < len(holidays); i++ {
+		if holidays[i].Date.Before(holidays[i-1].Date) {
+			t.Errorf("%s (%s) comes after %s (%s)", holidays[i].Key, holidays[i].Date.Format("2006-01-02"),
+				holidays[i-1].Key, holidays[i-1].Date.Format("2006-01-02"))
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package ical
+
+import (
+	"strconv"
+	"strings"
+)
+
+// cssColors are the CSS colour names calendar apps understand, with their
+// RGB values.
+var cssColors = []struct {
+	name    string
+	r, g, b int
+}{
+	{"black", 0x00, 0x00, 0x00},
+	{"gray", 0x80, 0x80, 0x80},
+	{"silver", 0xC0, 0xC0, 0xC0},
+	{"white", 0xFF, 0xFF, 0xFF},
+	{"maroon", 0x80, 0x00, 0x00},
+	{"red", 0xFF, 0x00, 0x00},
+	{"crimson", 0xDC, 0x14, 0x3C},
+	{"indianred", 0xCD, 0x5C, 0x5C},
+	{"salmon", 0xFA, 0x80, 0x72},
+	{"coral", 0xFF, 0x7F, 0x50},
+	{"tomato", 0xFF, 0x63, 0x47},
+	{"orangered", 0xFF, 0x45, 0x00},
+	{"orange", 0xFF, 0xA5, 0x00},
+	{"gold", 0xFF, 0xD7, 0x00},
+	{"yellow", 0xFF, 0xFF, 0x00},
+	{"khaki", 0xF0, 0xE6, 0x8C},
+	{"wheat", 0xF5, 0xDE, 0xB3},
+	{"tan", 0xD2, 0xB4, 0x8C},
+	{"chocolate", 0xD2, 0x69, 0x1E},
+	{"sienna", 0xA0, 0x52, 0x2D},
+	{"brown", 0xA5, 0x2A, 0x2A},
+	{"olive", 0x80, 0x80, 0x00},
+	{"yellowgreen", 0x9A, 0xCD, 0x32},
+	{"lime", 0x00, 0xFF, 0x00},
+	{"limegreen", 0x32, 0xCD, 0x32},
+	{"lightgreen", 0x90, 0xEE, 0x90},
+	{"green", 0x00, 0x80, 0x00},
+	{"seagreen", 0x2E, 0x8B, 0x57},
+	{"teal", 0x00, 0x80, 0x80},
+	{"turquoise", 0x40, 0xE0, 0xD0},
+	{"aqua", 0x00, 0xFF, 0xFF},
+	{"lightblue", 0xAD, 0xD8, 0xE6},
+	{"skyblue", 0x87, 0xCE, 0xEB},
+	{"steelblue", 0x46, 0x82, 0xB4},
+	{"royalblue", 0x41, 0x69, 0xE1},
+	{"blue", 0x00, 0x00, 0xFF},
+	{"navy", 0x00, 0x00, 0x80},
+	{"slateblue", 0x6A, 0x5A, 0xCD},
+	{"purple", 0x80, 0x00, 0x80},
+	{"orchid", 0xDA, 0x70, 0xD6},
+	{"violet", 0xEE, 0x82, 0xEE},
+	{"plum", 0xDD, 0xA0, 0xDD},
+	{"fuchsia", 0xFF, 0x00, 0xFF},
+	{"hotpink", 0xFF, 0x69, 0xB4},
+	{"pink", 0xFF, 0xC0, 0xCB},
+	{"lavender", 0xE6, 0xE6, 0xFA},
+}
+
+// ColorName returns the CSS colour name closest to a "#RRGGBB" colour, e.g.
+// "indianred" for "#CD5C5C", or "" if color is not in that form.
+func ColorName(color string) string {
+	if len(color) != 7 || !strings.HasPrefix(color, "#") {
+		return ""
+	}
+	rgb, err := strconv.ParseUint(color[1:], 16, 32)
+	if err != nil {
+		return ""
+	}
+	r, g, b := int(rgb>>16), int(rgb>>8&0xFF), int(rgb&0xFF)
+	best, bestDistance := "", -1
+	for _, c := range cssColors {
+		distance := (r-c.r)*(r-c.r) + (g-c.g)*(g-c.g) + (b-c.b)*(b-c.b)
+		if bestDistance < 0 || distance < bestDistance {
+			best, bestDistance = c.name, distance
+		}
+	}
+	return best
+}
@@ -0,0 +1,87 @@
+package ical
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/gorm"
+)
+
+type HTTPHandler struct {
+	DB  *gorm.DB
+	Ctx context.Context
+}
+
+// FeedToken is the secret that subscribers put in the feed URL. The feed is
+// switched off while it is empty.
+var FeedToken = ""
+
+// feedHistoryDays is how far back the feed goes. Later appointments are all
+// included.
+const feedHistoryDays = 90
+
+// feedRefresh is how often subscribers are asked to fetch the feed again.
+const feedRefresh = 15 * time.Minute
+
+// Feed handles GET /calendar.ics?token=..., an iCalendar feed of the
+// appointments that calendar apps can subscribe to. Cancelled appointments
+// are left out. The optional practitioner and type parameters (IDs) limit
+// the feed to one practitioner's appointments or one appointment type.
+func (h *HTTPHandler) Feed(w http.ResponseWriter, r *http.Request) {
+	if FeedToken == "" {
+		http.Error(w, "the calendar feed is not configured", http.StatusNotFound)
+		return
+	}
+	token := r.URL.Query().Get("token")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(FeedToken)) != 1 {
+		http.Error(w, "invalid token", http.StatusUnauthorized)
+		return
+	}
+
+	query := h.DB.Preload("Patient").Preload("AppointmentType").Preload("Resource").Preload("Practitioner").
+		Where("start_time >= ?", clinic.StartOfDay(time.Now()).AddDate(0, 0, -feedHistoryDays)).
+		Where("status <> ?", models.StatusCancelled)
+	name := "Appointments"
+	for _, key := range []string{"practitioner", "type"} {
+		value := r.URL.Query().Get(key)
+		if value == "" {
+			continue
+		}
+		id, err := strconv.ParseUint(value, 10, 0)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid %s %q", key, value), http.StatusBadRequest)
+			return
+		}
+		if key == "practitioner" {
+			var practitioner models.Practitioner
+			if err := h.DB.First(&practitioner, id).Error; err != nil {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			}
+			query = query.Where("practitioner_id = ?", id)
+			name += " - " + practitioner.Name
+		} else {
+			query = query.Where("appointment_type_id = ?", id)
+		}
+	}
+	var appointments []models.Appointment
+	err := query.Order("start_time asc").Find(&appointments).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	events := make([]Event, len(appointments))
+	for i, appointment := range appointments {
+		events[i] = EventFor(appointment)
+	}
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="calendar.ics"`)
+	Write(w, Calendar{Name: name, Method: "PUBLISH", TimeZone: clinic.Location.String(), RefreshInterval: feedRefresh}, events)
+}
@@ -0,0 +1,195 @@
+// Package ical renders appointments as iCalendar (RFC 5545) data, for
+// calendar apps that subscribe to the schedule.
+package ical
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ipmess/dentistbackend/pkg/models"
+)
+
+// ProductID identifies this backend in the iCalendar data it produces.
+const ProductID = "-//dentistbackend//appointments//EN"
+
+// UIDSuffix makes the UIDs of appointment events globally unique.
+const UIDSuffix = "@dentistbackend"
+
+// Event is a VEVENT.
+type Event struct {
+	UID         string
+	Sequence    int
+	Stamp       time.Time // DTSTAMP: when the event last changed
+	Start       time.Time
+	End         time.Time
+	Summary     string
+	Description string
+	Categories  []string
+	Color       string // a CSS colour name (RFC 7986)
+	Status      string // TENTATIVE, CONFIRMED or CANCELLED
+}
+
+// UID returns the UID of the event for an appointment, which stays the same
+// for as long as the appointment exists.
+func UID(appointment models.Appointment) string {
+	return appointment.UUID + UIDSuffix
+}
+
+// EventFor returns the event for appointment, whose Patient and
+// AppointmentType must be loaded. The summary shows the patient and the
+// appointment type; the type's colour becomes a category, so calendar apps
+// can colour the events by type.
+func EventFor(appointment models.Appointment) Event {
+	event := Event{
+		UID:      UID(appointment),
+		Sequence: appointment.Sequence,
+		Stamp:    appointment.UpdatedAt,
+		Start:    appointment.StartTime,
+		End:      appointment.StartTime.Add(time.Duration(appointment.Duration) * time.Minute),
+		Summary:  appointment.Patient.Name + " - " + appointment.AppointmentType.Description,
+		Status:   "TENTATIVE",
+	}
+	var details []string
+	details = append(details, fmt.Sprintf("%s, %d minutes", appointment.AppointmentType.Description, appointment.Duration))
+	if appointment.Patient.PhoneNumber != "" {
+		details = append(details, "Phone: "+appointment.Patient.PhoneNumber)
+	}
+	if appointment.Practitioner != nil {
+		details = append(details, "With: "+appointment.Practitioner.Name)
+	}
+	if appointment.Resource != nil {
+		details = append(details, "Room: "+appointment.Resource.Name)
+	}
+	details = append(details, "Status: "+string(appointment.Status))
+	event.Description = strings.Join(details, "\n")
+
+	event.Categories = []string{appointment.AppointmentType.Description}
+	if color := ColorName(appointment.AppointmentType.Color); color != "" {
+		event.Color = color
+		event.Categories = append(event.Categories, color)
+	}
+	switch appointment.Status {
+	case models.StatusScheduled, "":
+	case models.StatusCancelled:
+		event.Status = "CANCELLED"
+	default:
+		event.Status = "CONFIRMED"
+	}
+	return event
+}
+
+// Calendar holds the properties of a VCALENDAR.
+type Calendar struct {
+	Name            string        // X-WR-CALNAME
+	Method          string        // e.g. PUBLISH for a feed; empty for a stored calendar object
+	TimeZone        string        // X-WR-TIMEZONE, for display only: events are in UTC
+	RefreshInterval time.Duration // how often subscribers should fetch the calendar again
+}
+
+// Write writes calendar with events to w.
+func Write(w io.Writer, calendar Calendar, events []Event) error {
+	lw := &lineWriter{w: w}
+	lw.line("BEGIN", "VCALENDAR")
+	lw.line("VERSION", "2.0")
+	lw.line("PRODID", ProductID)
+	lw.line("CALSCALE", "GREGORIAN")
+	if calendar.Method != "" {
+		lw.line("METHOD", calendar.Method)
+	}
+	if calendar.Name != "" {
+		lw.line("X-WR-CALNAME", escape(calendar.Name))
+	}
+	if calendar.TimeZone != "" {
+		lw.line("X-WR-TIMEZONE", calendar.TimeZone)
+	}
+	if calendar.RefreshInterval > 0 {
+		minutes := int(calendar.RefreshInterval.Minutes())
+		lw.line("REFRESH-INTERVAL;VALUE=DURATION", fmt.Sprintf("PT%dM", minutes))
+		lw.line("X-PUBLISHED-TTL", fmt.Sprintf("PT%dM", minutes))
+	}
+	for _, event := range events {
+		WriteEvent(lw, event)
+	}
+	lw.line("END", "VCALENDAR")
+	return lw.err
+}
+
+// WriteEvent writes a single VEVENT to w.
+func WriteEvent(w io.Writer, event Event) error {
+	lw, ok := w.(*lineWriter)
+	if !ok {
+		lw = &lineWriter{w: w}
+	}
+	lw.line("BEGIN", "VEVENT")
+	lw.line("UID", escape(event.UID))
+	lw.line("SEQUENCE", fmt.Sprint(event.Sequence))
+	lw.line("DTSTAMP", FormatTime(event.Stamp))
+	lw.line("DTSTART", FormatTime(event.Start))
+	lw.line("DTEND", FormatTime(event.End))
+	lw.line("SUMMARY", escape(event.Summary))
+	if event.Description != "" {
+		lw.line("DESCRIPTION", escape(event.Description))
+	}
+	if len(event.Categories) > 0 {
+		escaped := make([]string, len(event.Categories))
+		for i, category := range event.Categories {
+			escaped[i] = escape(category)
+		}
+		lw.line("CATEGORIES", strings.Join(escaped, ","))
+	}
+	if event.Color != "" {
+		lw.line("COLOR", event.Color)
+	}
+	if event.Status != "" {
+		lw.line("STATUS", event.Status)
+	}
+	lw.line("END", "VEVENT")
+	return lw.err
+}
+
+// FormatTime formats t as a UTC date-time, e.g. 20250312T083000Z.
+func FormatTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// escape escapes a TEXT value.
+func escape(text string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(text)
+}
+
+// lineWriter writes content lines, folded at 75 octets and ended with CRLF.
+// It keeps the first error and skips the writes after it.
+type lineWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (lw *lineWriter) Write(p []byte) (int, error) {
+	if lw.err != nil {
+		return 0, lw.err
+	}
+	n, err := lw.w.Write(p)
+	lw.err = err
+	return n, err
+}
+
+func (lw *lineWriter) line(name, value string) {
+	line := name + ":" + value
+	var folded strings.Builder
+	width := 0
+	for _, r := range line {
+		size := utf8.RuneLen(r)
+		if width+size > 75 {
+			// continuation lines start with a space, which counts:
+			folded.WriteString("\r\n ")
+			width = 1
+		}
+		folded.WriteRune(r)
+		width += size
+	}
+	folded.WriteString("\r\n")
+	io.WriteString(lw, folded.String())
+}
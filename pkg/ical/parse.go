@@ -0,0 +1,271 @@
+package ical
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/rrule"
+)
+
+// maxOccurrences is how many occurrences of a recurring event Parse expands.
+const maxOccurrences = 100
+
+// ParsedEvent is a VEVENT read from an iCalendar file. Recurring events are
+// expanded into one ParsedEvent per occurrence, with the same UID.
+type ParsedEvent struct {
+	UID         string
+	Summary     string
+	Description string
+	Location    string
+	Start       time.Time
+	End         time.Time
+	AllDay      bool
+	Emails      []string // of the attendees and organizer
+	Status      string
+	Recurring   bool
+	// Warnings lists what could not be read from the event.
+	Warnings []string `json:",omitempty"`
+}
+
+// property is a content line: NAME;PARAM=value:VALUE.
+type property struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+// Parse reads the events of an iCalendar file. Times with a TZID that is not
+// known (e.g. the Windows time zone names Outlook uses) and floating times
+// are taken to be on the clinic's wall clock.
+func Parse(r io.Reader) ([]ParsedEvent, error) {
+	lines, err := unfold(r)
+	if err != nil {
+		return nil, err
+	}
+	var events []ParsedEvent
+	var current []property
+	inEvent, nested := false, 0
+	for _, line := range lines {
+		prop, err := parseLine(line)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case prop.name == "BEGIN" && strings.EqualFold(prop.value, "VEVENT"):
+			inEvent, current = true, nil
+		case prop.name == "END" && strings.EqualFold(prop.value, "VEVENT"):
+			if !inEvent {
+				return nil, fmt.Errorf("END:VEVENT without BEGIN:VEVENT")
+			}
+			inEvent = false
+			events = append(events, expandEvent(current)...)
+		case inEvent && prop.name == "BEGIN":
+			// skip components inside events, such as VALARM
+			nested++
+		case inEvent && prop.name == "END":
+			nested--
+		case inEvent && nested == 0:
+			current = append(current, prop)
+		}
+	}
+	if inEvent {
+		return nil, fmt.Errorf("missing END:VEVENT")
+	}
+	return events, nil
+}
+
+// unfold joins folded lines.
+func unfold(r io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	var lines []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(line) > 0 && (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func parseLine(line string) (property, error) {
+	prop := property{params: map[string]string{}}
+	// the value starts at the first colon outside quoted parameter values:
+	quoted, colon := false, -1
+	for i, c := range line {
+		if c == '"' {
+			quoted = !quoted
+		}
+		if c == ':' && !quoted {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return prop, fmt.Errorf("invalid content line %q", line)
+	}
+	prop.value = line[colon+1:]
+	parts := strings.Split(line[:colon], ";")
+	prop.name = strings.ToUpper(parts[0])
+	for _, param := range parts[1:] {
+		key, value, _ := strings.Cut(param, "=")
+		prop.params[strings.ToUpper(key)] = strings.Trim(value, `"`)
+	}
+	return prop, nil
+}
+
+// unescape decodes a TEXT value.
+func unescape(text string) string {
+	return strings.NewReplacer(`\\`, `\`, `\;`, ";", `\,`, ",", `\n`, "\n", `\N`, "\n").Replace(text)
+}
+
+var emailPattern = regexp.MustCompile(`(?i)mailto:([^\s;,]+)`)
+
+// expandEvent builds the events of a VEVENT: one, or one per occurrence if it
+// recurs.
+func expandEvent(props []property) []ParsedEvent {
+	var event ParsedEvent
+	var duration time.Duration
+	var rule string
+	var excluded []time.Time
+	for _, prop := range props {
+		switch prop.name {
+		case "UID":
+			event.UID = prop.value
+		case "SUMMARY":
+			event.Summary = unescape(prop.value)
+		case "DESCRIPTION":
+			event.Description = unescape(prop.value)
+		case "LOCATION":
+			event.Location = unescape(prop.value)
+		case "STATUS":
+			event.Status = strings.ToUpper(prop.value)
+		case "ATTENDEE", "ORGANIZER":
+			if match := emailPattern.FindStringSubmatch(prop.value); match != nil {
+				event.Emails = append(event.Emails, strings.ToLower(match[1]))
+			}
+		case "DTSTART":
+			start, allDay, err := parseTime(prop)
+			if err != nil {
+				event.Warnings = append(event.Warnings, err.Error())
+			}
+			event.Start, event.AllDay = start, allDay
+		case "DTEND":
+			end, _, err := parseTime(prop)
+			if err != nil {
+				event.Warnings = append(event.Warnings, err.Error())
+			}
+			event.End = end
+		case "DURATION":
+			d, err := parseDuration(prop.value)
+			if err != nil {
+				event.Warnings = append(event.Warnings, err.Error())
+			}
+			duration = d
+		case "RRULE":
+			rule = prop.value
+		case "EXDATE":
+			for _, value := range strings.Split(prop.value, ",") {
+				t, _, err := parseTime(property{params: prop.params, value: value})
+				if err == nil {
+					excluded = append(excluded, t)
+				}
+			}
+		}
+	}
+	if event.End.IsZero() && !event.Start.IsZero() {
+		event.End = event.Start.Add(duration)
+	}
+	if rule == "" || event.Start.IsZero() {
+		return []ParsedEvent{event}
+	}
+
+	parsed, err := rrule.Parse(rule)
+	if err != nil {
+		event.Warnings = append(event.Warnings, fmt.Sprintf("unsupported recurrence %q: only the first occurrence is imported", rule))
+		return []ParsedEvent{event}
+	}
+	starts, more := parsed.All(event.Start, maxOccurrences)
+	length := event.End.Sub(event.Start)
+	var events []ParsedEvent
+	for _, start := range starts {
+		skip := false
+		for _, exdate := range excluded {
+			if exdate.Equal(start) {
+				skip = true
+			}
+		}
+		if skip {
+			continue
+		}
+		occurrence := event
+		occurrence.Recurring = true
+		occurrence.Start = start
+		occurrence.End = start.Add(length)
+		if more {
+			occurrence.Warnings = append(append([]string{}, event.Warnings...), fmt.Sprintf("only the first %d occurrences are imported", maxOccurrences))
+		}
+		events = append(events, occurrence)
+	}
+	return events
+}
+
+// parseTime parses a DATE or DATE-TIME value. The second result reports
+// whether it is a date, i.e. an all-day event.
+func parseTime(prop property) (time.Time, bool, error) {
+	value := prop.value
+	if prop.params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err := time.ParseInLocation("20060102", value, clinic.Location)
+		if err != nil {
+			return t, true, fmt.Errorf("invalid date %q", value)
+		}
+		return t, true, nil
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err := time.Parse("20060102T150405Z", value)
+		if err != nil {
+			return t, false, fmt.Errorf("invalid time %q", value)
+		}
+		return t.In(clinic.Location), false, nil
+	}
+	location := clinic.Location
+	if tzid := prop.params["TZID"]; tzid != "" {
+		if loaded, err := time.LoadLocation(tzid); err == nil {
+			location = loaded
+		}
+	}
+	t, err := time.ParseInLocation("20060102T150405", value, location)
+	if err != nil {
+		return t, false, fmt.Errorf("invalid time %q", value)
+	}
+	return t.In(clinic.Location), false, nil
+}
+
+var durationPattern = regexp.MustCompile(`^([+-])?P(?:(\d+)W)?(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+)S)?)?$`)
+
+// parseDuration parses a DURATION value such as PT45M or P1DT2H.
+func parseDuration(value string) (time.Duration, error) {
+	match := durationPattern.FindStringSubmatch(value)
+	if match == nil || match[1] == "-" {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	units := []time.Duration{7 * 24 * time.Hour, 24 * time.Hour, time.Hour, time.Minute, time.Second}
+	var duration time.Duration
+	for i, unit := range units {
+		if match[i+2] != "" {
+			n, _ := strconv.Atoi(match[i+2])
+			duration += time.Duration(n) * unit
+		}
+	}
+	return duration, nil
+}
@@ -0,0 +1,225 @@
+package ical
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+)
+
+// calendar wraps the content lines of one event in a VCALENDAR, with the
+// CRLF line endings of real files.
+func calendar(lines ...string) string {
+	all := append([]string{"BEGIN:VCALENDAR", "VERSION:2.0", "BEGIN:VEVENT", "UID:event-1"}, lines...)
+	all = append(all, "END:VEVENT", "END:VCALENDAR")
+	return strings.Join(all, "\r\n") + "\r\n"
+}
+
+// span formats an event's times on the clinic's wall clock.
+func span(event ParsedEvent) string {
+	return event.Start.In(clinic.Location).Format("2006-01-02 15:04") + " - " + event.End.In(clinic.Location).Format("15:04")
+}
+
+func TestParseTimes(t *testing.T) {
+	tests := []struct {
+		name   string
+		lines  []string
+		want   []string
+		allDay bool
+	}{
+		{
+			name:  "UTC",
+			lines: []string{"DTSTART:20250312T083000Z", "DTEND:20250312T091500Z"},
+			want:  []string{"2025-03-12 10:30 - 11:15"},
+		},
+		{
+			name:  "a known TZID",
+			lines: []string{"DTSTART;TZID=Europe/London:20250312T090000", "DTEND;TZID=Europe/London:20250312T094500"},
+			want:  []string{"2025-03-12 11:00 - 11:45"},
+		},
+		{
+			name:  "a quoted TZID",
+			lines: []string{`DTSTART;TZID="Europe/London":20250312T090000`, `DTEND;TZID="Europe/London":20250312T094500`},
+			want:  []string{"2025-03-12 11:00 - 11:45"},
+		},
+		{
+			name:  "an unknown TZID is the clinic's wall clock",
+			lines: []string{"DTSTART;TZID=W. Europe Standard Time:20250312T090000", "DTEND;TZID=W. Europe Standard Time:20250312T093000"},
+			want:  []string{"2025-03-12 09:00 - 09:30"},
+		},
+		{
+			name:  "floating times are the clinic's wall clock",
+			lines: []string{"DTSTART:20250312T090000", "DTEND:20250312T093000"},
+			want:  []string{"2025-03-12 09:00 - 09:30"},
+		},
+		{
+			name:  "floating times after the change to summer time",
+			lines: []string{"DTSTART:20250331T090000", "DTEND:20250331T093000"},
+			want:  []string{"2025-03-31 09:00 - 09:30"},
+		},
+		{
+			name:   "a date is an all-day event",
+			lines:  []string{"DTSTART;VALUE=DATE:20250312", "DTEND;VALUE=DATE:20250313"},
+			want:   []string{"2025-03-12 00:00 - 00:00"},
+			allDay: true,
+		},
+		{
+			name:  "DURATION instead of DTEND",
+			lines: []string{"DTSTART:20250312T090000", "DURATION:PT45M"},
+			want:  []string{"2025-03-12 09:00 - 09:45"},
+		},
+		{
+			name:  "DTEND wins over DURATION",
+			lines: []string{"DTSTART:20250312T090000", "DURATION:PT45M", "DTEND:20250312T093000"},
+			want:  []string{"2025-03-12 09:00 - 09:30"},
+		},
+		{
+			name:  "RRULE",
+			lines: []string{"DTSTART:20250303T100000", "DTEND:20250303T103000", "RRULE:FREQ=WEEKLY;COUNT=3"},
+			want:  []string{"2025-03-03 10:00 - 10:30", "2025-03-10 10:00 - 10:30", "2025-03-17 10:00 - 10:30"},
+		},
+		{
+			name: "EXDATE leaves out occurrences",
+			lines: []string{"DTSTART;TZID=Asia/Nicosia:20250303T100000", "DTEND;TZID=Asia/Nicosia:20250303T103000",
+				"RRULE:FREQ=WEEKLY;COUNT=4", "EXDATE;TZID=Asia/Nicosia:20250310T100000,20250317T100000"},
+			want: []string{"2025-03-03 10:00 - 10:30", "2025-03-24 10:00 - 10:30"},
+		},
+		{
+			name:  "EXDATE in UTC",
+			lines: []string{"DTSTART:20250303T100000", "DURATION:PT30M", "RRULE:FREQ=DAILY;COUNT=3", "EXDATE:20250304T080000Z"},
+			want:  []string{"2025-03-03 10:00 - 10:30", "2025-03-05 10:00 - 10:30"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			events, err := Parse(strings.NewReader(calendar(test.lines...)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, event := range events {
+				got = append(got, span(event))
+				if event.AllDay != test.allDay {
+					t.Errorf("AllDay = %v, want %v", event.AllDay, test.allDay)
+				}
+				if event.Recurring != (len(test.want) > 1) {
+					t.Errorf("Recurring = %v", event.Recurring)
+				}
+				if event.UID != "event-1" {
+					t.Errorf("UID = %q, want event-1", event.UID)
+				}
+				if len(event.Warnings) > 0 {
+					t.Errorf("Warnings = %v", event.Warnings)
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("events = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseProperties(t *testing.T) {
+	input := calendar(
+		"SUMMARY:Cleaning\\, Maria Ioannou",
+		"DESCRIPTION:First line\\nsecond line with a long text that",
+		"  is folded",
+		"LOCATION:Room 1",
+		"STATUS:confirmed",
+		"ORGANIZER;CN=Clinic:mailto:Clinic@Example.com",
+		`ATTENDEE;CN="Ioannou: Maria";ROLE=REQ-PARTICIPANT:mailto:maria@example.com`,
+		"DTSTART:20250312T090000",
+		"DTEND:20250312T093000",
+		"BEGIN:VALARM",
+		"TRIGGER:-PT15M",
+		"DESCRIPTION:Reminder",
+		"END:VALARM",
+	)
+	events, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("got %d events, want 1", len(events))
+	}
+	event := events[0]
+	want := ParsedEvent{
+		UID:         "event-1",
+		Summary:     "Cleaning, Maria Ioannou",
+		Description: "First line\nsecond line with a long text that is folded",
+		Location:    "Room 1",
+		Status:      "CONFIRMED",
+		Emails:      []string{"clinic@example.com", "maria@example.com"},
+		Start:       event.Start,
+		End:         event.End,
+	}
+	if !reflect.DeepEqual(event, want) {
+		t.Errorf("Parse = %+v, want %+v", event, want)
+	}
+}
+
+func TestParseWarnings(t *testing.T) {
+	tests := []struct {
+		name  string
+		lines []string
+		want  string
+	}{
+		{"an invalid time", []string{"DTSTART:2025-03-12T09:00", "DTEND:20250312T093000"}, "invalid time"},
+		{"an invalid duration", []string{"DTSTART:20250312T090000", "DURATION:45 minutes"}, "invalid duration"},
+		{"an unsupported recurrence", []string{"DTSTART:20250312T090000", "DURATION:PT30M", "RRULE:FREQ=HOURLY"}, "only the first occurrence is imported"},
+		{"too many occurrences", []string{"DTSTART:20250312T090000", "DURATION:PT30M", "RRULE:FREQ=DAILY"}, "only the first 100 occurrences"},
+	}
+	for _, test := range tests {
+		events, err := Parse(strings.NewReader(calendar(test.lines...)))
+		if err != nil {
+			t.Fatalf("%s: %s", test.name, err)
+		}
+		if len(events) == 0 || !strings.Contains(strings.Join(events[0].Warnings, "; "), test.want) {
+			t.Errorf("%s: warnings = %v, want %q", test.name, events[0].Warnings, test.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  string
+	}{
+		{"a line without a colon", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY\r\nEND:VEVENT\r\n", "invalid content line"},
+		{"a missing END:VEVENT", "BEGIN:VCALENDAR\r\nBEGIN:VEVENT\r\nSUMMARY:Cleaning\r\nEND:VCALENDAR\r\n", "missing END:VEVENT"},
+		{"END:VEVENT without BEGIN", "BEGIN:VCALENDAR\r\nEND:VEVENT\r\n", "without BEGIN:VEVENT"},
+	}
+	for _, test := range tests {
+		_, err := Parse(strings.NewReader(test.input))
+		if err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%s: error = %v, want %q", test.name, err, test.want)
+		}
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{value: "PT45M", want: 45 * time.Minute},
+		{value: "PT1H30M", want: 90 * time.Minute},
+		{value: "P1DT2H", want: 26 * time.Hour},
+		{value: "P1W", want: 7 * 24 * time.Hour},
+		{value: "+PT10S", want: 10 * time.Second},
+		{value: "-PT15M", wantErr: true},
+		{value: "45M", wantErr: true},
+		{value: "PT45", wantErr: true},
+		{value: "P1H", wantErr: true},
+	}
+	for _, test := range tests {
+		got, err := parseDuration(test.value)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("parseDuration(%q) = %s, %v, want %s, error %v", test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package models
 import (
 	"time"
 
+	"github.com/ipmess/dentistbackend/pkg/clinic"
 	"gorm.io/gorm"
 )
 
@@ -19,7 +20,9 @@ type Patient struct {
 	SMS               bool          `json:"SMS"`
 	EmailNotification bool          `json:"EmailNotification"`
 	ReminderDays      int           `json:"ReminderDays"`
-	Appointments      []Appointment `gorm:"foreignKey:PatientID"` // Relationship with Appointments
+	Language          string        `gorm:"type:char(2);not null;default:el" json:"Language"` // "el" or "en", for the messages sent to the patient
+	MedicalAlerts     string        `gorm:"type:text" json:"MedicalAlerts"`                   // e.g. "Penicillin allergy; on anticoagulants", printed on the day sheet
+	Appointments      []Appointment `gorm:"foreignKey:PatientID"`                             // Relationship with Appointments
 }
 
 type Appointment struct {
@@ -35,10 +38,71 @@ type Appointment struct {
 	Whatsapp          bool
 	SMS               bool
 	EmailNotification bool
-	Reminder          int // Reminder in hours before the appointment
+	Reminder          int    // Reminder in hours before the appointment
+	AllowOutsideHours bool   // The dentist deliberately booked this appointment outside working hours
+	SeriesID          *uint  // Foreign key to AppointmentSeries, for recurring appointments
+	ResourceID        *uint  // Foreign key to Resource: the room or chair; NULL for appointments booked before there were resources
+	PractitionerID    *uint  // Foreign key to Practitioner; NULL for appointments booked before there were practitioners
+	Sequence          int    `gorm:"not null;default:0"`      // Revision number, increased on every change, for calendar clients
+	ImportedUID       string `gorm:"type:varchar(255);index"` // UID of the calendar event the appointment was imported from, if any
+	// Status lifecycle, with the time each status was reached:
+	Status      AppointmentStatus `gorm:"type:varchar(20);not null;default:scheduled;index"`
+	ConfirmedAt *time.Time
+	CheckedInAt *time.Time
+	InChairAt   *time.Time
+	CompletedAt *time.Time
+	CancelledAt *time.Time
+	NoShowAt    *time.Time
+	// Cancellation details, set when the appointment is cancelled:
+	CancellationReason CancellationReason `gorm:"type:varchar(30)"`
+	CancelledBy        string             `gorm:"type:varchar(255)"` // who cancelled, e.g. "patient" or the dentist's name
+	CancellationNote   string             `gorm:"type:varchar(1024)"`
+	LateCancellation   bool               // cancelled too close to the start time
+	CancellationFee    bool               // a cancellation fee applies
 	// Relationships
 	Patient         Patient         `gorm:"foreignKey:PatientID"`         // Belongs to Patient
 	AppointmentType AppointmentType `gorm:"foreignKey:AppointmentTypeID"` // Belongs to AppointmentType
+	Resource        *Resource       `gorm:"foreignKey:ResourceID" json:",omitempty"`
+	Practitioner    *Practitioner   `gorm:"foreignKey:PractitionerID" json:",omitempty"`
+}
+
+// AppointmentStatus is where an appointment is in its lifecycle:
+// scheduled -> confirmed -> checked-in -> in-chair -> completed,
+// or cancelled / no-show.
+type AppointmentStatus string
+
+const (
+	StatusScheduled AppointmentStatus = "scheduled"
+	StatusConfirmed AppointmentStatus = "confirmed"
+	StatusCheckedIn AppointmentStatus = "checked-in"
+	StatusInChair   AppointmentStatus = "in-chair"
+	StatusCompleted AppointmentStatus = "completed"
+	StatusCancelled AppointmentStatus = "cancelled"
+	StatusNoShow    AppointmentStatus = "no-show"
+)
+
+// CancellationReason says why an appointment was cancelled.
+type CancellationReason string
+
+const (
+	ReasonPatientRequest   CancellationReason = "patient-request"
+	ReasonDentistSick      CancellationReason = "dentist-sick"
+	ReasonLateCancellation CancellationReason = "late-cancellation"
+	ReasonOther            CancellationReason = "other"
+)
+
+// AppointmentChange records that an appointment was moved, keeping the time
+// it had before, so the appointment's history can be reconstructed.
+type AppointmentChange struct {
+	gorm.Model
+	ID            uint      `gorm:"primaryKey;autoIncrement"`
+	AppointmentID uint      `gorm:"not null;index"` // Foreign key to Appointment
+	OldStartTime  time.Time `gorm:"not null"`
+	OldDuration   int       `gorm:"not null"` // In minutes
+	NewStartTime  time.Time `gorm:"not null"`
+	NewDuration   int       `gorm:"not null"`          // In minutes
+	ChangedBy     string    `gorm:"type:varchar(255)"` // e.g. "patient" or the dentist's name
+	Reason        string    `gorm:"type:varchar(1024)"`
 }
 
 // AppointmentType represents a type of appointment in the system.
@@ -48,8 +112,272 @@ type Appointment struct {
 type AppointmentType struct {
 	gorm.Model
 	ID              uint          `gorm:"primaryKey;autoIncrement"`
-	Description     string        `gorm:"type:varchar(255);not null"`
-	DefaultDuration int           `gorm:"not null"`                     // In minutes
-	Color           string        `gorm:"type:char(7)"`                 // e.g. #FFA07A
+	Description     string        `gorm:"type:varchar(255);not null;uniqueIndex"`
+	DefaultDuration int           `gorm:"not null"`               // In minutes
+	BufferBefore    int           `gorm:"not null;default:0"`     // Minutes to prepare the chair before, e.g. for setting up instruments
+	BufferAfter     int           `gorm:"not null;default:0"`     // Minutes to clean up after, e.g. sterilizing the chair after an extraction
+	Color           string        `gorm:"type:char(7)"`           // e.g. #FFA07A
+	Keywords        string        `gorm:"type:varchar(255)"`      // comma separated words that identify the type in imported calendars, e.g. "extraction,εξαγωγη"
+	Archived        bool          `gorm:"not null;default:false"` // retired: kept for the appointments that have it, but no longer booked
+	DefaultFee      int           `gorm:"not null;default:0"`     // In euro cents, VAT included; pre-fills the charge of a completed appointment
+	VATCategory     VATCategory   `gorm:"type:varchar(20);not null;default:exempt"`
+	InstructionsEL  string        `gorm:"type:text"`                    // preparation and aftercare instructions for the patient, in Greek
+	InstructionsEN  string        `gorm:"type:text"`                    // the same in English
 	Appointments    []Appointment `gorm:"foreignKey:AppointmentTypeID"` // Relationship with Appointments
+	// The rooms or chairs this type of appointment can take place in. If it
+	// has none, any active resource will do.
+	Resources []Resource `gorm:"many2many:appointment_type_resources" json:",omitempty"`
+}
+
+// Resource is a room or chair that appointments are booked into, e.g. an
+// operatory or the hygiene room. Each resource can hold one appointment at a
+// time.
+type Resource struct {
+	gorm.Model
+	ID     uint   `gorm:"primaryKey;autoIncrement"`
+	UUID   string `gorm:"type:uuid;default:UUID();unique;not null"`
+	Name   string `gorm:"type:varchar(100);not null;unique"` // e.g. "Operatory 1"
+	Kind   string `gorm:"type:varchar(50)"`                  // e.g. "operatory" or "hygiene"
+	Active bool   `gorm:"not null;default:true"`             // inactive resources are not booked any more
+}
+
+// Practitioner is a dentist or hygienist with their own calendar: their own
+// working hours and time off, and the appointment types they may perform.
+// A practitioner without any appointment types may perform all of them.
+type Practitioner struct {
+	gorm.Model
+	ID               uint              `gorm:"primaryKey;autoIncrement"`
+	UUID             string            `gorm:"type:uuid;default:UUID();unique;not null"`
+	Name             string            `gorm:"type:varchar(255);not null"`
+	Role             string            `gorm:"type:varchar(50)"` // e.g. "dentist" or "hygienist"
+	Color            string            `gorm:"type:char(7)"`     // e.g. #4682B4, for the calendar
+	Active           bool              `gorm:"not null;default:true"`
+	AppointmentTypes []AppointmentType `gorm:"many2many:practitioner_appointment_types" json:",omitempty"`
+}
+
+// WorkingHours is one opening period of the clinic on a day of the week.
+// A day can have several periods (split shifts), for example 08:00-13:00 and
+// 16:00-20:00 on the same Weekday. Days without any period are closed.
+// Rows with a PractitionerID are that practitioner's own hours; the others
+// are the clinic's, which apply to practitioners without hours of their own.
+type WorkingHours struct {
+	gorm.Model
+	ID             uint         `gorm:"primaryKey;autoIncrement"`
+	PractitionerID *uint        `gorm:"index"`                 // Foreign key to Practitioner; NULL for the clinic's hours
+	Weekday        time.Weekday `gorm:"not null"`              // 0 = Sunday, 1 = Monday, ...
+	Opens          string       `gorm:"type:char(5);not null"` // HH:MM
+	Closes         string       `gorm:"type:char(5);not null"` // HH:MM, "24:00" for midnight
+}
+
+// TimeOff is a period in which no appointments can be booked: an off day, a
+// holiday, or a few hours blocked off for rest or study.
+// All-day blocks run from midnight on the first day to midnight after the last
+// day. Recurring blocks repeat daily, weekly, monthly or yearly from StartTime,
+// until RecurrenceUntil (or forever, if it is not set). Time off with a
+// PractitionerID only blocks that practitioner's calendar.
+type TimeOff struct {
+	gorm.Model
+	ID              uint       `gorm:"primaryKey;autoIncrement"`
+	UUID            string     `gorm:"type:uuid;default:UUID();unique;not null"`
+	PractitionerID  *uint      `gorm:"index"` // Foreign key to Practitioner; NULL when the whole clinic is closed
+	StartTime       time.Time  `gorm:"not null"`
+	EndTime         time.Time  `gorm:"not null"` // exclusive
+	AllDay          bool       `gorm:"not null"`
+	Reason          string     `gorm:"type:varchar(255)"`
+	Recurrence      string     `gorm:"type:varchar(10)"` // "", "daily", "weekly", "monthly" or "yearly"
+	RecurrenceUntil *time.Time // last day on which a recurring block can start
+}
+
+// HolidayOptOut records that the clinic stays open on a public holiday.
+// Key identifies the holiday (e.g. "green-monday"); Year is the year the
+// opt-out applies to, or 0 for every year.
+type HolidayOptOut struct {
+	gorm.Model
+	ID   uint   `gorm:"primaryKey;autoIncrement"`
+	Key  string `gorm:"type:varchar(50);not null;uniqueIndex:idx_holiday_opt_out"`
+	Year int    `gorm:"not null;uniqueIndex:idx_holiday_opt_out"`
+}
+
+// AppointmentSeries is a set of recurring appointments, e.g. orthodontic
+// adjustments every four weeks. Its occurrences are stored as ordinary
+// Appointment rows pointing back to the series through SeriesID, so each one
+// can be moved or cancelled on its own.
+type AppointmentSeries struct {
+	gorm.Model
+	ID                uint      `gorm:"primaryKey;autoIncrement"`
+	UUID              string    `gorm:"type:uuid;default:UUID();unique;not null"`
+	PatientID         uint      `gorm:"not null"`                   // Foreign key to Patients
+	AppointmentTypeID uint      `gorm:"not null"`                   // Foreign key to AppointmentType
+	StartTime         time.Time `gorm:"not null"`                   // Start time of the first occurrence (DTSTART)
+	Duration          int       `gorm:"not null"`                   // Duration in minutes
+	RRule             string    `gorm:"type:varchar(255);not null"` // RFC 5545 recurrence rule, e.g. FREQ=WEEKLY;COUNT=6
+	Viber             bool
+	Whatsapp          bool
+	SMS               bool
+	EmailNotification bool
+	Reminder          int // Reminder in hours before each appointment
+	// Relationships
+	Patient         Patient         `gorm:"foreignKey:PatientID"`
+	AppointmentType AppointmentType `gorm:"foreignKey:AppointmentTypeID"`
+	Appointments    []Appointment   `gorm:"foreignKey:SeriesID"`
+}
+
+// WaitlistEntry is a patient waiting for an earlier appointment of a given
+// type, on the days and at the times of day they prefer.
+type WaitlistEntry struct {
+	gorm.Model
+	ID                uint       `gorm:"primaryKey;autoIncrement"`
+	UUID              string     `gorm:"type:uuid;default:UUID();unique;not null"`
+	PatientID         uint       `gorm:"not null"` // Foreign key to Patients
+	AppointmentTypeID uint       `gorm:"not null"` // Foreign key to AppointmentType
+	Duration          int        // In minutes; 0 means the appointment type's default duration
+	Weekdays          string     `gorm:"type:varchar(20)"` // e.g. "1,4" for Monday and Thursday; empty means any day
+	EarliestTime      string     `gorm:"type:char(5)"`     // HH:MM; empty means any time
+	LatestTime        string     `gorm:"type:char(5)"`     // HH:MM, by which the appointment must end; empty means any time
+	NotBefore         *time.Time // don't offer slots before this time
+	NotAfter          *time.Time // only offer slots before this time (e.g. the patient's current appointment)
+	Notes             string     `gorm:"type:varchar(1024)"`
+	Active            bool       `gorm:"not null;default:true"`
+	// Relationships
+	Patient         Patient         `gorm:"foreignKey:PatientID"`
+	AppointmentType AppointmentType `gorm:"foreignKey:AppointmentTypeID"`
+}
+
+// WaitlistOffer is a freed slot suggested to a patient on the waitlist.
+// The offers for one freed slot are ranked, best candidate first.
+type WaitlistOffer struct {
+	gorm.Model
+	ID                 uint      `gorm:"primaryKey;autoIncrement"`
+	WaitlistEntryID    uint      `gorm:"not null"` // Foreign key to WaitlistEntry
+	FreedAppointmentID uint      `gorm:"not null"` // the cancelled or moved appointment that freed the slot
+	StartTime          time.Time `gorm:"not null"`
+	Duration           int       `gorm:"not null"` // In minutes
+	Rank               int       `gorm:"not null"` // 1 is the best candidate
+	Score              int       `gorm:"not null"`
+	Status             string    `gorm:"type:varchar(20);not null;default:suggested"` // "suggested", "notified" or "dismissed"
+	// Relationships
+	WaitlistEntry WaitlistEntry `gorm:"foreignKey:WaitlistEntryID"`
+}
+
+// Notification is a message queued for a patient, on the channels they want
+// to be notified on. Messages are sent by a separate process, which marks
+// them as sent.
+type Notification struct {
+	gorm.Model
+	ID            uint   `gorm:"primaryKey;autoIncrement"`
+	PatientID     uint   `gorm:"not null"` // Foreign key to Patients
+	AppointmentID *uint  // the appointment the message is about, if any
+	Kind          string `gorm:"type:varchar(30);not null"` // e.g. "waitlist-offer"
+	Channels      string `gorm:"type:varchar(50)"`          // e.g. "viber,sms"
+	Message       string `gorm:"type:text;not null"`
+	Status        string `gorm:"type:varchar(20);not null;default:pending;index"` // "pending" or "sent"
+	SentAt        *time.Time
+	// Relationships
+	Patient Patient `gorm:"foreignKey:PatientID"`
+}
+
+// VATCategory is the VAT treatment of a service in Cyprus. Medical dental
+// care is exempt; cosmetic treatments such as whitening are not.
+type VATCategory string
+
+const (
+	VATExempt       VATCategory = "exempt"
+	VATStandard     VATCategory = "standard"      // 19%
+	VATReduced      VATCategory = "reduced"       // 9%
+	VATSuperReduced VATCategory = "super-reduced" // 5%
+	VATZero         VATCategory = "zero"
+)
+
+// Charge is what a patient is charged for an appointment. It is pre-filled
+// from the appointment type's fee when the appointment is completed, and can
+// be corrected afterwards. Amounts are in euro cents; Amount includes VAT.
+type Charge struct {
+	gorm.Model
+	ID            uint        `gorm:"primaryKey;autoIncrement"`
+	UUID          string      `gorm:"type:uuid;default:UUID();unique;not null"`
+	AppointmentID uint        `gorm:"not null;uniqueIndex"` // Foreign key to Appointments
+	PatientID     uint        `gorm:"not null;index"`       // Foreign key to Patients
+	Description   string      `gorm:"type:varchar(255);not null"`
+	Amount        int         `gorm:"not null"`
+	VATCategory   VATCategory `gorm:"type:varchar(20);not null"`
+	VATRate       int         `gorm:"not null"` // in percent
+	VATAmount     int         `gorm:"not null"` // the VAT included in Amount
+	PaidAt        *time.Time
+	// Relationships
+	Patient Patient `gorm:"foreignKey:PatientID"`
+}
+
+// GoogleCalendarEvent links an appointment to the event it was pushed to in
+// a Google Calendar. Sequence is the appointment's Sequence when the event
+// was last written, so changed appointments can be found and pushed again.
+type GoogleCalendarEvent struct {
+	gorm.Model
+	ID            uint   `gorm:"primaryKey;autoIncrement"`
+	AppointmentID uint   `gorm:"not null;uniqueIndex:idx_google_event_appointment"` // Foreign key to Appointments
+	CalendarID    string `gorm:"type:varchar(255);not null;uniqueIndex:idx_google_event_appointment"`
+	EventID       string `gorm:"type:varchar(255);not null;index"`
+	Sequence      int    `gorm:"not null"`
+	Deleted       bool   // the event was deleted because the appointment was cancelled
+}
+
+// GoogleCalendarSync holds the sync state of a Google Calendar: the token of
+// the last incremental sync, and the push notification channel Google
+// announces changes on.
+type GoogleCalendarSync struct {
+	gorm.Model
+	ID                uint   `gorm:"primaryKey;autoIncrement"`
+	CalendarID        string `gorm:"type:varchar(255);not null;unique"`
+	SyncToken         string `gorm:"type:varchar(1024)"`
+	ChannelID         string `gorm:"type:varchar(64)"`
+	ChannelToken      string `gorm:"type:varchar(64)"` // sent back by Google with every notification
+	ResourceID        string `gorm:"type:varchar(255)"`
+	ChannelExpiration *time.Time
+}
+
+// The hooks below present stored times, which are in UTC, on the clinic's
+// wall clock, so the API shows them with the clinic's offset and the
+// scheduling code can take weekdays and times of day from them directly.
+
+func (a *Appointment) AfterFind(tx *gorm.DB) error {
+	a.StartTime = a.StartTime.In(clinic.Location)
+	return nil
+}
+
+func (a *Appointment) BeforeSave(tx *gorm.DB) error {
+	a.StartTime = a.StartTime.In(clinic.Location)
+	return nil
+}
+
+func (c *AppointmentChange) AfterFind(tx *gorm.DB) error {
+	c.OldStartTime = c.OldStartTime.In(clinic.Location)
+	c.NewStartTime = c.NewStartTime.In(clinic.Location)
+	return nil
+}
+
+func (s *AppointmentSeries) AfterFind(tx *gorm.DB) error {
+	s.StartTime = s.StartTime.In(clinic.Location)
+	return nil
+}
+
+func (t *TimeOff) AfterFind(tx *gorm.DB) error {
+	t.StartTime = t.StartTime.In(clinic.Location)
+	t.EndTime = t.EndTime.In(clinic.Location)
+	if t.RecurrenceUntil != nil {
+		until := t.RecurrenceUntil.In(clinic.Location)
+		t.RecurrenceUntil = &until
+	}
+	return nil
+}
+
+func (o *WaitlistOffer) AfterFind(tx *gorm.DB) error {
+	o.StartTime = o.StartTime.In(clinic.Location)
+	return nil
+}
+
+// TimeZoneMigration records that the times earlier versions stored in the
+// server's local time have been converted to UTC, so that it happens once.
+type TimeZoneMigration struct {
+	ID         uint      `gorm:"primaryKey;autoIncrement"`
+	FromZone   string    `gorm:"type:varchar(64);not null"` // the zone the times were stored in, e.g. Asia/Nicosia
+	MigratedAt time.Time `gorm:"not null"`
 }
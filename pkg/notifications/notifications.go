@@ -0,0 +1,118 @@
+package notifications
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/gorm"
+)
+
+type HTTPHandler struct {
+	DB  *gorm.DB
+	Ctx context.Context
+}
+
+// Kinds of notification
+const (
+	KindWaitlistOffer           = "waitlist-offer"
+	KindAppointmentMoved        = "appointment-moved"
+	KindAppointmentConfirmation = "appointment-confirmation"
+)
+
+// Notification statuses
+const (
+	StatusPending = "pending"
+	StatusSent    = "sent"
+)
+
+// Channels returns the notification channels that are switched on, in the
+// form stored in models.Notification.Channels.
+func Channels(viber, whatsapp, sms, email bool) string {
+	var channels []string
+	if viber {
+		channels = append(channels, "viber")
+	}
+	if whatsapp {
+		channels = append(channels, "whatsapp")
+	}
+	if sms {
+		channels = append(channels, "sms")
+	}
+	if email {
+		channels = append(channels, "email")
+	}
+	return strings.Join(channels, ",")
+}
+
+// Queue stores a pending notification for patient, sent on the patient's
+// default channels. appointmentID is optional.
+func Queue(db *gorm.DB, patient models.Patient, appointmentID *uint, kind, message string) (models.Notification, error) {
+	channels := Channels(patient.Viber, patient.Whatsapp, patient.SMS, patient.EmailNotification)
+	return queue(db, patient.ID, appointmentID, channels, kind, message)
+}
+
+// QueueFor stores a pending notification about appointment, sent on the
+// channels chosen for the appointment rather than the patient's defaults.
+func QueueFor(db *gorm.DB, appointment models.Appointment, kind, message string) (models.Notification, error) {
+	channels := Channels(appointment.Viber, appointment.Whatsapp, appointment.SMS, appointment.EmailNotification)
+	return queue(db, appointment.PatientID, &appointment.ID, channels, kind, message)
+}
+
+func queue(db *gorm.DB, patientID uint, appointmentID *uint, channels, kind, message string) (models.Notification, error) {
+	notification := models.Notification{
+		PatientID:     patientID,
+		AppointmentID: appointmentID,
+		Kind:          kind,
+		Channels:      channels,
+		Message:       message,
+		Status:        StatusPending,
+	}
+	err := db.Omit("Patient").Create(&notification).Error
+	return notification, err
+}
+
+// ListNotifications handles GET /notifications?status=pending.
+func (h *HTTPHandler) ListNotifications(w http.ResponseWriter, r *http.Request) {
+	query := h.DB.Preload("Patient").Order("created_at asc")
+	if status := r.URL.Query().Get("status"); status != "" {
+		query = query.Where("status = ?", status)
+	}
+	var notifications []models.Notification
+	err := query.Find(&notifications).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notifications)
+}
+
+// MarkSent handles POST /notifications/{id}/sent, called once a message has
+// been delivered.
+func (h *HTTPHandler) MarkSent(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid notification ID", http.StatusBadRequest)
+		return
+	}
+	var notification models.Notification
+	err = h.DB.First(&notification, id).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	now := time.Now()
+	err = h.DB.Model(&notification).Updates(models.Notification{Status: StatusSent, SentAt: &now}).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(notification)
+}
@@ -5,11 +5,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/ipmess/dentistbackend/pkg/authenticationHelper"
+	"github.com/ipmess/dentistbackend/pkg/clinic"
 	"github.com/ipmess/dentistbackend/pkg/models"
 	"gorm.io/gorm"
 )
@@ -138,7 +140,144 @@ func (h *HTTPHandler) DeletePatient(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-/* TODO:
-We need to implement the get appointments REST API endpoint:
-* `GET /patients/:uuid/appointments` to get a list of all appointments for a particular patient.
-*/
+// appointmentHistoryEntry is one appointment in a patient's history. Only the
+// date, duration, type and outcome are included.
+type appointmentHistoryEntry struct {
+	UUID               string
+	StartTime          time.Time
+	Duration           int
+	AppointmentType    string
+	Status             models.AppointmentStatus
+	CancellationReason models.CancellationReason `json:",omitempty"`
+	LateCancellation   bool                      `json:",omitempty"`
+}
+
+// cancellationStats summarises how often a patient cancels or misses
+// appointments.
+type cancellationStats struct {
+	PatientID             uint `json:"-"`
+	PatientUUID           string
+	Name                  string
+	Appointments          int
+	Cancelled             int
+	LateCancellations     int
+	NoShows               int
+	FeeableCancellations  int // cancellations a fee applies to
+	PastAppointments      int
+	PastLateCancellations int     `json:"-"`
+	LateCancellationRate  float64 // late cancellations per past appointment
+}
+
+// findPatient looks up the patient with the UUID in the URL, and writes a 404
+// response if there is none.
+func (h *HTTPHandler) findPatient(w http.ResponseWriter, r *http.Request) (models.Patient, bool) {
+	vars := mux.Vars(r)
+	var patient models.Patient
+	err := h.DB.Where("uuid = ?", vars["uuid"]).First(&patient).Error
+	if err != nil {
+		http.Error(w, "Patient not found", http.StatusNotFound)
+		return patient, false
+	}
+	return patient, true
+}
+
+// GetPatientAppointments handles GET /patients/{uuid}/appointments: the
+// patient's appointment history, including cancelled appointments.
+func (h *HTTPHandler) GetPatientAppointments(w http.ResponseWriter, r *http.Request) {
+	patient, ok := h.findPatient(w, r)
+	if !ok {
+		return
+	}
+	var appointments []models.Appointment
+	err := h.DB.Preload("AppointmentType").Preload("Resource").Preload("Practitioner").Where("patient_id = ?", patient.ID).Order("start_time desc").Find(&appointments).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	history := []appointmentHistoryEntry{}
+	for _, appointment := range appointments {
+		history = append(history, appointmentHistoryEntry{
+			UUID:               appointment.UUID,
+			StartTime:          appointment.StartTime,
+			Duration:           appointment.Duration,
+			AppointmentType:    appointment.AppointmentType.Description,
+			Status:             appointment.Status,
+			CancellationReason: appointment.CancellationReason,
+			LateCancellation:   appointment.LateCancellation,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(history)
+}
+
+// queryCancellationStats aggregates the cancellation statistics of every
+// patient matched by the where clause.
+func queryCancellationStats(db *gorm.DB) ([]cancellationStats, error) {
+	var stats []cancellationStats
+	now := clinic.Now()
+	err := db.Model(&models.Appointment{}).
+		Select("appointments.patient_id AS patient_id, patients.uuid AS patient_uuid, patients.name AS name, "+
+			"COUNT(*) AS appointments, "+
+			"SUM(appointments.status = ?) AS cancelled, "+
+			"SUM(appointments.late_cancellation) AS late_cancellations, "+
+			"SUM(appointments.status = ?) AS no_shows, "+
+			"SUM(appointments.cancellation_fee) AS feeable_cancellations, "+
+			"SUM(appointments.start_time < ?) AS past_appointments, "+
+			"SUM(appointments.start_time < ? AND appointments.late_cancellation) AS past_late_cancellations",
+			models.StatusCancelled, models.StatusNoShow, now, now).
+		Joins("JOIN patients ON patients.id = appointments.patient_id").
+		Group("appointments.patient_id, patients.uuid, patients.name").
+		Scan(&stats).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range stats {
+		if stats[i].PastAppointments > 0 {
+			stats[i].LateCancellationRate = float64(stats[i].PastLateCancellations) / float64(stats[i].PastAppointments)
+		}
+	}
+	return stats, nil
+}
+
+// GetCancellationStats handles GET /patients/{uuid}/cancellations.
+func (h *HTTPHandler) GetCancellationStats(w http.ResponseWriter, r *http.Request) {
+	patient, ok := h.findPatient(w, r)
+	if !ok {
+		return
+	}
+	stats, err := queryCancellationStats(h.DB.Where("appointments.patient_id = ?", patient.ID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	result := cancellationStats{PatientUUID: patient.UUID, Name: patient.Name}
+	if len(stats) == 1 {
+		result = stats[0]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// ListLateCancellations handles GET /reports/late-cancellations: every
+// patient with at least one late cancellation, worst first.
+func (h *HTTPHandler) ListLateCancellations(w http.ResponseWriter, r *http.Request) {
+	stats, err := queryCancellationStats(h.DB)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	report := []cancellationStats{}
+	for _, patientStats := range stats {
+		if patientStats.LateCancellations > 0 {
+			report = append(report, patientStats)
+		}
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].LateCancellations != report[j].LateCancellations {
+			return report[i].LateCancellations > report[j].LateCancellations
+		}
+		return report[i].LateCancellationRate > report[j].LateCancellationRate
+	})
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
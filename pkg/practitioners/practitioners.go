@@ -0,0 +1,194 @@
+package practitioners
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/gorm"
+)
+
+type HTTPHandler struct {
+	DB  *gorm.DB
+	Ctx context.Context
+}
+
+// Active returns every active practitioner, in ID order.
+func Active(db *gorm.DB) ([]models.Practitioner, error) {
+	var active []models.Practitioner
+	err := db.Where("active = ?", true).Order("id asc").Find(&active).Error
+	return active, err
+}
+
+// AllowedFor returns the active practitioners who may perform appointments
+// of the given type, in ID order: those who list the type among their
+// appointment types, and those who don't list any.
+func AllowedFor(db *gorm.DB, appointmentTypeID uint) ([]models.Practitioner, error) {
+	var allowed []models.Practitioner
+	err := db.Where("active = ?", true).
+		Where("id IN (SELECT practitioner_id FROM practitioner_appointment_types WHERE appointment_type_id = ?) OR id NOT IN (SELECT practitioner_id FROM practitioner_appointment_types)", appointmentTypeID).
+		Order("id asc").
+		Find(&allowed).Error
+	return allowed, err
+}
+
+// NewPractitioner handles POST /practitioners, e.g.
+// {"Name": "Maria Georgiou", "Role": "hygienist", "Color": "#4682B4"}
+func (h *HTTPHandler) NewPractitioner(w http.ResponseWriter, r *http.Request) {
+	var practitioner models.Practitioner
+	err := json.NewDecoder(r.Body).Decode(&practitioner)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if practitioner.Name == "" {
+		http.Error(w, "Name is required", http.StatusUnprocessableEntity)
+		return
+	}
+	practitioner.CreatedAt = time.Now()
+	practitioner.UpdatedAt = time.Now()
+	practitioner.ID = 0
+	practitioner.Active = true
+	practitioner.AppointmentTypes = nil
+	tempUUID, _ := uuid.NewV7()
+	practitioner.UUID = tempUUID.String()
+
+	err = h.DB.Create(&practitioner).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(practitioner)
+}
+
+// ListPractitioners handles GET /practitioners.
+func (h *HTTPHandler) ListPractitioners(w http.ResponseWriter, r *http.Request) {
+	var list []models.Practitioner
+	err := h.DB.Preload("AppointmentTypes").Order("id asc").Find(&list).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// GetPractitioner handles GET /practitioners/{uuid}.
+func (h *HTTPHandler) GetPractitioner(w http.ResponseWriter, r *http.Request) {
+	var practitioner models.Practitioner
+	err := h.DB.Preload("AppointmentTypes").Where("uuid = ?", mux.Vars(r)["uuid"]).First(&practitioner).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(practitioner)
+}
+
+// UpdatePractitioner handles PUT /practitioners/{uuid}. "Active": false
+// stops new bookings with the practitioner; existing appointments keep them.
+func (h *HTTPHandler) UpdatePractitioner(w http.ResponseWriter, r *http.Request) {
+	var changes models.Practitioner
+	err := json.NewDecoder(r.Body).Decode(&changes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if changes.Name == "" {
+		http.Error(w, "Name is required", http.StatusUnprocessableEntity)
+		return
+	}
+	var practitioner models.Practitioner
+	err = h.DB.Where("uuid = ?", mux.Vars(r)["uuid"]).First(&practitioner).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	err = h.DB.Model(&practitioner).Select("Name", "Role", "Color", "Active").Updates(&changes).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(practitioner)
+}
+
+// DeletePractitioner handles DELETE /practitioners/{uuid}. Practitioners
+// with appointments cannot be deleted; deactivate them instead.
+func (h *HTTPHandler) DeletePractitioner(w http.ResponseWriter, r *http.Request) {
+	var practitioner models.Practitioner
+	err := h.DB.Where("uuid = ?", mux.Vars(r)["uuid"]).First(&practitioner).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var booked int64
+	err = h.DB.Model(&models.Appointment{}).Where("practitioner_id = ?", practitioner.ID).Count(&booked).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if booked > 0 {
+		http.Error(w, "the practitioner has appointments; set Active to false instead", http.StatusConflict)
+		return
+	}
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&practitioner).Association("AppointmentTypes").Clear(); err != nil {
+			return err
+		}
+		if err := tx.Where("practitioner_id = ?", practitioner.ID).Delete(&models.WorkingHours{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("practitioner_id = ?", practitioner.ID).Delete(&models.TimeOff{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&practitioner).Error
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetAppointmentTypes handles PUT /practitioners/{uuid}/appointment-types.
+// The body is the list of appointment type IDs the practitioner may perform,
+// e.g. [1, 4]; an empty list lets them perform every type.
+func (h *HTTPHandler) SetAppointmentTypes(w http.ResponseWriter, r *http.Request) {
+	var ids []uint
+	err := json.NewDecoder(r.Body).Decode(&ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var practitioner models.Practitioner
+	err = h.DB.Where("uuid = ?", mux.Vars(r)["uuid"]).First(&practitioner).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var types []models.AppointmentType
+	if len(ids) > 0 {
+		err = h.DB.Where("id IN ?", ids).Find(&types).Error
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(types) != len(ids) {
+			http.Error(w, "unknown appointment type ID", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	err = h.DB.Model(&practitioner).Association("AppointmentTypes").Replace(types)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(types)
+}
@@ -0,0 +1,228 @@
+package resources
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/gorm"
+)
+
+type HTTPHandler struct {
+	DB  *gorm.DB
+	Ctx context.Context
+}
+
+// AllowedFor returns the active resources an appointment of the given type
+// can be booked into, in ID order: the resources the type declares, or every
+// active resource if it declares none. An empty result means the clinic has
+// not set up any resources, and the whole clinic is treated as one chair.
+func AllowedFor(db *gorm.DB, appointmentTypeID uint) ([]models.Resource, error) {
+	var allowed []models.Resource
+	err := db.Joins("JOIN appointment_type_resources ON appointment_type_resources.resource_id = resources.id").
+		Where("appointment_type_resources.appointment_type_id = ? AND resources.active = ?", appointmentTypeID, true).
+		Order("resources.id asc").
+		Find(&allowed).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(allowed) > 0 {
+		return allowed, nil
+	}
+	var declared int64
+	err = db.Table("appointment_type_resources").Where("appointment_type_id = ?", appointmentTypeID).Count(&declared).Error
+	if err != nil {
+		return nil, err
+	}
+	if declared > 0 {
+		// every resource of this type has been deactivated
+		return []models.Resource{}, nil
+	}
+	return Active(db)
+}
+
+// Active returns every active resource, in ID order.
+func Active(db *gorm.DB) ([]models.Resource, error) {
+	var active []models.Resource
+	err := db.Where("active = ?", true).Order("id asc").Find(&active).Error
+	return active, err
+}
+
+// NewResource handles POST /resources, e.g. {"Name": "Operatory 2", "Kind": "operatory"}
+func (h *HTTPHandler) NewResource(w http.ResponseWriter, r *http.Request) {
+	var resource models.Resource
+	err := json.NewDecoder(r.Body).Decode(&resource)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if resource.Name == "" {
+		http.Error(w, "Name is required", http.StatusUnprocessableEntity)
+		return
+	}
+	resource.CreatedAt = time.Now()
+	resource.UpdatedAt = time.Now()
+	resource.ID = 0
+	resource.Active = true
+	tempUUID, _ := uuid.NewV7()
+	resource.UUID = tempUUID.String()
+
+	err = h.DB.Create(&resource).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resource)
+}
+
+// ListResources handles GET /resources.
+func (h *HTTPHandler) ListResources(w http.ResponseWriter, r *http.Request) {
+	var list []models.Resource
+	err := h.DB.Order("id asc").Find(&list).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// GetResource handles GET /resources/{uuid}.
+func (h *HTTPHandler) GetResource(w http.ResponseWriter, r *http.Request) {
+	var resource models.Resource
+	err := h.DB.Where("uuid = ?", mux.Vars(r)["uuid"]).First(&resource).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resource)
+}
+
+// UpdateResource handles PUT /resources/{uuid}. "Active": false stops new
+// bookings into the resource; existing appointments keep it.
+func (h *HTTPHandler) UpdateResource(w http.ResponseWriter, r *http.Request) {
+	var changes models.Resource
+	err := json.NewDecoder(r.Body).Decode(&changes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if changes.Name == "" {
+		http.Error(w, "Name is required", http.StatusUnprocessableEntity)
+		return
+	}
+	var resource models.Resource
+	err = h.DB.Where("uuid = ?", mux.Vars(r)["uuid"]).First(&resource).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	err = h.DB.Model(&resource).Select("Name", "Kind", "Active").Updates(&changes).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resource)
+}
+
+// DeleteResource handles DELETE /resources/{uuid}. Resources that have
+// appointments booked into them cannot be deleted; deactivate them instead.
+func (h *HTTPHandler) DeleteResource(w http.ResponseWriter, r *http.Request) {
+	var resource models.Resource
+	err := h.DB.Where("uuid = ?", mux.Vars(r)["uuid"]).First(&resource).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var booked int64
+	err = h.DB.Model(&models.Appointment{}).Where("resource_id = ?", resource.ID).Count(&booked).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if booked > 0 {
+		http.Error(w, "the resource has appointments; set Active to false instead", http.StatusConflict)
+		return
+	}
+	err = h.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Exec("DELETE FROM appointment_type_resources WHERE resource_id = ?", resource.ID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&resource).Error
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// findAppointmentType looks up the appointment type in the {id} URL variable.
+func (h *HTTPHandler) findAppointmentType(w http.ResponseWriter, r *http.Request) (models.AppointmentType, bool) {
+	var appointmentType models.AppointmentType
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid appointment type ID", http.StatusBadRequest)
+		return appointmentType, false
+	}
+	err = h.DB.Preload("Resources").First(&appointmentType, id).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return appointmentType, false
+	}
+	return appointmentType, true
+}
+
+// GetTypeResources handles GET /appointment-types/{id}/resources, listing
+// the resources the appointment type can use. An empty list means any.
+func (h *HTTPHandler) GetTypeResources(w http.ResponseWriter, r *http.Request) {
+	appointmentType, ok := h.findAppointmentType(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(appointmentType.Resources)
+}
+
+// SetTypeResources handles PUT /appointment-types/{id}/resources. The body
+// is the list of resource IDs the appointment type can use, e.g. [1, 2];
+// an empty list allows any resource.
+func (h *HTTPHandler) SetTypeResources(w http.ResponseWriter, r *http.Request) {
+	var ids []uint
+	err := json.NewDecoder(r.Body).Decode(&ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	appointmentType, ok := h.findAppointmentType(w, r)
+	if !ok {
+		return
+	}
+	var list []models.Resource
+	if len(ids) > 0 {
+		err = h.DB.Where("id IN ?", ids).Find(&list).Error
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(list) != len(ids) {
+			http.Error(w, "unknown resource ID", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	err = h.DB.Model(&appointmentType).Association("Resources").Replace(list)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
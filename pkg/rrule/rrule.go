@@ -0,0 +1,391 @@
+// Package rrule implements the subset of RFC 5545 recurrence rules needed for
+// recurring appointments:
+//
+//	FREQ=DAILY|WEEKLY|MONTHLY|YEARLY
+//	INTERVAL=n
+//	COUNT=n or UNTIL=20250630T235959Z (or UNTIL=20250630T235959 or
+//	UNTIL=20250630, in the clinic's time zone)
+//	BYDAY=MO,TH (with an ordinal for MONTHLY, e.g. BYDAY=2TU or BYDAY=-1FR;
+//	with DAILY and YEARLY it limits the occurrences to those weekdays)
+//	BYMONTHDAY=15,-1 (MONTHLY)
+//	BYMONTH=3,9 (YEARLY)
+//	WKST=MO
+//
+// Occurrences keep the wall clock time of DTSTART in its location, so they
+// don't shift when daylight saving time starts or ends.
+package rrule
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+)
+
+type Frequency string
+
+const (
+	Daily   Frequency = "DAILY"
+	Weekly  Frequency = "WEEKLY"
+	Monthly Frequency = "MONTHLY"
+	Yearly  Frequency = "YEARLY"
+)
+
+// maxPeriods stops the expansion of rules that never produce an occurrence
+// (e.g. BYMONTHDAY=31 with BYMONTH=2).
+const maxPeriods = 10000
+
+// WeekdayNum is a BYDAY entry: a weekday, optionally with an ordinal within
+// the month (1 = first, -1 = last, 0 = every).
+type WeekdayNum struct {
+	Weekday time.Weekday
+	N       int
+}
+
+// Rule is a parsed recurrence rule.
+type Rule struct {
+	Freq       Frequency
+	Interval   int
+	Count      int       // 0 if not set
+	Until      time.Time // zero if not set
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+	ByMonth    []time.Month
+	WeekStart  time.Weekday
+}
+
+var weekdayCodes = map[string]time.Weekday{
+	"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday,
+	"TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday,
+}
+
+func weekdayCode(weekday time.Weekday) string {
+	for code, w := range weekdayCodes {
+		if w == weekday {
+			return code
+		}
+	}
+	return ""
+}
+
+// Parse parses a recurrence rule, with or without the "RRULE:" prefix.
+func Parse(value string) (Rule, error) {
+	rule := Rule{Interval: 1, WeekStart: time.Monday}
+	value = strings.TrimPrefix(strings.TrimSpace(value), "RRULE:")
+	if value == "" {
+		return rule, errors.New("empty recurrence rule")
+	}
+	for _, part := range strings.Split(value, ";") {
+		name, val, found := strings.Cut(part, "=")
+		if !found || val == "" {
+			return rule, fmt.Errorf("invalid recurrence rule part %q", part)
+		}
+		var err error
+		switch strings.ToUpper(name) {
+		case "FREQ":
+			rule.Freq = Frequency(strings.ToUpper(val))
+			switch rule.Freq {
+			case Daily, Weekly, Monthly, Yearly:
+			default:
+				return rule, fmt.Errorf("unsupported FREQ %q", val)
+			}
+		case "INTERVAL":
+			rule.Interval, err = strconv.Atoi(val)
+			if err != nil || rule.Interval < 1 {
+				return rule, fmt.Errorf("invalid INTERVAL %q", val)
+			}
+		case "COUNT":
+			rule.Count, err = strconv.Atoi(val)
+			if err != nil || rule.Count < 1 {
+				return rule, fmt.Errorf("invalid COUNT %q", val)
+			}
+		case "UNTIL":
+			rule.Until, err = parseUntil(val)
+			if err != nil {
+				return rule, err
+			}
+		case "BYDAY":
+			for _, day := range strings.Split(val, ",") {
+				weekdayNum, err := parseWeekdayNum(day)
+				if err != nil {
+					return rule, err
+				}
+				rule.ByDay = append(rule.ByDay, weekdayNum)
+			}
+		case "BYMONTHDAY":
+			for _, day := range strings.Split(val, ",") {
+				n, err := strconv.Atoi(day)
+				if err != nil || n == 0 || n < -31 || n > 31 {
+					return rule, fmt.Errorf("invalid BYMONTHDAY %q", day)
+				}
+				rule.ByMonthDay = append(rule.ByMonthDay, n)
+			}
+		case "BYMONTH":
+			for _, month := range strings.Split(val, ",") {
+				n, err := strconv.Atoi(month)
+				if err != nil || n < 1 || n > 12 {
+					return rule, fmt.Errorf("invalid BYMONTH %q", month)
+				}
+				rule.ByMonth = append(rule.ByMonth, time.Month(n))
+			}
+		case "WKST":
+			weekday, ok := weekdayCodes[strings.ToUpper(val)]
+			if !ok {
+				return rule, fmt.Errorf("invalid WKST %q", val)
+			}
+			rule.WeekStart = weekday
+		default:
+			return rule, fmt.Errorf("unsupported recurrence rule part %q", name)
+		}
+	}
+	if rule.Freq == "" {
+		return rule, errors.New("recurrence rule has no FREQ")
+	}
+	if rule.Count > 0 && !rule.Until.IsZero() {
+		return rule, errors.New("recurrence rule cannot have both COUNT and UNTIL")
+	}
+	for _, day := range rule.ByDay {
+		if day.N != 0 && rule.Freq != Monthly {
+			return rule, errors.New("BYDAY ordinals are only supported with FREQ=MONTHLY")
+		}
+	}
+	if len(rule.ByMonthDay) > 0 && rule.Freq != Monthly {
+		return rule, errors.New("BYMONTHDAY is only supported with FREQ=MONTHLY")
+	}
+	if len(rule.ByMonth) > 0 && rule.Freq != Yearly {
+		return rule, errors.New("BYMONTH is only supported with FREQ=YEARLY")
+	}
+	return rule, nil
+}
+
+// parseUntil parses an UNTIL value. A UTC time ends in Z; floating times and
+// dates are in the clinic's time zone, like the series they end.
+func parseUntil(value string) (time.Time, error) {
+	if until, err := time.Parse("20060102T150405Z", value); err == nil {
+		return until, nil
+	}
+	for _, layout := range []string{"20060102T150405", "20060102"} {
+		until, err := time.ParseInLocation(layout, value, clinic.Location)
+		if err == nil {
+			if layout == "20060102" {
+				// a date means "until the end of that day":
+				until = until.AddDate(0, 0, 1).Add(-time.Second)
+			}
+			return until, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid UNTIL %q", value)
+}
+
+func parseWeekdayNum(value string) (WeekdayNum, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if len(value) < 2 {
+		return WeekdayNum{}, fmt.Errorf("invalid BYDAY %q", value)
+	}
+	weekday, ok := weekdayCodes[value[len(value)-2:]]
+	if !ok {
+		return WeekdayNum{}, fmt.Errorf("invalid BYDAY %q", value)
+	}
+	n := 0
+	if ordinal := value[:len(value)-2]; ordinal != "" {
+		var err error
+		n, err = strconv.Atoi(ordinal)
+		if err != nil || n == 0 || n < -5 || n > 5 {
+			return WeekdayNum{}, fmt.Errorf("invalid BYDAY %q", value)
+		}
+	}
+	return WeekdayNum{Weekday: weekday, N: n}, nil
+}
+
+// String formats the rule as an RRULE value (without the "RRULE:" prefix).
+func (r Rule) String() string {
+	parts := []string{"FREQ=" + string(r.Freq)}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		parts = append(parts, "UNTIL="+r.Until.UTC().Format("20060102T150405Z"))
+	}
+	if len(r.ByDay) > 0 {
+		var days []string
+		for _, day := range r.ByDay {
+			code := weekdayCode(day.Weekday)
+			if day.N != 0 {
+				code = strconv.Itoa(day.N) + code
+			}
+			days = append(days, code)
+		}
+		parts = append(parts, "BYDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		var days []string
+		for _, day := range r.ByMonthDay {
+			days = append(days, strconv.Itoa(day))
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(days, ","))
+	}
+	if len(r.ByMonth) > 0 {
+		var months []string
+		for _, month := range r.ByMonth {
+			months = append(months, strconv.Itoa(int(month)))
+		}
+		parts = append(parts, "BYMONTH="+strings.Join(months, ","))
+	}
+	if r.WeekStart != time.Monday {
+		parts = append(parts, "WKST="+weekdayCode(r.WeekStart))
+	}
+	return strings.Join(parts, ";")
+}
+
+// Bounded reports whether the rule ends, i.e. has a COUNT or an UNTIL.
+func (r Rule) Bounded() bool {
+	return r.Count > 0 || !r.Until.IsZero()
+}
+
+// All returns the occurrences of the rule starting at dtstart, in order. At
+// most limit occurrences are returned; the second result reports whether the
+// rule had more occurrences than that.
+func (r Rule) All(dtstart time.Time, limit int) ([]time.Time, bool) {
+	var occurrences []time.Time
+	for period := 0; period < maxPeriods; period++ {
+		for _, candidate := range r.candidates(dtstart, period) {
+			if candidate.Before(dtstart) {
+				continue
+			}
+			if !r.Until.IsZero() && candidate.After(r.Until) {
+				return occurrences, false
+			}
+			if r.Count > 0 && len(occurrences) == r.Count {
+				return occurrences, false
+			}
+			if len(occurrences) == limit {
+				return occurrences, true
+			}
+			occurrences = append(occurrences, candidate)
+		}
+	}
+	return occurrences, false
+}
+
+// candidates returns the sorted occurrences within the period-th period
+// (day, week, month or year, depending on FREQ) after dtstart.
+func (r Rule) candidates(dtstart time.Time, period int) []time.Time {
+	at := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, dtstart.Hour(), dtstart.Minute(), dtstart.Second(), 0, dtstart.Location())
+	}
+	var candidates []time.Time
+	switch r.Freq {
+	case Daily:
+		day := dtstart.AddDate(0, 0, period*r.Interval)
+		if r.matchesWeekday(day.Year(), day.Month(), day.Day()) {
+			candidates = append(candidates, at(day.Year(), day.Month(), day.Day()))
+		}
+	case Weekly:
+		offset := (int(dtstart.Weekday()) - int(r.WeekStart) + 7) % 7
+		weekStart := dtstart.AddDate(0, 0, period*7*r.Interval-offset)
+		weekdays := []time.Weekday{dtstart.Weekday()}
+		if len(r.ByDay) > 0 {
+			weekdays = nil
+			for _, day := range r.ByDay {
+				weekdays = append(weekdays, day.Weekday)
+			}
+		}
+		for _, weekday := range weekdays {
+			day := weekStart.AddDate(0, 0, (int(weekday)-int(r.WeekStart)+7)%7)
+			candidates = append(candidates, at(day.Year(), day.Month(), day.Day()))
+		}
+	case Monthly:
+		first := time.Date(dtstart.Year(), dtstart.Month()+time.Month(period*r.Interval), 1, 0, 0, 0, 0, dtstart.Location())
+		for _, day := range r.monthDays(first, dtstart.Day()) {
+			candidates = append(candidates, at(first.Year(), first.Month(), day))
+		}
+	case Yearly:
+		year := dtstart.Year() + period*r.Interval
+		months := []time.Month{dtstart.Month()}
+		if len(r.ByMonth) > 0 {
+			months = r.ByMonth
+		}
+		for _, month := range months {
+			if dtstart.Day() <= daysIn(year, month) && r.matchesWeekday(year, month, dtstart.Day()) {
+				candidates = append(candidates, at(year, month, dtstart.Day()))
+			}
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+	return candidates
+}
+
+// monthDays returns the days of the month starting at first that match
+// BYDAY and BYMONTHDAY. Without either, it is the day of DTSTART, which is
+// skipped in months that are too short.
+func (r Rule) monthDays(first time.Time, defaultDay int) []int {
+	length := daysIn(first.Year(), first.Month())
+	var byMonthDay map[int]bool
+	if len(r.ByMonthDay) > 0 {
+		byMonthDay = map[int]bool{}
+		for _, day := range r.ByMonthDay {
+			if day < 0 {
+				day = length + day + 1
+			}
+			byMonthDay[day] = true
+		}
+	}
+	var days []int
+	for day := 1; day <= length; day++ {
+		switch {
+		case len(r.ByDay) > 0:
+			if !r.matchesByDay(first, day, length) || (byMonthDay != nil && !byMonthDay[day]) {
+				continue
+			}
+		case byMonthDay != nil:
+			if !byMonthDay[day] {
+				continue
+			}
+		default:
+			if day != defaultDay {
+				continue
+			}
+		}
+		days = append(days, day)
+	}
+	return days
+}
+
+func (r Rule) matchesByDay(first time.Time, day, length int) bool {
+	weekday := first.AddDate(0, 0, day-1).Weekday()
+	for _, byDay := range r.ByDay {
+		if byDay.Weekday != weekday {
+			continue
+		}
+		switch {
+		case byDay.N == 0:
+			return true
+		case byDay.N > 0 && (day-1)/7+1 == byDay.N:
+			return true
+		case byDay.N < 0 && (length-day)/7+1 == -byDay.N:
+			return true
+		}
+	}
+	return false
+}
+
+// matchesWeekday reports whether a day of a DAILY or YEARLY rule falls on
+// one of the BYDAY weekdays, if the rule has any.
+func (r Rule) matchesWeekday(year int, month time.Month, day int) bool {
+	if len(r.ByDay) == 0 {
+		return true
+	}
+	first := time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	return r.matchesByDay(first, day, daysIn(year, month))
+}
+
+func daysIn(year int, month time.Month) int {
+	return time.Date(year, month+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
@@ -0,0 +1,224 @@
+package rrule
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string // the rule formatted again; empty if Parse fails
+		wantErr string
+	}{
+		{value: "FREQ=WEEKLY;BYDAY=TU,TH;COUNT=10", want: "FREQ=WEEKLY;COUNT=10;BYDAY=TU,TH"},
+		{value: "RRULE:FREQ=MONTHLY;BYDAY=2TU", want: "FREQ=MONTHLY;BYDAY=2TU"},
+		{value: "freq=monthly;bymonthday=-1;interval=2", want: "FREQ=MONTHLY;INTERVAL=2;BYMONTHDAY=-1"},
+		{value: "FREQ=YEARLY;BYMONTH=3,9;WKST=SU", want: "FREQ=YEARLY;BYMONTH=3,9;WKST=SU"},
+		{value: "FREQ=DAILY;UNTIL=20250301T100000Z", want: "FREQ=DAILY;UNTIL=20250301T100000Z"},
+		// floating times and dates are in the clinic's time zone (UTC+2 in March):
+		{value: "FREQ=DAILY;UNTIL=20250301T100000", want: "FREQ=DAILY;UNTIL=20250301T080000Z"},
+		{value: "FREQ=DAILY;UNTIL=20250301", want: "FREQ=DAILY;UNTIL=20250301T215959Z"},
+		{value: "", wantErr: "empty recurrence rule"},
+		{value: "COUNT=3", wantErr: "no FREQ"},
+		{value: "FREQ=HOURLY", wantErr: "unsupported FREQ"},
+		{value: "FREQ=DAILY;INTERVAL=0", wantErr: "invalid INTERVAL"},
+		{value: "FREQ=DAILY;COUNT=3;UNTIL=20250301", wantErr: "both COUNT and UNTIL"},
+		{value: "FREQ=WEEKLY;BYDAY=2TU", wantErr: "ordinals are only supported"},
+		{value: "FREQ=MONTHLY;BYDAY=6TU", wantErr: "invalid BYDAY"},
+		{value: "FREQ=WEEKLY;BYMONTHDAY=1", wantErr: "BYMONTHDAY is only supported"},
+		{value: "FREQ=MONTHLY;BYMONTH=1", wantErr: "BYMONTH is only supported"},
+		{value: "FREQ=DAILY;BYHOUR=9", wantErr: "unsupported recurrence rule part"},
+		{value: "FREQ=DAILY;UNTIL=2025-03-01", wantErr: "invalid UNTIL"},
+	}
+	for _, test := range tests {
+		rule, err := Parse(test.value)
+		switch {
+		case test.wantErr != "":
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("Parse(%q) error = %v, want %q", test.value, err, test.wantErr)
+			}
+		case err != nil:
+			t.Errorf("Parse(%q) error = %v", test.value, err)
+		case rule.String() != test.want:
+			t.Errorf("Parse(%q) = %q, want %q", test.value, rule.String(), test.want)
+		}
+	}
+}
+
+func TestAll(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    string
+		dtstart string // in the clinic's time zone
+		limit   int
+		want    []string
+		more    bool
+	}{
+		{
+			name:    "weekly on Tuesdays and Thursdays",
+			rule:    "FREQ=WEEKLY;BYDAY=TU,TH;COUNT=5",
+			dtstart: "2025-03-04 10:00",
+			want:    []string{"2025-03-04 10:00", "2025-03-06 10:00", "2025-03-11 10:00", "2025-03-13 10:00", "2025-03-18 10:00"},
+		},
+		{
+			name:    "every other week",
+			rule:    "FREQ=WEEKLY;INTERVAL=2;COUNT=3",
+			dtstart: "2025-03-05 09:30",
+			want:    []string{"2025-03-05 09:30", "2025-03-19 09:30", "2025-04-02 09:30"},
+		},
+		{
+			name:    "second Tuesday of the month",
+			rule:    "FREQ=MONTHLY;BYDAY=2TU;COUNT=4",
+			dtstart: "2025-01-14 17:00",
+			want:    []string{"2025-01-14 17:00", "2025-02-11 17:00", "2025-03-11 17:00", "2025-04-08 17:00"},
+		},
+		{
+			name:    "last Friday of the month",
+			rule:    "FREQ=MONTHLY;BYDAY=-1FR;COUNT=3",
+			dtstart: "2025-01-31 12:00",
+			want:    []string{"2025-01-31 12:00", "2025-02-28 12:00", "2025-03-28 12:00"},
+		},
+		{
+			name:    "last day of the month",
+			rule:    "FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=4",
+			dtstart: "2024-01-31 08:00",
+			want:    []string{"2024-01-31 08:00", "2024-02-29 08:00", "2024-03-31 08:00", "2024-04-30 08:00"},
+		},
+		{
+			name:    "the 31st is skipped in shorter months",
+			rule:    "FREQ=MONTHLY;COUNT=3",
+			dtstart: "2025-01-31 08:00",
+			want:    []string{"2025-01-31 08:00", "2025-03-31 08:00", "2025-05-31 08:00"},
+		},
+		{
+			name:    "yearly in March and September",
+			rule:    "FREQ=YEARLY;BYMONTH=3,9;COUNT=3",
+			dtstart: "2025-03-10 11:00",
+			want:    []string{"2025-03-10 11:00", "2025-09-10 11:00", "2026-03-10 11:00"},
+		},
+		{
+			name:    "daily on weekdays only",
+			rule:    "FREQ=DAILY;BYDAY=MO,WE,FR;COUNT=4",
+			dtstart: "2025-03-07 10:00",
+			want:    []string{"2025-03-07 10:00", "2025-03-10 10:00", "2025-03-12 10:00", "2025-03-14 10:00"},
+		},
+		{
+			name:    "yearly only when it falls on a Monday",
+			rule:    "FREQ=YEARLY;BYDAY=MO;COUNT=2",
+			dtstart: "2025-03-03 10:00",
+			want:    []string{"2025-03-03 10:00", "2031-03-03 10:00"},
+		},
+		{
+			name:    "COUNT",
+			rule:    "FREQ=DAILY;COUNT=2",
+			dtstart: "2025-03-03 10:00",
+			want:    []string{"2025-03-03 10:00", "2025-03-04 10:00"},
+		},
+		{
+			name:    "UNTIL a date includes that day",
+			rule:    "FREQ=DAILY;UNTIL=20250305",
+			dtstart: "2025-03-03 10:00",
+			want:    []string{"2025-03-03 10:00", "2025-03-04 10:00", "2025-03-05 10:00"},
+		},
+		{
+			name:    "UNTIL a floating time is in the clinic's time zone",
+			rule:    "FREQ=DAILY;UNTIL=20250305T090000",
+			dtstart: "2025-03-03 10:00",
+			want:    []string{"2025-03-03 10:00", "2025-03-04 10:00"},
+		},
+		{
+			name:    "UNTIL a UTC time",
+			rule:    "FREQ=DAILY;UNTIL=20250305T080000Z",
+			dtstart: "2025-03-03 10:00",
+			want:    []string{"2025-03-03 10:00", "2025-03-04 10:00", "2025-03-05 10:00"},
+		},
+		{
+			name:    "the limit stops unbounded rules",
+			rule:    "FREQ=WEEKLY",
+			dtstart: "2025-03-03 10:00",
+			limit:   2,
+			want:    []string{"2025-03-03 10:00", "2025-03-10 10:00"},
+			more:    true,
+		},
+		{
+			name:    "no occurrences",
+			rule:    "FREQ=YEARLY;BYMONTH=2;COUNT=1",
+			dtstart: "2025-01-30 10:00",
+			want:    nil,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule, err := Parse(test.rule)
+			if err != nil {
+				t.Fatalf("Parse(%q): %s", test.rule, err)
+			}
+			limit := test.limit
+			if limit == 0 {
+				limit = 100
+			}
+			occurrences, more := rule.All(clinicTime(t, test.dtstart), limit)
+			var got []string
+			for _, occurrence := range occurrences {
+				got = append(got, occurrence.In(clinic.Location).Format("2006-01-02 15:04"))
+			}
+			if !reflect.DeepEqual(got, test.want) || more != test.more {
+				t.Errorf("All = %v, %v, want %v, %v", got, more, test.want, test.more)
+			}
+		})
+	}
+}
+
+// Occurrences keep their wall clock time across the daylight saving changes
+// of Asia/Nicosia, on the last Sundays of March and October.
+func TestAllAcrossDaylightSaving(t *testing.T) {
+	tests := []struct {
+		rule    string
+		dtstart string
+		want    []string
+	}{
+		{
+			rule:    "FREQ=WEEKLY;COUNT=3",
+			dtstart: "2025-03-24 10:00",
+			want:    []string{"2025-03-24T10:00:00+02:00", "2025-03-31T10:00:00+03:00", "2025-04-07T10:00:00+03:00"},
+		},
+		{
+			rule:    "FREQ=DAILY;COUNT=3",
+			dtstart: "2025-10-25 09:00",
+			want:    []string{"2025-10-25T09:00:00+03:00", "2025-10-26T09:00:00+02:00", "2025-10-27T09:00:00+02:00"},
+		},
+		{
+			rule:    "FREQ=MONTHLY;BYDAY=-1SU;COUNT=2",
+			dtstart: "2025-02-23 11:00",
+			want:    []string{"2025-02-23T11:00:00+02:00", "2025-03-30T11:00:00+03:00"},
+		},
+	}
+	for _, test := range tests {
+		rule, err := Parse(test.rule)
+		if err != nil {
+			t.Fatalf("Parse(%q): %s", test.rule, err)
+		}
+		occurrences, _ := rule.All(clinicTime(t, test.dtstart), 100)
+		var got []string
+		for _, occurrence := range occurrences {
+			got = append(got, occurrence.Format(time.RFC3339))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s from %s = %v, want %v", test.rule, test.dtstart, got, test.want)
+		}
+	}
+}
+
+func clinicTime(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.ParseInLocation("2006-01-02 15:04", value, clinic.Location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
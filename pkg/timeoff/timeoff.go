@@ -0,0 +1,348 @@
+package timeoff
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/holidays"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/gorm"
+)
+
+type HTTPHandler struct {
+	DB  *gorm.DB
+	Ctx context.Context
+}
+
+// Allowed values of models.TimeOff.Recurrence
+const (
+	NoRecurrence = ""
+	Daily        = "daily"
+	Weekly       = "weekly"
+	Monthly      = "monthly"
+	Yearly       = "yearly"
+)
+
+// Block is a single occurrence of a time off entry, i.e. a period during
+// which the clinic, or one practitioner, is busy.
+type Block struct {
+	UUID           string
+	Reason         string
+	AllDay         bool
+	Holiday        string `json:",omitempty"` // key of the public holiday, for holiday closures
+	PractitionerID *uint  `json:",omitempty"` // set when only this practitioner is away
+	Start          time.Time
+	End            time.Time
+}
+
+// Occurrences returns every time off block that intersects [from, to), with
+// recurring entries expanded, sorted by start time. Public holidays the
+// clinic has not opted out of are included as all-day blocks. The time off
+// of every practitioner is included.
+func Occurrences(db *gorm.DB, from, to time.Time) ([]Block, error) {
+	return occurrences(db, from, to)
+}
+
+// OccurrencesFor is like Occurrences, but only returns the blocks that keep
+// the given practitioner from working: the clinic's time off and the
+// practitioner's own. With a nil practitionerID only the clinic's time off
+// is returned.
+func OccurrencesFor(db *gorm.DB, from, to time.Time, practitionerID *uint) ([]Block, error) {
+	if practitionerID == nil {
+		return occurrences(db.Where("practitioner_id IS NULL"), from, to)
+	}
+	return occurrences(db.Where("practitioner_id IS NULL OR practitioner_id = ?", *practitionerID), from, to)
+}
+
+func occurrences(db *gorm.DB, from, to time.Time) ([]Block, error) {
+	var entries []models.TimeOff
+	err := db.Where("start_time < ?", to).
+		Where("(recurrence = '' AND end_time > ?) OR (recurrence <> '' AND (recurrence_until IS NULL OR recurrence_until >= ?))", from, from.AddDate(0, 0, -1)).
+		Order("start_time asc").
+		Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+	blocks := []Block{}
+	for _, entry := range entries {
+		blocks = append(blocks, expand(entry, from, to)...)
+	}
+	observed, err := holidays.Observed(db.Session(&gorm.Session{NewDB: true}), from, to)
+	if err != nil {
+		return nil, err
+	}
+	for _, holiday := range observed {
+		blocks = append(blocks, Block{
+			Reason:  holiday.NameGreek,
+			AllDay:  true,
+			Holiday: holiday.Key,
+			Start:   holiday.Date,
+			End:     holiday.Date.AddDate(0, 0, 1),
+		})
+	}
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].Start.Before(blocks[j].Start) })
+	return blocks, nil
+}
+
+// expand returns the occurrences of entry that intersect [from, to).
+func expand(entry models.TimeOff, from, to time.Time) []Block {
+	var blocks []Block
+	length := entry.EndTime.Sub(entry.StartTime)
+	for n := 0; ; n++ {
+		start := nthStart(entry, n)
+		if !start.Before(to) {
+			break
+		}
+		if entry.RecurrenceUntil != nil && start.After(endOfDay(*entry.RecurrenceUntil)) {
+			break
+		}
+		end := start.Add(length)
+		if entry.AllDay {
+			// keep whole days whole, even across daylight saving changes:
+			end = start.AddDate(0, 0, days(entry))
+		}
+		if end.After(from) {
+			blocks = append(blocks, Block{
+				UUID:           entry.UUID,
+				Reason:         entry.Reason,
+				AllDay:         entry.AllDay,
+				PractitionerID: entry.PractitionerID,
+				Start:          start,
+				End:            end,
+			})
+		}
+		if entry.Recurrence == NoRecurrence {
+			break
+		}
+	}
+	return blocks
+}
+
+// nthStart returns the start of the n-th occurrence of entry. Occurrences are
+// computed from the original start, so that e.g. monthly blocks on the 31st
+// don't drift.
+func nthStart(entry models.TimeOff, n int) time.Time {
+	switch entry.Recurrence {
+	case Daily:
+		return entry.StartTime.AddDate(0, 0, n)
+	case Weekly:
+		return entry.StartTime.AddDate(0, 0, 7*n)
+	case Monthly:
+		return entry.StartTime.AddDate(0, n, 0)
+	case Yearly:
+		return entry.StartTime.AddDate(n, 0, 0)
+	default:
+		return entry.StartTime
+	}
+}
+
+// days returns the number of days covered by an all-day entry.
+func days(entry models.TimeOff) int {
+	n := 0
+	for day := entry.StartTime; day.Before(entry.EndTime); day = day.AddDate(0, 0, 1) {
+		n++
+	}
+	return n
+}
+
+func endOfDay(t time.Time) time.Time {
+	return clinic.StartOfDay(t).AddDate(0, 0, 1)
+}
+
+// normalize validates entry and, for all-day entries, moves StartTime to the
+// start of its day and EndTime to the start of the day after the last
+// blocked day. A missing EndTime makes an all-day entry last one day.
+func normalize(entry *models.TimeOff) error {
+	switch entry.Recurrence {
+	case NoRecurrence, Daily, Weekly, Monthly, Yearly:
+	default:
+		return fmt.Errorf("invalid recurrence %q, expected daily, weekly, monthly or yearly", entry.Recurrence)
+	}
+	if entry.StartTime.IsZero() {
+		return errors.New("missing StartTime")
+	}
+	entry.StartTime = entry.StartTime.In(clinic.Location)
+	entry.EndTime = entry.EndTime.In(clinic.Location)
+	if entry.AllDay {
+		entry.StartTime = clinic.StartOfDay(entry.StartTime)
+		if entry.EndTime.IsZero() || !entry.EndTime.After(entry.StartTime) {
+			entry.EndTime = entry.StartTime.AddDate(0, 0, 1)
+		} else {
+			end := entry.EndTime
+			midnight := clinic.StartOfDay(end)
+			if midnight.Before(end) {
+				midnight = midnight.AddDate(0, 0, 1)
+			}
+			entry.EndTime = midnight
+		}
+	}
+	if !entry.EndTime.After(entry.StartTime) {
+		return errors.New("EndTime must be after StartTime")
+	}
+	if entry.Recurrence != NoRecurrence && entry.RecurrenceUntil != nil && entry.RecurrenceUntil.Before(entry.StartTime) {
+		return errors.New("RecurrenceUntil is before StartTime")
+	}
+	return nil
+}
+
+// NewTimeOff handles POST /time-off.
+func (h *HTTPHandler) NewTimeOff(w http.ResponseWriter, r *http.Request) {
+	var entry models.TimeOff
+	err := json.NewDecoder(r.Body).Decode(&entry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := normalize(&entry); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	entry.CreatedAt = time.Now()
+	entry.UpdatedAt = time.Now()
+	entry.ID = 0
+	tempUUID, _ := uuid.NewV7()
+	entry.UUID = tempUUID.String()
+
+	if err := h.DB.Create(&entry).Error; err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+// ListTimeOff handles GET /time-off. Without parameters it returns every
+// time off entry. With from and to (YYYY-MM-DD) it returns the blocks
+// between those dates instead, with recurring entries expanded. With
+// practitioner (an ID) it only returns what keeps that practitioner from
+// working: the clinic's time off and their own.
+func (h *HTTPHandler) ListTimeOff(w http.ResponseWriter, r *http.Request) {
+	from := r.URL.Query().Get("from")
+	to := r.URL.Query().Get("to")
+	var practitionerID *uint
+	if value := r.URL.Query().Get("practitioner"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 0)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid practitioner %q", value), http.StatusBadRequest)
+			return
+		}
+		practitionerID = new(uint)
+		*practitionerID = uint(id)
+	}
+	if from == "" && to == "" {
+		query := h.DB
+		if practitionerID != nil {
+			query = query.Where("practitioner_id IS NULL OR practitioner_id = ?", *practitionerID)
+		}
+		var entries []models.TimeOff
+		err := query.Order("start_time asc").Find(&entries).Error
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+		return
+	}
+
+	fromDate, err := time.ParseInLocation("2006-01-02", from, clinic.Location)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid from date %q, expected YYYY-MM-DD", from), http.StatusBadRequest)
+		return
+	}
+	toDate, err := time.ParseInLocation("2006-01-02", to, clinic.Location)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("invalid to date %q, expected YYYY-MM-DD", to), http.StatusBadRequest)
+		return
+	}
+	var blocks []Block
+	if practitionerID != nil {
+		blocks, err = OccurrencesFor(h.DB, fromDate, toDate.AddDate(0, 0, 1), practitionerID)
+	} else {
+		blocks, err = Occurrences(h.DB, fromDate, toDate.AddDate(0, 0, 1))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(blocks)
+}
+
+// GetTimeOff handles GET /time-off/{uuid}.
+func (h *HTTPHandler) GetTimeOff(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var entry models.TimeOff
+	err := h.DB.Where("uuid = ?", vars["uuid"]).First(&entry).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+// UpdateTimeOff handles PUT /time-off/{uuid}. The body replaces the entry's
+// times, reason and recurrence.
+func (h *HTTPHandler) UpdateTimeOff(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var changes models.TimeOff
+	err := json.NewDecoder(r.Body).Decode(&changes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := normalize(&changes); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	var entry models.TimeOff
+	err = h.DB.Where("uuid = ?", vars["uuid"]).First(&entry).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	err = h.DB.Model(&entry).Select("PractitionerID", "StartTime", "EndTime", "AllDay", "Reason", "Recurrence", "RecurrenceUntil").Updates(models.TimeOff{
+		PractitionerID:  changes.PractitionerID,
+		StartTime:       changes.StartTime,
+		EndTime:         changes.EndTime,
+		AllDay:          changes.AllDay,
+		Reason:          changes.Reason,
+		Recurrence:      changes.Recurrence,
+		RecurrenceUntil: changes.RecurrenceUntil,
+	}).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+// DeleteTimeOff handles DELETE /time-off/{uuid}.
+func (h *HTTPHandler) DeleteTimeOff(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	var entry models.TimeOff
+	err := h.DB.Where("uuid = ?", vars["uuid"]).First(&entry).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	err = h.DB.Delete(&entry).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,424 @@
+package waitlist
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"github.com/ipmess/dentistbackend/pkg/notifications"
+	"github.com/ipmess/dentistbackend/pkg/workinghours"
+	"gorm.io/gorm"
+)
+
+type HTTPHandler struct {
+	DB  *gorm.DB
+	Ctx context.Context
+}
+
+// AutoNotify makes OfferFreedSlot queue a notification for the best
+// candidate straight away. Otherwise the dentist picks from the suggestions.
+var AutoNotify = false
+
+// Bookable reports whether proposed can be booked as it is: within working
+// hours, clear of time off and of other appointments and their buffer time,
+// with a practitioner and in a resource its type may use. main sets it to
+// appointments.Bookable, which this package cannot import; while it is nil,
+// slots are offered without the check.
+var Bookable func(db *gorm.DB, proposed *models.Appointment) (bool, error)
+
+// Offer statuses
+const (
+	OfferSuggested = "suggested"
+	OfferNotified  = "notified"
+	OfferDismissed = "dismissed"
+)
+
+// parseWeekdays parses the comma separated weekday numbers of an entry.
+func parseWeekdays(value string) ([]time.Weekday, error) {
+	var weekdays []time.Weekday
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || n > 6 {
+			return nil, fmt.Errorf("invalid weekday %q, expected 0 (Sunday) to 6 (Saturday)", part)
+		}
+		weekdays = append(weekdays, time.Weekday(n))
+	}
+	return weekdays, nil
+}
+
+// validate checks the preferences of entry.
+func validate(entry models.WaitlistEntry) error {
+	if entry.PatientID == 0 || entry.AppointmentTypeID == 0 {
+		return errors.New("PatientID and AppointmentTypeID are required")
+	}
+	if entry.Duration < 0 {
+		return errors.New("Duration cannot be negative")
+	}
+	if _, err := parseWeekdays(entry.Weekdays); err != nil {
+		return err
+	}
+	for _, value := range []string{entry.EarliestTime, entry.LatestTime} {
+		if value == "" {
+			continue
+		}
+		if _, err := workinghours.ParseTimeOfDay(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// neededDuration returns the minutes entry needs, which defaults to its
+// appointment type's duration.
+func neededDuration(entry models.WaitlistEntry) int {
+	if entry.Duration == 0 {
+		return entry.AppointmentType.DefaultDuration
+	}
+	return entry.Duration
+}
+
+// score says how well the freed slot [start, start+freedDuration) suits
+// entry, or returns false if it doesn't suit it at all. Better matches get
+// higher scores: the same appointment type as the freed one, a longer wait,
+// and a slot that is not much longer than needed.
+func score(entry models.WaitlistEntry, freed models.Appointment, now time.Time) (int, bool) {
+	needed := neededDuration(entry)
+	if !entry.Active || needed <= 0 || needed > freed.Duration || entry.PatientID == freed.PatientID {
+		return 0, false
+	}
+	start := freed.StartTime.In(clinic.Location)
+	end := start.Add(time.Duration(needed) * time.Minute)
+	if entry.NotBefore != nil && start.Before(*entry.NotBefore) {
+		return 0, false
+	}
+	if entry.NotAfter != nil && !start.Before(*entry.NotAfter) {
+		return 0, false
+	}
+
+	result := 100
+	weekdays, _ := parseWeekdays(entry.Weekdays)
+	if len(weekdays) > 0 {
+		matches := false
+		for _, weekday := range weekdays {
+			if weekday == start.Weekday() {
+				matches = true
+			}
+		}
+		if !matches {
+			return 0, false
+		}
+		result += 10
+	}
+	startMinute := start.Hour()*60 + start.Minute()
+	endMinute := startMinute + needed
+	if entry.EarliestTime != "" {
+		earliest, _ := workinghours.ParseTimeOfDay(entry.EarliestTime)
+		if startMinute < earliest {
+			return 0, false
+		}
+		result += 10
+	}
+	if entry.LatestTime != "" {
+		latest, _ := workinghours.ParseTimeOfDay(entry.LatestTime)
+		if endMinute > latest || end.Day() != start.Day() {
+			return 0, false
+		}
+		result += 10
+	}
+
+	if entry.AppointmentTypeID == freed.AppointmentTypeID {
+		result += 20
+	}
+	waitingDays := int(now.Sub(entry.CreatedAt).Hours() / 24)
+	if waitingDays > 60 {
+		waitingDays = 60
+	}
+	result += waitingDays
+	result -= (freed.Duration - needed) / 5
+	return result, true
+}
+
+// OfferFreedSlot matches the slot freed by a cancelled or moved appointment
+// against the active waitlist entries, and stores the ranked suggestions.
+// Only entries whose appointment could be booked into the slot are offered it.
+// freed must hold the time the appointment had before it was cancelled or
+// moved. If AutoNotify is set, the best candidate is notified straight away.
+func OfferFreedSlot(db *gorm.DB, freed models.Appointment) ([]models.WaitlistOffer, error) {
+	now := time.Now()
+	if !freed.StartTime.After(now) {
+		return nil, nil
+	}
+	var entries []models.WaitlistEntry
+	err := db.Preload("Patient").Preload("AppointmentType").Where("active = ?", true).Find(&entries).Error
+	if err != nil {
+		return nil, err
+	}
+
+	type candidate struct {
+		entry models.WaitlistEntry
+		score int
+	}
+	var candidates []candidate
+	for _, entry := range entries {
+		entryScore, ok := score(entry, freed, now)
+		if !ok || entry.AppointmentType.Archived {
+			continue
+		}
+		// the entry's type may need more buffer time, other rooms or other
+		// practitioners than the freed appointment:
+		if Bookable != nil {
+			proposed := models.Appointment{
+				PatientID:         entry.PatientID,
+				AppointmentTypeID: entry.AppointmentTypeID,
+				AppointmentType:   entry.AppointmentType,
+				StartTime:         freed.StartTime,
+				Duration:          neededDuration(entry),
+			}
+			bookable, err := Bookable(db, &proposed)
+			if err != nil {
+				return nil, err
+			}
+			if !bookable {
+				continue
+			}
+		}
+		candidates = append(candidates, candidate{entry: entry, score: entryScore})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].score != candidates[j].score {
+			return candidates[i].score > candidates[j].score
+		}
+		return candidates[i].entry.CreatedAt.Before(candidates[j].entry.CreatedAt)
+	})
+
+	var offers []models.WaitlistOffer
+	for i, c := range candidates {
+		offer := models.WaitlistOffer{
+			WaitlistEntryID:    c.entry.ID,
+			FreedAppointmentID: freed.ID,
+			StartTime:          freed.StartTime,
+			Duration:           neededDuration(c.entry),
+			Rank:               i + 1,
+			Score:              c.score,
+			Status:             OfferSuggested,
+		}
+		if err := db.Omit("WaitlistEntry").Create(&offer).Error; err != nil {
+			return nil, err
+		}
+		offer.WaitlistEntry = c.entry
+		offers = append(offers, offer)
+	}
+
+	if AutoNotify && len(offers) > 0 {
+		if err := notify(db, &offers[0]); err != nil {
+			return offers, err
+		}
+	}
+	return offers, nil
+}
+
+// OfferFreedSlotOrLog calls OfferFreedSlot and only logs failures,
+// so that a cancellation or move never fails because of the waitlist.
+func OfferFreedSlotOrLog(db *gorm.DB, freed models.Appointment) {
+	offers, err := OfferFreedSlot(db, freed)
+	if err != nil {
+		log.Printf("couldn't match the freed slot at %s against the waitlist: %s\n", freed.StartTime.Format("02 Jan 2006 15:04"), err)
+		return
+	}
+	if len(offers) > 0 {
+		log.Printf("%d waitlist candidates for the freed slot at %s\n", len(offers), freed.StartTime.Format("02 Jan 2006 15:04"))
+	}
+}
+
+// offerMessage returns the message offering the slot of offer to the
+// entry's patient, in the patient's language.
+func offerMessage(entry models.WaitlistEntry, offer models.WaitlistOffer) string {
+	start := offer.StartTime.In(clinic.Location)
+	if entry.Patient.Language == "en" {
+		return fmt.Sprintf("Dear %s, an earlier appointment for %s is available on %s. Please call us if you would like it.",
+			entry.Patient.Name, entry.AppointmentType.Description, start.Format("Monday 02 Jan 2006 at 15:04"))
+	}
+	return fmt.Sprintf("%s, υπάρχει διαθέσιμο νωρίτερο ραντεβού για %s στις %s. Αν το θέλετε, παρακαλούμε τηλεφωνήστε μας.",
+		entry.Patient.Name, entry.AppointmentType.Description, start.Format("02/01/2006 στις 15:04"))
+}
+
+// notify queues a message offering the slot to the offer's patient.
+func notify(db *gorm.DB, offer *models.WaitlistOffer) error {
+	entry := offer.WaitlistEntry
+	message := offerMessage(entry, *offer)
+	_, err := notifications.Queue(db, entry.Patient, nil, notifications.KindWaitlistOffer, message)
+	if err != nil {
+		return err
+	}
+	offer.Status = OfferNotified
+	return db.Model(offer).Update("Status", OfferNotified).Error
+}
+
+// NewEntry handles POST /waitlist.
+func (h *HTTPHandler) NewEntry(w http.ResponseWriter, r *http.Request) {
+	var entry models.WaitlistEntry
+	err := json.NewDecoder(r.Body).Decode(&entry)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validate(entry); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	entry.CreatedAt = time.Now()
+	entry.UpdatedAt = time.Now()
+	entry.ID = 0
+	entry.Active = true
+	tempUUID, _ := uuid.NewV7()
+	entry.UUID = tempUUID.String()
+
+	err = h.DB.Omit("Patient", "AppointmentType").Create(&entry).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+// ListEntries handles GET /waitlist, listing the active entries oldest first.
+func (h *HTTPHandler) ListEntries(w http.ResponseWriter, r *http.Request) {
+	var entries []models.WaitlistEntry
+	err := h.DB.Preload("Patient").Preload("AppointmentType").Where("active = ?", true).Order("created_at asc").Find(&entries).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// GetEntry handles GET /waitlist/{uuid}.
+func (h *HTTPHandler) GetEntry(w http.ResponseWriter, r *http.Request) {
+	var entry models.WaitlistEntry
+	err := h.DB.Preload("Patient").Preload("AppointmentType").Where("uuid = ?", mux.Vars(r)["uuid"]).First(&entry).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+// UpdateEntry handles PUT /waitlist/{uuid}. The body replaces the entry's
+// preferences; "Active": false takes the patient off the waitlist.
+func (h *HTTPHandler) UpdateEntry(w http.ResponseWriter, r *http.Request) {
+	var changes models.WaitlistEntry
+	err := json.NewDecoder(r.Body).Decode(&changes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var entry models.WaitlistEntry
+	err = h.DB.Where("uuid = ?", mux.Vars(r)["uuid"]).First(&entry).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	changes.PatientID = entry.PatientID
+	if changes.AppointmentTypeID == 0 {
+		changes.AppointmentTypeID = entry.AppointmentTypeID
+	}
+	if err := validate(changes); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	err = h.DB.Model(&entry).
+		Select("AppointmentTypeID", "Duration", "Weekdays", "EarliestTime", "LatestTime", "NotBefore", "NotAfter", "Notes", "Active").
+		Updates(&changes).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entry)
+}
+
+// DeleteEntry handles DELETE /waitlist/{uuid}.
+func (h *HTTPHandler) DeleteEntry(w http.ResponseWriter, r *http.Request) {
+	var entry models.WaitlistEntry
+	err := h.DB.Where("uuid = ?", mux.Vars(r)["uuid"]).First(&entry).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	err = h.DB.Delete(&entry).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ListOffers handles GET /waitlist/offers: the suggestions for freed slots
+// that are still in the future, best candidate first for each slot.
+func (h *HTTPHandler) ListOffers(w http.ResponseWriter, r *http.Request) {
+	var offers []models.WaitlistOffer
+	err := h.DB.Preload("WaitlistEntry.Patient").Preload("WaitlistEntry.AppointmentType").
+		Where("start_time > ? AND status <> ?", time.Now(), OfferDismissed).
+		Order("start_time asc, `rank` asc").
+		Find(&offers).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(offers)
+}
+
+// NotifyOffer handles POST /waitlist/offers/{id}/notify, queueing a message
+// that offers the slot to the patient.
+func (h *HTTPHandler) NotifyOffer(w http.ResponseWriter, r *http.Request) {
+	h.updateOffer(w, r, func(offer *models.WaitlistOffer) error {
+		return notify(h.DB, offer)
+	})
+}
+
+// DismissOffer handles POST /waitlist/offers/{id}/dismiss.
+func (h *HTTPHandler) DismissOffer(w http.ResponseWriter, r *http.Request) {
+	h.updateOffer(w, r, func(offer *models.WaitlistOffer) error {
+		offer.Status = OfferDismissed
+		return h.DB.Model(offer).Update("Status", OfferDismissed).Error
+	})
+}
+
+func (h *HTTPHandler) updateOffer(w http.ResponseWriter, r *http.Request, update func(offer *models.WaitlistOffer) error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "invalid offer ID", http.StatusBadRequest)
+		return
+	}
+	var offer models.WaitlistOffer
+	err = h.DB.Preload("WaitlistEntry.Patient").Preload("WaitlistEntry.AppointmentType").First(&offer, id).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := update(&offer); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(offer)
+}
@@ -0,0 +1,255 @@
+package workinghours
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ipmess/dentistbackend/pkg/clinic"
+
+	"github.com/ipmess/dentistbackend/pkg/models"
+	"gorm.io/gorm"
+)
+
+type HTTPHandler struct {
+	DB  *gorm.DB
+	Ctx context.Context
+}
+
+// Shift is one opening period, in minutes after midnight.
+type Shift struct {
+	Opens  int
+	Closes int
+}
+
+// Period is an opening period on a particular date.
+type Period struct {
+	Start time.Time
+	End   time.Time
+}
+
+// Schedule holds weekly opening hours, of the clinic or of a practitioner, with the shifts of each
+// day sorted by opening time.
+type Schedule map[time.Weekday][]Shift
+
+// Load reads the clinic's weekly opening hours from the database.
+func Load(db *gorm.DB) (Schedule, error) {
+	var rows []models.WorkingHours
+	err := db.Where("practitioner_id IS NULL").Order("weekday asc, opens asc").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	return build(rows)
+}
+
+// LoadFor reads the weekly working hours of a practitioner. Practitioners
+// without hours of their own work the clinic's hours.
+func LoadFor(db *gorm.DB, practitionerID uint) (Schedule, error) {
+	var rows []models.WorkingHours
+	err := db.Where("practitioner_id = ?", practitionerID).Order("weekday asc, opens asc").Find(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return Load(db)
+	}
+	return build(rows)
+}
+
+func build(rows []models.WorkingHours) (Schedule, error) {
+	schedule := Schedule{}
+	for _, row := range rows {
+		shift, err := parseShift(row)
+		if err != nil {
+			return nil, err
+		}
+		schedule[row.Weekday] = append(schedule[row.Weekday], shift)
+	}
+	return schedule, nil
+}
+
+// DefaultShift is the opening period of every day while no opening hours
+// have been set up.
+var DefaultShift = Shift{Opens: 8 * 60, Closes: 17 * 60}
+
+// Configured reports whether any opening hours have been set up. Until they
+// are, the clinic is treated as open from 08:00 to 17:00 every day.
+func (s Schedule) Configured() bool {
+	return len(s) > 0
+}
+
+// Periods returns the opening periods on the clinic's date of day.
+func (s Schedule) Periods(day time.Time) []Period {
+	day = day.In(clinic.Location)
+	shifts := s[day.Weekday()]
+	if !s.Configured() {
+		shifts = []Shift{DefaultShift}
+	}
+	var periods []Period
+	for _, shift := range shifts {
+		periods = append(periods, Period{
+			Start: atMinute(day, shift.Opens),
+			End:   atMinute(day, shift.Closes),
+		})
+	}
+	return periods
+}
+
+// Covers reports whether [start, end) lies entirely inside a single opening
+// period.
+func (s Schedule) Covers(start, end time.Time) bool {
+	for _, period := range s.Periods(start) {
+		if !start.Before(period.Start) && !end.After(period.End) {
+			return true
+		}
+	}
+	return false
+}
+
+// atMinute returns the time that is minute minutes after the start of day.
+func atMinute(day time.Time, minute int) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), minute/60, minute%60, 0, 0, day.Location())
+}
+
+// ParseTimeOfDay parses an "HH:MM" string into minutes after midnight.
+// "24:00" is accepted as the end of the day.
+func ParseTimeOfDay(value string) (int, error) {
+	parsed, err := time.Parse("15:04", value)
+	if err == nil && len(value) == 5 {
+		return parsed.Hour()*60 + parsed.Minute(), nil
+	}
+	if value == "24:00" {
+		return 24 * 60, nil
+	}
+	return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", value)
+}
+
+func parseShift(row models.WorkingHours) (Shift, error) {
+	opens, err := ParseTimeOfDay(row.Opens)
+	if err != nil {
+		return Shift{}, err
+	}
+	closes, err := ParseTimeOfDay(row.Closes)
+	if err != nil {
+		return Shift{}, err
+	}
+	return Shift{Opens: opens, Closes: closes}, nil
+}
+
+// validate checks a full weekly schedule: valid weekdays and times, every
+// shift closing after it opens, and no overlapping shifts on the same day.
+func validate(rows []models.WorkingHours) error {
+	byDay := map[time.Weekday][]Shift{}
+	for _, row := range rows {
+		if row.Weekday < time.Sunday || row.Weekday > time.Saturday {
+			return fmt.Errorf("invalid weekday %d, expected 0 (Sunday) to 6 (Saturday)", row.Weekday)
+		}
+		shift, err := parseShift(row)
+		if err != nil {
+			return err
+		}
+		if shift.Closes <= shift.Opens {
+			return fmt.Errorf("%s: %s-%s closes before it opens", row.Weekday, row.Opens, row.Closes)
+		}
+		byDay[row.Weekday] = append(byDay[row.Weekday], shift)
+	}
+	for weekday, shifts := range byDay {
+		sort.Slice(shifts, func(i, j int) bool { return shifts[i].Opens < shifts[j].Opens })
+		for i := 1; i < len(shifts); i++ {
+			if shifts[i].Opens < shifts[i-1].Closes {
+				return fmt.Errorf("%s: opening periods overlap", weekday)
+			}
+		}
+	}
+	return nil
+}
+
+// scope limits a query to the hours of the practitioner given in the
+// "practitioner" query parameter (an ID), or to the clinic's hours.
+func scope(db *gorm.DB, r *http.Request) (*gorm.DB, *uint, error) {
+	value := r.URL.Query().Get("practitioner")
+	if value == "" {
+		return db.Where("practitioner_id IS NULL"), nil, nil
+	}
+	id, err := strconv.ParseUint(value, 10, 0)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid practitioner %q", value)
+	}
+	practitionerID := uint(id)
+	var practitioner models.Practitioner
+	if err := db.First(&practitioner, practitionerID).Error; err != nil {
+		return nil, nil, fmt.Errorf("practitioner %d not found", practitionerID)
+	}
+	return db.Where("practitioner_id = ?", practitionerID), &practitionerID, nil
+}
+
+// ListWorkingHours handles GET /working-hours, or
+// GET /working-hours?practitioner=2 for a practitioner's own hours.
+func (h *HTTPHandler) ListWorkingHours(w http.ResponseWriter, r *http.Request) {
+	query, _, err := scope(h.DB, r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var rows []models.WorkingHours
+	err = query.Order("weekday asc, opens asc").Find(&rows).Error
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rows)
+}
+
+// ReplaceWorkingHours handles PUT /working-hours. The body is the complete
+// weekly schedule, e.g.
+// [{"Weekday": 1, "Opens": "08:00", "Closes": "13:00"}, {"Weekday": 1, "Opens": "16:00", "Closes": "20:00"}]
+// and replaces whatever was configured before. An empty list removes all
+// opening hours, so bookings are no longer restricted.
+// PUT /working-hours?practitioner=2 replaces a practitioner's own hours
+// instead; an empty list makes them work the clinic's hours again.
+func (h *HTTPHandler) ReplaceWorkingHours(w http.ResponseWriter, r *http.Request) {
+	var rows []models.WorkingHours
+	err := json.NewDecoder(r.Body).Decode(&rows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := validate(rows); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	_, practitionerID, err := scope(h.DB.WithContext(h.Ctx), r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for i := range rows {
+		rows[i].ID = 0
+		rows[i].PractitionerID = practitionerID
+	}
+
+	err = h.DB.WithContext(h.Ctx).Transaction(func(tx *gorm.DB) error {
+		existing := tx.Where("practitioner_id IS NULL")
+		if practitionerID != nil {
+			existing = tx.Where("practitioner_id = ?", *practitionerID)
+		}
+		if err := existing.Delete(&models.WorkingHours{}).Error; err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+		return tx.Create(&rows).Error
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(rows)
+}